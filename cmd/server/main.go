@@ -2,79 +2,304 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"imgproxy-proxy/internal/admin"
+	"imgproxy-proxy/internal/health"
 	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
 	"imgproxy-proxy/internal/proxy"
+	"imgproxy-proxy/internal/tracing"
 
 	"github.com/joho/godotenv"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-// Health represents the health check response structure
-type Health struct {
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
-	Version   string    `json:"version"`
+// newChecker creates the readiness checks: the default imgproxy backend, which
+// is required, and the last configuration reload, which is reported but does
+// not make the service unready as the previous configuration stays in effect.
+func newChecker(handler *proxy.ProxyHandler, watcher *proxy.ConfigWatcher, config proxy.Config) *health.Checker {
+	checks := []health.Check{{
+		Name:  "config",
+		Probe: func(context.Context) error { return watcher.Err() },
+	}}
+	if config.HealthCheckBackendPath != "" {
+		checks = append(checks, health.Check{
+			Name:     "imgproxy",
+			Required: true,
+			Probe: health.HTTPProbe(http.DefaultClient, func() string {
+				return strings.TrimSuffix(handler.Config().BaseURL, "/") + config.HealthCheckBackendPath
+			}),
+		})
+	}
+	return health.NewChecker(config.HealthCheckTimeout, config.HealthCheckCacheTTL, checks...)
+}
+
+// registerHealth registers the liveness and readiness endpoints with handle.
+// /health is kept as an alias of /readyz for existing probes. Probe errors are
+// only reported with details, which is meant for the admin listener.
+func registerHealth(handle func(pattern string, handler http.Handler), checker *health.Checker, details bool) {
+	ready := checker.ReadyHandler()
+	if details {
+		ready = checker.ReadyDetailsHandler()
+	}
+	handle("/livez", checker.LiveHandler())
+	handle("/readyz", ready)
+	handle("/health", ready)
 }
 
-// healthHandler returns a handler function for health check requests
-func healthHandler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		health := Health{
-			Status:    "ok",
-			Timestamp: time.Now(),
-			Version:   "1.0.0", // TODO: This could be extracted from build info in a more complex setup
+// newTracerProvider creates the tracer provider sending spans to an OTLP
+// collector, or returns nil when tracing is disabled.
+func newTracerProvider(config proxy.Config, logger *logging.Logger) (*sdktrace.TracerProvider, error) {
+	if config.TracesExporter != proxy.TracesExporterOTLP {
+		return nil, nil
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) { logger.Warn("Trace export failed: %v", err) }))
+	headers, _ := tracing.ParseHeaders(config.OTLPHeaders) // Validated with the configuration
+	return tracing.NewProvider(tracing.Config{
+		Endpoint:    config.OTLPTracesURL(),
+		Headers:     headers,
+		ServiceName: config.ServiceName,
+		SampleRatio: config.TracesSampleRatio,
+	})
+}
+
+// openAccessLog opens the access log configured by ACCESS_LOG. The returned
+// closer closes its file once the server stopped.
+func openAccessLog(config proxy.Config) (*logging.AccessLogger, io.Closer, error) {
+	w, err := logging.OpenAccessLog(config.AccessLog)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err := logging.NewAccessLogger(w, config.AccessLogOptions())
+	if err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+	return access, w, nil
+}
+
+// newAdminServer creates the admin listener handler serving the cache API,
+// metrics, health checks and, if enabled, pprof. Health checks are served
+// without authentication so orchestrators can probe them.
+func newAdminServer(config proxy.Config, handler *proxy.ProxyHandler, registry *prometheus.Registry, checker *health.Checker, logger *logging.Logger) *admin.Server {
+	// Credentials are read from the current configuration, so reloads rotate them
+	auth := func() admin.Auth {
+		current := handler.Config()
+		return admin.Auth{Token: current.AdminToken, Username: current.AdminUsername, Password: current.AdminPassword}
+	}
+	adminServer := admin.NewServer(handler.Cache(), auth, logger)
+	if config.MetricsEnabled {
+		adminServer.Handle(config.MetricsEndpoint, metrics.Handler(registry))
+	}
+	registerHealth(adminServer.HandlePublic, checker, true)
+	if config.AdminPprof {
+		adminServer.HandlePprof()
+	}
+	return adminServer
+}
+
+// watchConfig reloads the handler configuration on SIGHUP and, unless disabled,
+// whenever the config, routes or tenants files change.
+func watchConfig(handler *proxy.ProxyHandler, logger *logging.Logger, interval time.Duration) *proxy.ConfigWatcher {
+	watcher := proxy.NewConfigWatcher(handler, logger)
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			logger.Info("Received SIGHUP, reloading configuration")
+			watcher.Reload()
 		}
+	}()
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(health)
+	if interval > 0 {
+		go watcher.Watch(context.Background(), interval)
 	}
+	return watcher
 }
 
-// loadEnvFile loads environment variables from .env file
-// if it exists, otherwise it uses the environment variables set in the system.
-func loadEnvFile(logger *logging.Logger) {
-	if err := godotenv.Load(); err != nil {
-		logger.Info("No .env file found, using environment variables")
+// checkConfig prints the effective configuration with secrets redacted, followed
+// by every configuration problem found. It returns the process exit code.
+func checkConfig(w io.Writer) int {
+	config, err := proxy.LoadConfig()
+
+	redacted := config.Redacted()
+	for _, setting := range redacted.Settings() {
+		fmt.Fprintln(w, setting)
+	}
+	if len(redacted.Routes) > 0 {
+		routes, _ := json.Marshal(redacted.Routes)
+		fmt.Fprintf(w, "ROUTES=%s\n", routes)
+	}
+	if len(redacted.Tenants) > 0 {
+		tenants, _ := json.Marshal(redacted.Tenants)
+		fmt.Fprintf(w, "TENANTS=%s\n", tenants)
 	}
+
+	if err != nil {
+		fmt.Fprintln(w)
+		var validationErr proxy.ValidationError
+		if !errors.As(err, &validationErr) {
+			fmt.Fprintf(w, "Configuration error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "Configuration has %d error(s):\n", len(validationErr))
+		for _, fieldErr := range validationErr {
+			fmt.Fprintf(w, "  %s\n", fieldErr)
+		}
+		return 1
+	}
+
+	fmt.Fprintln(w, "\nConfiguration OK")
+	return 0
+}
+
+// watchLogLevel switches to debug logging on SIGUSR1. SIGUSR2 restores the
+// configured LOG_LEVEL and removes the level rules set on the admin listener.
+func watchLogLevel(handler *proxy.ProxyHandler, logger *logging.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				logger.SetLevel(logging.LevelDebug)
+				logger.Info("Received SIGUSR1, log level set to %s", logging.LevelDebug)
+				continue
+			}
+			level := handler.Config().LogLevel
+			logger.Info("Received SIGUSR2, restoring log level %s", level)
+			logger.SetLevelRules(nil)
+			logger.SetLevel(level)
+		}
+	}()
+}
+
+// loadEnvFile loads environment variables from the .env file, if it exists,
+// on top of those set in the system. It reports whether the file was loaded.
+func loadEnvFile() bool {
+	return godotenv.Load() == nil
 }
 
 func main() {
-	// Initialize logger with default log level
-	logger := logging.NewLogger(logging.LevelInfo)
-	formatter := logging.NewFormatter()
+	checkOnly := flag.Bool("check-config", false, "Print the effective configuration with secrets redacted and exit, non-zero if it is invalid")
+	flag.Parse()
 
 	// Load environment variables from .env file
-	loadEnvFile(logger)
+	envLoaded := loadEnvFile()
 
-	// Load configuration from environment variables
-	config := proxy.MustLoadConfig()
+	if *checkOnly {
+		os.Exit(checkConfig(os.Stdout))
+	}
 
-	// Update logger with configured log level
-	logger = logging.NewLogger(config.LogLevel)
+	// Load configuration from environment variables and create the logger it
+	// configures; its level can then be changed at runtime
+	config, err := proxy.LoadConfig()
+	logger := logging.New(os.Stdout, config.LogLevel, config.LogFormat)
+	formatter := logging.NewFormatter()
+	if err != nil {
+		logger.Fatal("Configuration error: %v", err)
+	}
+	if !envLoaded {
+		logger.Info("No .env file found, using environment variables")
+	}
 
 	// Create the handler with the loaded configuration
-	handler := proxy.CreateHandler(config)
+	registry := metrics.NewRegistry(config.MetricsGoCollector, config.MetricsProcessCollector)
+	handler := proxy.NewProxyHandler(config, logger, metrics.NewMetrics(registry, config.MetricsNamespace, metrics.WithLabelPolicy(config.MetricsLabelPolicy())))
 
-	// Register the handler for all paths except metrics path
-	http.HandleFunc("/", handler)
+	// Trace requests if an exporter is configured
+	tracerProvider, err := newTracerProvider(config, logger)
+	if err != nil {
+		logger.Fatal("Error setting up tracing: %v", err)
+	}
+	if tracerProvider != nil {
+		handler.SetTracerProvider(tracerProvider)
+		logger.Info("Tracing enabled, exporting spans to %s", config.OTLPTracesURL())
+	}
 
-	// Setup Prometheus metrics endpoint if enabled
-	if config.MetricsEnabled {
-		http.Handle(config.MetricsEndpoint, promhttp.Handler())
+	// Write served requests to a dedicated access log if configured
+	if config.AccessLog != "" {
+		access, closer, err := openAccessLog(config)
+		if err != nil {
+			logger.Fatal("Access log error: %v", err)
+		}
+		defer closer.Close()
+		handler.SetAccessLog(access)
+		logger.Info("Access log enabled (%s format) at %s", config.AccessLogFormat, config.AccessLog)
+	}
+
+	// Apply configuration changes without restarting
+	watcher := watchConfig(handler, logger, config.ConfigWatchInterval)
+	watchLogLevel(handler, logger)
+
+	// Register the handler for all paths except metrics path; it selects routes by host and prefix
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	for _, route := range handler.Routes().Routes() {
+		logger.Info("Route %s: %s%s (%s)", route.Name, route.Host, route.PathPrefix, route.Type)
+	}
+
+	// Setup Prometheus metrics endpoint if enabled; it moves to the admin listener when there is one
+	if config.MetricsEnabled && config.AdminAddr == "" {
+		mux.Handle(config.MetricsEndpoint, metrics.Handler(registry))
 		logger.Info("Prometheus metrics enabled at %s", config.MetricsEndpoint)
 	}
 
-	// Register health check endpoint
-	http.HandleFunc("/health", healthHandler())
+	// Register health check endpoints; readiness reports not ready while shutting down
+	checker := newChecker(handler, watcher, config)
+	registerHealth(mux.Handle, checker, false)
+	version, commit := health.BuildInfo()
+	logger.Info("Version %s (commit %s)", version, commit)
 
-	// Start the server
 	logger.Info(formatter.FormatServerStart(config.ServerPort, config.BaseURL))
-	if err := http.ListenAndServe(config.ServerPort, nil); err != nil {
+	server, err := listen("Server", newServer(config.ServerPort, mux, config))
+	if err != nil {
 		logger.Fatal("Server error: %v", err)
 	}
+	listeners := []listener{server}
+
+	// Start the admin listener with metrics, health checks, pprof and the admin API if configured
+	if config.AdminAddr != "" {
+		adminServer := newAdminServer(config, handler, registry, checker, logger)
+		adminListener, err := listen("Admin listener", newAdminHTTPServer(adminServer.Handler(), config))
+		if err != nil {
+			logger.Fatal("Admin server error: %v", err)
+		}
+		listeners = append(listeners, adminListener)
+		if config.MetricsEnabled {
+			logger.Info("Prometheus metrics enabled at %s on the admin listener", config.MetricsEndpoint)
+		}
+	}
+
+	// Serve until SIGTERM or SIGINT, then drain in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serveErr := serve(ctx, logger, config, checker.StartDraining, listeners...)
+
+	// Send the spans of the last requests
+	flushCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(flushCtx); err != nil {
+			logger.Warn("Error flushing traces: %v", err)
+		}
+	}
+
+	if serveErr != nil {
+		logger.Fatal("Server error: %v", serveErr)
+	}
 }
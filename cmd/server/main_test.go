@@ -1,54 +1,254 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"imgproxy-proxy/internal/health"
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/internal/proxy"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// TestHealthHandler checks if the health handler returns correct status and JSON format
+// TestHealthHandler checks the liveness and readiness endpoints against a
+// healthy and an unreachable backend
 func TestHealthHandler(t *testing.T) {
-	// Create a request to pass to our handler
-	req, err := http.NewRequest("GET", "/health", nil)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	config := proxy.Config{BaseURL: backend.URL, HealthCheckBackendPath: "/health", HealthCheckTimeout: time.Second}
+	handler := proxy.NewProxyHandler(config, logging.NewLogger(logging.LevelFatal), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	watcher := proxy.NewConfigWatcher(handler, logging.NewLogger(logging.LevelFatal))
+	checker := newChecker(handler, watcher, config)
+	mux := http.NewServeMux()
+	registerHealth(mux.Handle, checker, false)
+
+	get := func(path string) (int, health.Response) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s returned content type %q, want application/json", path, contentType)
+		}
+		var response health.Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Errorf("couldn't parse %s response body: %v", path, err)
+		}
+		return rr.Code, response
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/livez", http.StatusOK, health.StatusOK},
+		{"/readyz", http.StatusOK, health.StatusOK},
+		{"/health", http.StatusOK, health.StatusOK},
+	}
+	for _, tt := range tests {
+		code, response := get(tt.path)
+		if code != tt.status || response.Status != tt.want {
+			t.Errorf("%s = %d %q, want %d %q", tt.path, code, response.Status, tt.status, tt.want)
+		}
+		if response.Version == "" || response.Version == "1.0.0" {
+			t.Errorf("%s reported version %q, want the build version", tt.path, response.Version)
+		}
+		if time.Since(response.Timestamp) > time.Minute {
+			t.Errorf("timestamp is too old: %v", response.Timestamp)
+		}
+	}
+	if _, response := get("/readyz"); response.Checks["imgproxy"].Status != health.StatusOK || response.Checks["config"].Status != health.StatusOK {
+		t.Errorf("unexpected checks: %+v", response.Checks)
+	}
+
+	// An unreachable backend makes the service unready but still alive
+	backend.Close()
+	checker = newChecker(handler, watcher, config)
+	mux = http.NewServeMux()
+	registerHealth(mux.Handle, checker, false)
+	if code, response := get("/readyz"); code != http.StatusServiceUnavailable || response.Checks["imgproxy"].Status != health.StatusFailing || response.Checks["imgproxy"].Error != "" {
+		t.Errorf("/readyz = %d %+v with the backend down, want %d and a failing imgproxy check without error details", code, response, http.StatusServiceUnavailable)
+	}
+	mux = http.NewServeMux()
+	registerHealth(mux.Handle, checker, true)
+	if code, response := get("/readyz"); code != http.StatusServiceUnavailable || response.Checks["imgproxy"].Error == "" {
+		t.Errorf("/readyz = %d %+v with details and the backend down, want %d and an imgproxy error", code, response, http.StatusServiceUnavailable)
+	}
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Errorf("/livez = %d with the backend down, want %d", code, http.StatusOK)
+	}
+
+	// Once draining, readiness reports draining
+	checker.StartDraining()
+	if code, response := get("/readyz"); code != http.StatusServiceUnavailable || response.Status != health.StatusDraining {
+		t.Errorf("/readyz = %d %q while draining, want %d %q", code, response.Status, http.StatusServiceUnavailable, health.StatusDraining)
+	}
+}
+
+// TestAdminServer checks that the admin listener serves metrics behind its
+// credentials and health checks without them
+func TestAdminServer(t *testing.T) {
+	config := proxy.Config{
+		MetricsEnabled:   true,
+		MetricsEndpoint:  "/metrics",
+		MetricsNamespace: "test_admin",
+		AdminAddr:        "127.0.0.1:9091",
+		AdminUsername:    "ops",
+		AdminPassword:    "secret",
+	}
+	registry := metrics.NewRegistry(false, false)
+	handler := proxy.NewProxyHandler(config, logging.NewLogger(logging.LevelFatal), metrics.NewMetrics(registry, config.MetricsNamespace))
+	checker := health.NewChecker(time.Second, 0)
+	adminHandler := newAdminServer(config, handler, registry, checker, logging.NewLogger(logging.LevelFatal)).Handler()
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   bool
+		status int
+	}{
+		{"Metrics", "/metrics", true, http.StatusOK},
+		{"Metrics without credentials", "/metrics", false, http.StatusUnauthorized},
+		{"Readiness without credentials", "/readyz", false, http.StatusOK},
+		{"Pprof disabled", "/debug/pprof/", true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.auth {
+				req.SetBasicAuth("ops", "secret")
+			}
+			rr := httptest.NewRecorder()
+			adminHandler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d", rr.Code, tt.status)
+			}
+		})
+	}
+}
+
+// TestServeDrainsRequests checks that shutdown lets in-flight requests finish
+// and reports draining while it waits
+func TestServeDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	config := proxy.Config{ShutdownTimeout: 5 * time.Second}
+	l, err := listen("Server", newServer("127.0.0.1:0", handler, config))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Create a ResponseRecorder to record the response
-	rr := httptest.NewRecorder()
-	handler := healthHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	var draining atomic.Bool
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, logging.NewLogger(logging.LevelFatal), config, func() { draining.Store(true) }, l)
+	}()
 
-	// Call the handler with our test request and response recorder
-	handler.ServeHTTP(rr, req)
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.socket.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
 
-	// Check the status code is 200 OK
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+	<-started
+	cancel()
+	for !draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request got %q, want %q", got, "done")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() error = %v", err)
+	}
+	if _, err := http.Get("http://" + l.socket.Addr().String()); err == nil {
+		t.Error("expected new connections to be refused after shutdown")
 	}
+}
 
-	// Check the content type is application/json
-	expectedContentType := "application/json"
-	if contentType := rr.Header().Get("Content-Type"); contentType != expectedContentType {
-		t.Errorf("handler returned wrong content type: got %v want %v",
-			contentType, expectedContentType)
+func TestNewServer(t *testing.T) {
+	config := proxy.Config{
+		ServerReadTimeout:       time.Second,
+		ServerReadHeaderTimeout: 2 * time.Second,
+		ServerWriteTimeout:      3 * time.Second,
+		ServerIdleTimeout:       4 * time.Second,
+		ServerMaxHeaderBytes:    4096,
+	}
+	server := newServer(":8080", http.NotFoundHandler(), config)
+	if server.ReadTimeout != time.Second || server.ReadHeaderTimeout != 2*time.Second || server.WriteTimeout != 3*time.Second ||
+		server.IdleTimeout != 4*time.Second || server.MaxHeaderBytes != 4096 {
+		t.Errorf("newServer() = %+v, want the configured limits", server)
 	}
+}
 
-	// Parse the response body into a Health struct
-	var health Health
-	if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
-		t.Errorf("couldn't parse response body: %v", err)
+func TestNewAdminHTTPServer(t *testing.T) {
+	config := proxy.Config{AdminAddr: ":9091", ServerWriteTimeout: 3 * time.Second}
+	if server := newAdminHTTPServer(http.NotFoundHandler(), config); server.Addr != ":9091" || server.WriteTimeout != 3*time.Second {
+		t.Errorf("newAdminHTTPServer() = %+v, want the configured write timeout", server)
 	}
+	config.AdminPprof = true
+	if server := newAdminHTTPServer(http.NotFoundHandler(), config); server.WriteTimeout != 0 {
+		t.Errorf("newAdminHTTPServer() write timeout = %v with pprof, want none", server.WriteTimeout)
+	}
+}
 
-	// Verify the health check fields
-	if health.Status != "ok" {
-		t.Errorf("expected status to be 'ok', got %v", health.Status)
+// TestCheckConfig checks that --check-config redacts secrets and reports every problem
+func TestCheckConfig(t *testing.T) {
+	t.Setenv("IMGPROXY_KEY", "0123456789abcdef")
+	t.Setenv("IMGPROXY_SALT", "fedcba9876543210")
+	t.Setenv("IMGPROXY_SECRET", "backend-secret-token")
+	t.Setenv("IMGPROXY_BASE_URL", "http://imgproxy:8080")
+
+	var out bytes.Buffer
+	if code := checkConfig(&out); code != 0 {
+		t.Fatalf("checkConfig() = %d, want 0\n%s", code, out.String())
+	}
+	for _, secret := range []string{"0123456789abcdef", "fedcba9876543210", "backend-secret-token"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("output contains secret %q", secret)
+		}
+	}
+	if !strings.Contains(out.String(), "IMGPROXY_BASE_URL=http://imgproxy:8080") {
+		t.Errorf("output is missing the effective base URL:\n%s", out.String())
 	}
 
-	// Check timestamp is reasonably recent (within last minute)
-	if time.Since(health.Timestamp) > time.Minute {
-		t.Errorf("timestamp is too old: %v", health.Timestamp)
+	t.Setenv("IMGPROXY_SIGNATURE_SIZE", "64")
+	t.Setenv("METRICS_ENDPOINT", "/health")
+	out.Reset()
+	if code := checkConfig(&out); code != 1 {
+		t.Fatalf("checkConfig() = %d, want 1", code)
+	}
+	for _, field := range []string{"IMGPROXY_SIGNATURE_SIZE", "METRICS_ENDPOINT"} {
+		if !strings.Contains(out.String(), "  "+field+": ") {
+			t.Errorf("output does not report %s:\n%s", field, out.String())
+		}
 	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/proxy"
+)
+
+// newServer creates an HTTP server with the configured timeouts and header size limit.
+func newServer(addr string, handler http.Handler, config proxy.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       config.ServerReadTimeout,
+		ReadHeaderTimeout: config.ServerReadHeaderTimeout,
+		WriteTimeout:      config.ServerWriteTimeout,
+		IdleTimeout:       config.ServerIdleTimeout,
+		MaxHeaderBytes:    config.ServerMaxHeaderBytes,
+	}
+}
+
+// newAdminHTTPServer creates the HTTP server of the admin listener. With pprof
+// enabled it has no write timeout, as CPU profiles and execution traces are
+// written for as long as the client asks (?seconds=) and would be cut off.
+func newAdminHTTPServer(handler http.Handler, config proxy.Config) *http.Server {
+	server := newServer(config.AdminAddr, handler, config)
+	if config.AdminPprof {
+		server.WriteTimeout = 0
+	}
+	return server
+}
+
+// listener is a server together with the socket it accepts connections on.
+type listener struct {
+	name   string
+	server *http.Server
+	socket net.Listener
+}
+
+// listen binds the address of the server.
+func listen(name string, server *http.Server) (listener, error) {
+	socket, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return listener{}, err
+	}
+	return listener{name: name, server: server, socket: socket}, nil
+}
+
+// serve runs the listeners until ctx is cancelled or one of them fails. It then
+// calls drain, so health checks report not ready, waits for the shutdown
+// delay and shuts the servers down, letting in-flight requests finish within
+// the shutdown timeout. Connections still open after the timeout are closed.
+func serve(ctx context.Context, logger *logging.Logger, config proxy.Config, drain func(), listeners ...listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			logger.Info("%s listening on %s", l.name, l.socket.Addr())
+			if err := l.server.Serve(l.socket); !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}(l)
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		logger.Info("Shutting down, draining connections for up to %s", config.ShutdownTimeout)
+	case serveErr = <-errs:
+		logger.Error("Server error, shutting down: %v", serveErr)
+	}
+
+	drain()
+	if serveErr == nil && config.ShutdownDelay > 0 {
+		time.Sleep(config.ShutdownDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l listener) {
+			defer wg.Done()
+			if err := l.server.Shutdown(shutdownCtx); err != nil {
+				logger.Warn("%s did not drain within %s, closing remaining connections: %v", l.name, config.ShutdownTimeout, err)
+				l.server.Close()
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	logger.Info("Server stopped")
+	return serveErr
+}
@@ -0,0 +1,340 @@
+// Package admin implements the administration listener of the imgproxy proxy
+// service: the cache and log level APIs plus any operational endpoints mounted
+// on it, such as metrics, health checks and pprof. It is meant to be served on a listener
+// separate from the public image endpoint.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"imgproxy-proxy/internal/cache"
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/pkg/signing"
+)
+
+// Auth holds the credentials accepted by the admin listener. A request is
+// authenticated by either the bearer token or the basic auth credentials;
+// only public endpoints are served when neither is set.
+type Auth struct {
+	Token    string // Bearer token
+	Username string // Basic auth user name
+	Password string // Basic auth password
+}
+
+// allows reports whether the request carries valid credentials.
+func (a Auth) allows(r *http.Request) bool {
+	if a.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, a.Token) {
+			return true
+		}
+	}
+	if a.Username != "" {
+		if username, password, ok := r.BasicAuth(); ok && secureEqual(username, a.Username) && secureEqual(password, a.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureEqual compares secrets in constant time.
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Server holds the dependencies of the admin API.
+type Server struct {
+	cache  *cache.Cache
+	auth   func() Auth // Credentials currently accepted, read on each request
+	logger *logging.Logger
+	mux    *http.ServeMux
+	public map[string]bool // Patterns served without authentication
+}
+
+// PurgeRequest is the body accepted by the cache purge endpoint.
+// Exactly one selector must be set.
+type PurgeRequest struct {
+	SourceURL        string `json:"source_url"`         // Purge all renditions of this source URL
+	EncodedSourceURL string `json:"encoded_source_url"` // Same as SourceURL but URL-safe Base64 encoded, as found in proxy URLs
+	ProxyURL         string `json:"proxy_url"`          // Purge the renditions served for this exact proxy URL
+	Prefix           string `json:"prefix"`             // Purge all renditions whose source URL starts with this prefix
+	All              bool   `json:"all"`                // Purge the whole cache
+}
+
+// PurgeResponse is returned by the cache purge endpoint.
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// LogLevelResponse is returned by the log level endpoints.
+type LogLevelResponse struct {
+	Level logging.Level       `json:"level"` // Level of messages outside requests matched by a rule
+	Rules []logging.LevelRule `json:"rules"` // Level rules that have not expired
+}
+
+// LogLevelRequest is the body accepted by the log level endpoint. Omitted
+// fields are left unchanged; an empty rules list removes all rules.
+type LogLevelRequest struct {
+	Level *logging.Level    `json:"level"`
+	Rules *[]LevelRuleInput `json:"rules"`
+}
+
+// LevelRuleInput is a level rule that may expire after a duration rather than at a set time.
+type LevelRuleInput struct {
+	logging.LevelRule
+	TTL string `json:"ttl,omitempty"` // Duration after which the rule expires, e.g. "15m"
+}
+
+// errorResponse is the JSON body returned on errors.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewServer creates a new admin API server protected by the credentials
+// returned by auth, which is called on each request so credentials can change
+// while the server runs. The cache endpoints answer 404 when c is nil.
+func NewServer(c *cache.Cache, auth func() Auth, logger *logging.Logger) *Server {
+	s := &Server{
+		cache:  c,
+		auth:   auth,
+		logger: logger,
+		mux:    http.NewServeMux(),
+		public: make(map[string]bool),
+	}
+	s.mux.HandleFunc("GET /cache/stats", s.handleCacheStats)
+	s.mux.HandleFunc("GET /cache/entries", s.handleCacheEntries)
+	s.mux.HandleFunc("POST /cache/purge", s.handleCachePurge)
+	s.mux.HandleFunc("GET /log/level", s.handleLogLevel)
+	s.mux.HandleFunc("PUT /log/level", s.handleSetLogLevel)
+	return s
+}
+
+// Handle mounts an additional endpoint, such as metrics, on the admin listener.
+// It requires the same credentials as the admin API.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandlePublic mounts an endpoint served without authentication, such as
+// health checks probed by an orchestrator.
+func (s *Server) HandlePublic(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+	s.public[pattern] = true
+}
+
+// HandlePprof mounts the runtime profiling endpoints under /debug/pprof/.
+func (s *Server) HandlePprof() {
+	s.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+	s.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+	s.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+	s.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+	s.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+}
+
+// Handler returns the HTTP handler serving the admin API.
+func (s *Server) Handler() http.Handler {
+	return s.authenticate(s.mux)
+}
+
+// authenticate rejects requests to non-public endpoints that do not carry
+// valid credentials.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := s.auth()
+		if !auth.allows(r) {
+			if _, pattern := s.mux.Handler(r); !s.public[pattern] {
+				if auth.Token != "" || auth.Username == "" {
+					w.Header().Add("WWW-Authenticate", `Bearer realm="imgproxy-proxy admin"`)
+				}
+				if auth.Username != "" {
+					w.Header().Add("WWW-Authenticate", `Basic realm="imgproxy-proxy admin", charset="UTF-8"`)
+				}
+				writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleCacheStats returns the cache counters.
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCache(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cache.Stats())
+}
+
+// handleCacheEntries lists cache entries, optionally filtered by the
+// source_url, encoded_source_url, proxy_url or prefix query parameters.
+func (s *Server) handleCacheEntries(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCache(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	sourceURL := query.Get("source_url")
+	if encoded := query.Get("encoded_source_url"); encoded != "" {
+		decoded, err := signing.UrlSafeDecode(encoded)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid encoded_source_url"})
+			return
+		}
+		sourceURL = string(decoded)
+	}
+	proxyURL, err := normalizeProxyURL(query.Get("proxy_url"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid proxy_url"})
+		return
+	}
+	prefix := query.Get("prefix")
+
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid limit"})
+			return
+		}
+	}
+
+	entries := s.cache.Entries(func(info cache.Info) bool {
+		return (sourceURL == "" || info.SourceURL == sourceURL) &&
+			(proxyURL == "" || info.ProxyURL == proxyURL) &&
+			(prefix == "" || strings.HasPrefix(info.SourceURL, prefix))
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleCachePurge removes entries selected by a PurgeRequest.
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCache(w) {
+		return
+	}
+
+	var req PurgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body"})
+		return
+	}
+
+	selectors := 0
+	for _, set := range []bool{req.SourceURL != "", req.EncodedSourceURL != "", req.ProxyURL != "", req.Prefix != "", req.All} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "exactly one of source_url, encoded_source_url, proxy_url, prefix or all is required"})
+		return
+	}
+
+	var purged int
+	switch {
+	case req.SourceURL != "":
+		purged = s.cache.PurgeSource(req.SourceURL)
+	case req.EncodedSourceURL != "":
+		decoded, err := signing.UrlSafeDecode(req.EncodedSourceURL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid encoded_source_url"})
+			return
+		}
+		purged = s.cache.PurgeSource(string(decoded))
+	case req.ProxyURL != "":
+		proxyURL, err := normalizeProxyURL(req.ProxyURL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid proxy_url"})
+			return
+		}
+		purged = s.cache.PurgeProxyURL(proxyURL)
+	case req.Prefix != "":
+		purged = s.cache.PurgePrefix(req.Prefix)
+	case req.All:
+		purged = s.cache.PurgeAll()
+	}
+
+	s.logger.Info("Purged %d cache entries", purged)
+	writeJSON(w, http.StatusOK, PurgeResponse{Purged: purged})
+}
+
+// handleLogLevel returns the current log level and level rules.
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, LogLevelResponse{Level: s.logger.Level(), Rules: s.logger.LevelRules()})
+}
+
+// handleSetLogLevel changes the log level and level rules as described by a
+// LogLevelRequest. Nothing is changed if the request is invalid.
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body"})
+		return
+	}
+	if req.Level != nil && (*req.Level < logging.LevelDebug || *req.Level > logging.LevelFatal) {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid level"})
+		return
+	}
+
+	if req.Rules != nil {
+		rules := make([]logging.LevelRule, len(*req.Rules))
+		for i, input := range *req.Rules {
+			if input.TTL != "" {
+				ttl, err := time.ParseDuration(input.TTL)
+				if err != nil || ttl <= 0 {
+					writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid ttl " + strconv.Quote(input.TTL)})
+					return
+				}
+				input.Expires = time.Now().Add(ttl)
+			}
+			rules[i] = input.LevelRule
+		}
+		if err := s.logger.SetLevelRules(rules); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+	if req.Level != nil {
+		s.logger.SetLevel(*req.Level)
+	}
+
+	rules := s.logger.LevelRules()
+	s.logger.Info("Log level set to %s with %d level rule(s)", s.logger.Level(), len(rules))
+	writeJSON(w, http.StatusOK, LogLevelResponse{Level: s.logger.Level(), Rules: rules})
+}
+
+// requireCache writes an error and returns false if caching is disabled.
+func (s *Server) requireCache(w http.ResponseWriter) bool {
+	if s.cache == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "cache is disabled"})
+		return false
+	}
+	return true
+}
+
+// normalizeProxyURL reduces an absolute or relative proxy URL to the request
+// URI (path and query) under which renditions are recorded in the cache.
+func normalizeProxyURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return u.RequestURI(), nil
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,249 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"imgproxy-proxy/internal/cache"
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/pkg/signing"
+)
+
+const testToken = "secret-token"
+
+// staticAuth returns credentials that never change.
+func staticAuth(auth Auth) func() Auth {
+	return func() Auth { return auth }
+}
+
+func newTestServer() (*Server, *cache.Cache) {
+	c := cache.New(1024, 0)
+	c.Set(&cache.Entry{Key: "1", SourceURL: "https://cms.example.com/uploads/a.jpg", ProxyURL: "/s1/w:100/enc?w=50", Body: []byte("aa")})
+	c.Set(&cache.Entry{Key: "2", SourceURL: "https://cms.example.com/uploads/a.jpg", ProxyURL: "/s2/w:200/enc", Body: []byte("bb")})
+	c.Set(&cache.Entry{Key: "3", SourceURL: "https://cms.example.com/uploads/b.jpg", ProxyURL: "/s3/enc", Body: []byte("cc")})
+	return NewServer(c, staticAuth(Auth{Token: testToken}), logging.NewLogger(logging.LevelError)), c
+}
+
+func doRequest(s *Server, method, target, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _ := newTestServer()
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"Missing token", "", http.StatusUnauthorized},
+		{"Wrong token", "nope", http.StatusUnauthorized},
+		{"Valid token", testToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doRequest(s, "GET", "/cache/stats", "", tt.token)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d", rr.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAuthenticationRotation(t *testing.T) {
+	auth := Auth{Token: testToken}
+	s := NewServer(nil, func() Auth { return auth }, logging.NewLogger(logging.LevelError))
+	s.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if rr := doRequest(s, "GET", "/metrics", "", testToken); rr.Code != http.StatusOK {
+		t.Errorf("got status %d with the current token, want %d", rr.Code, http.StatusOK)
+	}
+	auth = Auth{Token: "rotated-token"}
+	if rr := doRequest(s, "GET", "/metrics", "", testToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d with the old token, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := doRequest(s, "GET", "/metrics", "", "rotated-token"); rr.Code != http.StatusOK {
+		t.Errorf("got status %d with the rotated token, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestAuthenticationMethods(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name      string
+		auth      Auth
+		path      string
+		configure func(r *http.Request)
+		status    int
+	}{
+		{"Basic auth", Auth{Username: "ops", Password: "pw"}, "/metrics", func(r *http.Request) { r.SetBasicAuth("ops", "pw") }, http.StatusOK},
+		{"Wrong password", Auth{Username: "ops", Password: "pw"}, "/metrics", func(r *http.Request) { r.SetBasicAuth("ops", "nope") }, http.StatusUnauthorized},
+		{"Bearer or basic", Auth{Token: testToken, Username: "ops", Password: "pw"}, "/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testToken) }, http.StatusOK},
+		{"Public endpoint", Auth{Token: testToken}, "/livez", func(r *http.Request) {}, http.StatusOK},
+		{"No credentials configured", Auth{}, "/metrics", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"Public endpoint without credentials configured", Auth{}, "/livez", func(r *http.Request) {}, http.StatusOK},
+		{"Unknown path", Auth{Token: testToken}, "/nope", func(r *http.Request) {}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, staticAuth(tt.auth), logging.NewLogger(logging.LevelError))
+			s.Handle("/metrics", ok)
+			s.HandlePublic("/livez", ok)
+
+			req := httptest.NewRequest("GET", tt.path, nil)
+			tt.configure(req)
+			rr := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d", rr.Code, tt.status)
+			}
+			if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestHandlePprof(t *testing.T) {
+	s := NewServer(nil, staticAuth(Auth{Token: testToken}), logging.NewLogger(logging.LevelError))
+	if rr := doRequest(s, "GET", "/debug/pprof/", "", testToken); rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d before enabling pprof, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	s.HandlePprof()
+	if rr := doRequest(s, "GET", "/debug/pprof/", "", testToken); rr.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := doRequest(s, "GET", "/debug/pprof/", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a token, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantPurged int
+	}{
+		{"By source URL", `{"source_url":"https://cms.example.com/uploads/a.jpg"}`, http.StatusOK, 2},
+		{"By encoded source URL", `{"encoded_source_url":"` + signing.UrlSafeEncode([]byte("https://cms.example.com/uploads/b.jpg")) + `"}`, http.StatusOK, 1},
+		{"By relative proxy URL", `{"proxy_url":"/s1/w:100/enc?w=50"}`, http.StatusOK, 1},
+		{"By absolute proxy URL", `{"proxy_url":"https://img.example.com/s2/w:200/enc"}`, http.StatusOK, 1},
+		{"By prefix", `{"prefix":"https://cms.example.com/uploads/"}`, http.StatusOK, 3},
+		{"All", `{"all":true}`, http.StatusOK, 3},
+		{"No selector", `{}`, http.StatusBadRequest, 0},
+		{"Two selectors", `{"prefix":"x","all":true}`, http.StatusBadRequest, 0},
+		{"Invalid encoding", `{"encoded_source_url":"***"}`, http.StatusBadRequest, 0},
+		{"Invalid JSON", `{`, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			rr := doRequest(s, "POST", "/cache/purge", tt.body, testToken)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp PurgeResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't parse response body: %v", err)
+			}
+			if resp.Purged != tt.wantPurged {
+				t.Errorf("purged %d entries, want %d", resp.Purged, tt.wantPurged)
+			}
+		})
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	s, c := newTestServer()
+	c.Get("3")
+
+	rr := doRequest(s, "GET", "/cache/entries?source_url=https://cms.example.com/uploads/b.jpg", "", testToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var entries []cache.Info
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("couldn't parse response body: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "3" || entries[0].Hits != 1 || entries[0].Size != 2 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	rr = doRequest(s, "GET", "/cache/entries?limit=2", "", testToken)
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("couldn't parse response body: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected limit to cap entries at 2, got %d", len(entries))
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	s := NewServer(nil, staticAuth(Auth{Token: testToken}), logging.NewLogger(logging.LevelError))
+	rr := doRequest(s, "GET", "/cache/stats", "", testToken)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantLevel  logging.Level
+		wantRules  int
+	}{
+		{"Level", `{"level":"debug"}`, http.StatusOK, logging.LevelDebug, 1},
+		{"Rules", `{"rules":[{"level":"debug","client_ip":"203.0.113.0/24","ttl":"15m"},{"level":"debug","request_id_prefix":"debug-"}]}`, http.StatusOK, logging.LevelWarn, 2},
+		{"Clear rules", `{"rules":[]}`, http.StatusOK, logging.LevelWarn, 0},
+		{"Unknown level", `{"level":"verbose"}`, http.StatusBadRequest, logging.LevelWarn, 1},
+		{"Numeric level", `{"level":3}`, http.StatusBadRequest, logging.LevelWarn, 1},
+		{"Rule without condition", `{"level":"debug","rules":[{"level":"debug"}]}`, http.StatusBadRequest, logging.LevelWarn, 1},
+		{"Invalid client IP", `{"rules":[{"level":"debug","client_ip":"nope"}]}`, http.StatusBadRequest, logging.LevelWarn, 1},
+		{"Invalid TTL", `{"rules":[{"level":"debug","client_ip":"203.0.113.7","ttl":"-1m"}]}`, http.StatusBadRequest, logging.LevelWarn, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logging.NewLogger(logging.LevelWarn)
+			logger.SetLevelRules([]logging.LevelRule{{Level: logging.LevelDebug, ClientIP: "192.0.2.1"}})
+			s := NewServer(nil, staticAuth(Auth{Token: testToken}), logger)
+
+			rr := doRequest(s, "PUT", "/log/level", tt.body, testToken)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if logger.Level() != tt.wantLevel || len(logger.LevelRules()) != tt.wantRules {
+				t.Errorf("level = %s with %d rules, want %s with %d rules", logger.Level(), len(logger.LevelRules()), tt.wantLevel, tt.wantRules)
+			}
+
+			var resp LogLevelResponse
+			if err := json.Unmarshal(doRequest(s, "GET", "/log/level", "", testToken).Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't parse response body: %v", err)
+			}
+			if resp.Level != tt.wantLevel || len(resp.Rules) != tt.wantRules {
+				t.Errorf("GET /log/level = %+v, want level %s with %d rules", resp, tt.wantLevel, tt.wantRules)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Package cache provides an in-memory cache for processed image renditions
+// returned by the backend imgproxy service.
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a single cached rendition.
+type Entry struct {
+	Key        string      // Key uniquely identifies the rendition (the backend URL)
+	SourceURL  string      // SourceURL is the decoded source image URL
+	ProxyURL   string      // ProxyURL is the request URI the client used to reach the proxy
+	StatusCode int         // StatusCode is the backend response status
+	Header     http.Header // Header holds the backend response headers
+	Body       []byte      // Body is the rendition payload
+	CreatedAt  time.Time   // CreatedAt is when the entry was stored
+	ExpiresAt  time.Time   // ExpiresAt is when the entry stops being served (zero means never)
+	hits       int64
+}
+
+// Size returns the number of bytes the entry accounts for in the cache.
+func (e *Entry) Size() int64 {
+	return int64(len(e.Body))
+}
+
+// Info describes a cache entry for inspection without exposing its payload.
+type Info struct {
+	Key       string    `json:"key"`
+	SourceURL string    `json:"source_url"`
+	ProxyURL  string    `json:"proxy_url"`
+	Size      int64     `json:"size"`
+	Age       float64   `json:"age_seconds"`
+	Hits      int64     `json:"hits"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Stats summarises the state of the cache.
+type Stats struct {
+	Entries  int   `json:"entries"`
+	Size     int64 `json:"size"`
+	MaxSize  int64 `json:"max_size"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Evicted  int64 `json:"evicted"`
+	Purged   int64 `json:"purged"`
+	Inserted int64 `json:"inserted"`
+}
+
+// Cache is a size-bounded LRU cache of image renditions.
+// It is safe for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	maxSize int64
+	ttl     time.Duration
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   Stats
+
+	now func() time.Time // For testing purposes, we can swap this out
+}
+
+// New creates a cache holding at most maxSize bytes of rendition bodies.
+// Entries older than ttl are no longer served; a zero ttl disables expiry.
+func New(maxSize int64, ttl time.Duration) *Cache {
+	return &Cache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the entry stored under key and records a hit.
+// Expired entries are removed and reported as a miss.
+func (c *Cache) Get(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*Entry)
+	if !entry.ExpiresAt.IsZero() && c.now().After(entry.ExpiresAt) {
+		c.removeElement(elem)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry.hits++
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// Set stores an entry, replacing any existing entry with the same key and
+// evicting the least recently used entries until the cache fits.
+// Entries larger than the whole cache are not stored.
+func (c *Cache) Set(entry *Entry) bool {
+	return c.SetWithTTL(entry, c.ttl)
+}
+
+// SetWithTTL behaves like Set but overrides the cache-wide TTL for this entry.
+func (c *Cache) SetWithTTL(entry *Entry, ttl time.Duration) bool {
+	if entry.Size() > c.maxSize {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.Key]; ok {
+		c.removeElement(elem)
+	}
+
+	entry.CreatedAt = c.now()
+	if ttl > 0 {
+		entry.ExpiresAt = entry.CreatedAt.Add(ttl)
+	}
+	entry.hits = 0
+
+	c.entries[entry.Key] = c.lru.PushFront(entry)
+	c.size += entry.Size()
+	c.stats.Inserted++
+
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeElement(oldest)
+		c.stats.Evicted++
+	}
+	return true
+}
+
+// PurgeSource removes every rendition of the given source URL.
+func (c *Cache) PurgeSource(sourceURL string) int {
+	return c.purge(func(e *Entry) bool { return e.SourceURL == sourceURL })
+}
+
+// PurgeProxyURL removes the renditions served for an exact proxy request URI.
+func (c *Cache) PurgeProxyURL(proxyURL string) int {
+	return c.purge(func(e *Entry) bool { return e.ProxyURL == proxyURL })
+}
+
+// PurgePrefix removes every rendition whose source URL starts with prefix.
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.purge(func(e *Entry) bool { return strings.HasPrefix(e.SourceURL, prefix) })
+}
+
+// PurgeAll empties the cache.
+func (c *Cache) PurgeAll() int {
+	return c.purge(func(*Entry) bool { return true })
+}
+
+// Entries returns information about the cached entries matching filter,
+// most recently used first. A nil filter matches every entry.
+func (c *Cache) Entries(filter func(Info) bool) []Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	infos := make([]Info, 0, len(c.entries))
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*Entry)
+		info := Info{
+			Key:       entry.Key,
+			SourceURL: entry.SourceURL,
+			ProxyURL:  entry.ProxyURL,
+			Size:      entry.Size(),
+			Age:       now.Sub(entry.CreatedAt).Seconds(),
+			Hits:      entry.hits,
+			CreatedAt: entry.CreatedAt,
+		}
+		if filter == nil || filter(info) {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Size = c.size
+	stats.MaxSize = c.maxSize
+	return stats
+}
+
+// purge removes all entries matching the predicate and returns how many were removed.
+func (c *Cache) purge(match func(*Entry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*Entry)) {
+			c.removeElement(elem)
+			purged++
+		}
+		elem = next
+	}
+	c.stats.Purged += int64(purged)
+	return purged
+}
+
+// removeElement unlinks an element from the LRU list and index. The caller must hold mu.
+func (c *Cache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*Entry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.Key)
+	c.size -= entry.Size()
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func newEntry(key, source, proxyURL string, size int) *Entry {
+	return &Entry{
+		Key:        key,
+		SourceURL:  source,
+		ProxyURL:   proxyURL,
+		StatusCode: 200,
+		Body:       make([]byte, size),
+	}
+}
+
+func TestCacheGetSet(t *testing.T) {
+	c := New(1024, 0)
+
+	if _, ok := c.Get("missing"); ok {
+		t.Fatal("expected miss for unknown key")
+	}
+
+	c.Set(newEntry("a", "https://example.com/a.jpg", "/sig/a", 10))
+	entry, ok := c.Get("a")
+	if !ok {
+		t.Fatal("expected hit after Set")
+	}
+	if entry.SourceURL != "https://example.com/a.jpg" {
+		t.Errorf("unexpected source URL %q", entry.SourceURL)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Size != 10 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := New(25, 0)
+
+	c.Set(newEntry("a", "src-a", "/a", 10))
+	c.Set(newEntry("b", "src-b", "/b", 10))
+	c.Get("a") // a becomes most recently used
+	c.Set(newEntry("c", "src-c", "/c", 10))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("expected recently used entry to survive eviction")
+	}
+	if c.Stats().Size != 20 {
+		t.Errorf("expected size 20, got %d", c.Stats().Size)
+	}
+
+	if c.Set(newEntry("huge", "src", "/huge", 100)) {
+		t.Error("expected oversized entry to be rejected")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := New(1024, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Set(newEntry("a", "src", "/a", 1))
+	now = now.Add(2 * time.Minute)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected expired entry to be a miss")
+	}
+	if c.Stats().Entries != 0 {
+		t.Error("expected expired entry to be removed")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	setup := func() *Cache {
+		c := New(1024, 0)
+		c.Set(newEntry("1", "https://cms.example.com/uploads/a.jpg", "/s1/w:100/x", 1))
+		c.Set(newEntry("2", "https://cms.example.com/uploads/a.jpg", "/s2/w:200/x", 1))
+		c.Set(newEntry("3", "https://cms.example.com/uploads/b.jpg", "/s3/y", 1))
+		c.Set(newEntry("4", "https://other.example.com/c.jpg", "/s4/z", 1))
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		purge     func(*Cache) int
+		wantCount int
+		wantLeft  int
+	}{
+		{"By source", func(c *Cache) int { return c.PurgeSource("https://cms.example.com/uploads/a.jpg") }, 2, 2},
+		{"By proxy URL", func(c *Cache) int { return c.PurgeProxyURL("/s3/y") }, 1, 3},
+		{"By prefix", func(c *Cache) int { return c.PurgePrefix("https://cms.example.com/") }, 3, 1},
+		{"All", func(c *Cache) int { return c.PurgeAll() }, 4, 0},
+		{"No match", func(c *Cache) int { return c.PurgeSource("nope") }, 0, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := setup()
+			if got := tt.purge(c); got != tt.wantCount {
+				t.Errorf("purged %d entries, want %d", got, tt.wantCount)
+			}
+			if left := c.Stats().Entries; left != tt.wantLeft {
+				t.Errorf("%d entries left, want %d", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	c := New(1024, 0)
+	c.Set(newEntry("a", "src-a", "/a", 3))
+	c.Set(newEntry("b", "src-b", "/b", 5))
+	c.Get("a")
+	c.Get("a")
+
+	infos := c.Entries(nil)
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(infos))
+	}
+	if infos[0].Key != "a" || infos[0].Hits != 2 || infos[0].Size != 3 {
+		t.Errorf("unexpected first entry %+v", infos[0])
+	}
+
+	filtered := c.Entries(func(i Info) bool { return i.SourceURL == "src-b" })
+	if len(filtered) != 1 || filtered[0].Key != "b" {
+		t.Errorf("unexpected filtered entries %+v", filtered)
+	}
+}
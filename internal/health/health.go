@@ -0,0 +1,258 @@
+// Package health implements the liveness and readiness endpoints of the
+// imgproxy proxy service and reports its build version.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overall and per-check statuses reported in responses.
+const (
+	StatusOK          = "ok"          // Everything works
+	StatusDegraded    = "degraded"    // An optional check fails; the service is still ready
+	StatusUnavailable = "unavailable" // A required check fails; the service is not ready
+	StatusDraining    = "draining"    // The service is shutting down
+	StatusFailing     = "failing"     // Status of a failing check
+)
+
+// Version and Commit identify the build. They are set with
+// -ldflags "-X imgproxy-proxy/internal/health.Version=v1.2.3 -X imgproxy-proxy/internal/health.Commit=abc123"
+// and otherwise taken from the module and VCS information embedded by the Go toolchain.
+var (
+	Version string
+	Commit  string
+)
+
+// BuildInfo returns the version and commit of the running binary.
+func BuildInfo() (version string, commit string) {
+	version, commit = Version, Commit
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if version == "" {
+			version = "devel"
+		}
+		return version, commit
+	}
+
+	if version == "" {
+		version = info.Main.Version
+		if version == "" || version == "(devel)" {
+			version = "devel"
+		}
+	}
+	if commit == "" {
+		modified := false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				commit = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if commit != "" && modified {
+			commit += "-dirty"
+		}
+	}
+	return version, commit
+}
+
+// Check is a dependency probed by the readiness endpoint.
+type Check struct {
+	Name     string                          // Name is the key of the check in responses
+	Required bool                            // Required checks make the service not ready when they fail
+	Probe    func(ctx context.Context) error // Probe returns an error when the dependency is unhealthy
+}
+
+// CheckResult is the outcome of a check.
+type CheckResult struct {
+	Status    string    `json:"status"`
+	Required  bool      `json:"required"`
+	Error     string    `json:"error,omitempty"`
+	Latency   float64   `json:"latency_ms"` // Latency is the probe duration in milliseconds
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Response is the JSON body of the health endpoints.
+type Response struct {
+	Status    string                 `json:"status"`
+	Timestamp time.Time              `json:"timestamp"`
+	Version   string                 `json:"version"`
+	Commit    string                 `json:"commit,omitempty"`
+	Checks    map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Checker runs the readiness checks and serves the health endpoints.
+// Check results are cached so frequent probes do not overload dependencies.
+type Checker struct {
+	checks   []Check
+	timeout  time.Duration
+	ttl      time.Duration
+	draining atomic.Bool
+	now      func() time.Time
+
+	mu      sync.Mutex // Held while probing, so concurrent requests share one round of checks
+	results map[string]CheckResult
+	expires time.Time
+}
+
+// NewChecker creates a checker running each check with the given timeout and
+// caching the results for ttl.
+func NewChecker(timeout time.Duration, ttl time.Duration, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout, ttl: ttl, now: time.Now}
+}
+
+// StartDraining marks the service as shutting down; it is reported as not ready from then on.
+func (c *Checker) StartDraining() {
+	c.draining.Store(true)
+}
+
+// Results returns the results of all checks, probing the dependencies when the cached results expired.
+func (c *Checker) Results(ctx context.Context) map[string]CheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results != nil && c.now().Before(c.expires) {
+		return c.results
+	}
+
+	results := make(map[string]CheckResult, len(c.checks))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			result := c.run(ctx, check)
+			resultsMu.Lock()
+			results[check.Name] = result
+			resultsMu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	c.results = results
+	c.expires = c.now().Add(c.ttl)
+	return results
+}
+
+// run probes a dependency within the check timeout.
+func (c *Checker) run(ctx context.Context, check Check) CheckResult {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := c.now()
+	err := check.Probe(ctx)
+	result := CheckResult{Status: StatusOK, Required: check.Required, Latency: float64(c.now().Sub(start)) / float64(time.Millisecond), CheckedAt: start}
+	if err != nil {
+		result.Status = StatusFailing
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// LiveHandler serves the liveness endpoint. It succeeds while the process can
+// serve requests, regardless of its dependencies.
+func (c *Checker) LiveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.write(w, http.StatusOK, StatusOK, nil)
+	}
+}
+
+// ReadyHandler serves the readiness endpoint. It returns 503 Service Unavailable
+// while draining or when a required check fails, with the status of every check.
+// Probe errors are left out, as they may reveal internal addresses; use
+// ReadyDetailsHandler on listeners that are not exposed publicly.
+func (c *Checker) ReadyHandler() http.HandlerFunc {
+	return c.readyHandler(false)
+}
+
+// ReadyDetailsHandler serves the readiness endpoint like ReadyHandler,
+// including the error of every failing check.
+func (c *Checker) ReadyDetailsHandler() http.HandlerFunc {
+	return c.readyHandler(true)
+}
+
+// readyHandler serves the readiness endpoint, with probe errors if details is set.
+func (c *Checker) readyHandler(details bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.draining.Load() {
+			c.write(w, http.StatusServiceUnavailable, StatusDraining, nil)
+			return
+		}
+
+		// Probes outlive a cancelled request, as their results are shared
+		results := c.Results(context.WithoutCancel(r.Context()))
+		status, code := StatusOK, http.StatusOK
+		for _, result := range results {
+			if result.Status == StatusOK {
+				continue
+			}
+			if result.Required {
+				status, code = StatusUnavailable, http.StatusServiceUnavailable
+				break
+			}
+			status = StatusDegraded
+		}
+		if !details {
+			results = withoutErrors(results)
+		}
+		c.write(w, code, status, results)
+	}
+}
+
+// withoutErrors returns a copy of results with the probe errors removed.
+func withoutErrors(results map[string]CheckResult) map[string]CheckResult {
+	stripped := make(map[string]CheckResult, len(results))
+	for name, result := range results {
+		result.Error = ""
+		stripped[name] = result
+	}
+	return stripped
+}
+
+// write sends a health response.
+func (c *Checker) write(w http.ResponseWriter, code int, status string, results map[string]CheckResult) {
+	version, commit := BuildInfo()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Response{
+		Status:    status,
+		Timestamp: c.now(),
+		Version:   version,
+		Commit:    commit,
+		Checks:    results,
+	})
+}
+
+// HTTPProbe returns a probe requesting the URL returned by url and failing
+// unless the response status is 2xx. The URL is resolved on every probe, so it
+// follows configuration reloads.
+func HTTPProbe(client *http.Client, url func() string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
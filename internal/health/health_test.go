@@ -0,0 +1,154 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyHandler(t *testing.T) {
+	failing := func(context.Context) error { return errors.New("down") }
+	passing := func(context.Context) error { return nil }
+
+	tests := []struct {
+		name     string
+		checks   []Check
+		draining bool
+		code     int
+		status   string
+	}{
+		{"No checks", nil, false, http.StatusOK, StatusOK},
+		{"Passing", []Check{{Name: "a", Required: true, Probe: passing}}, false, http.StatusOK, StatusOK},
+		{"Optional failing", []Check{{Name: "a", Required: true, Probe: passing}, {Name: "b", Probe: failing}}, false, http.StatusOK, StatusDegraded},
+		{"Required failing", []Check{{Name: "a", Required: true, Probe: failing}, {Name: "b", Probe: passing}}, false, http.StatusServiceUnavailable, StatusUnavailable},
+		{"Draining", []Check{{Name: "a", Required: true, Probe: passing}}, true, http.StatusServiceUnavailable, StatusDraining},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(time.Second, time.Minute, tt.checks...)
+			if tt.draining {
+				checker.StartDraining()
+			}
+
+			rr := httptest.NewRecorder()
+			checker.ReadyHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+			var response Response
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("couldn't parse response body: %v", err)
+			}
+			if rr.Code != tt.code || response.Status != tt.status {
+				t.Errorf("ReadyHandler() = %d %q, want %d %q", rr.Code, response.Status, tt.code, tt.status)
+			}
+			if !tt.draining && len(response.Checks) != len(tt.checks) {
+				t.Errorf("got %d check results, want %d", len(response.Checks), len(tt.checks))
+			}
+		})
+	}
+}
+
+func TestReadyDetailsHandler(t *testing.T) {
+	checker := NewChecker(time.Second, time.Minute, Check{Name: "a", Probe: func(context.Context) error {
+		return errors.New("dial tcp 10.0.0.5:8080: connection refused")
+	}})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		error   string
+	}{
+		{"Public", checker.ReadyHandler(), ""},
+		{"Details", checker.ReadyDetailsHandler(), "dial tcp 10.0.0.5:8080: connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+			var response Response
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("couldn't parse response body: %v", err)
+			}
+			if result := response.Checks["a"]; result.Status != StatusFailing || result.Error != tt.error {
+				t.Errorf("check result = %+v, want status %q and error %q", result, StatusFailing, tt.error)
+			}
+		})
+	}
+}
+
+func TestCheckerCachesResults(t *testing.T) {
+	probes := 0
+	checker := NewChecker(time.Second, 5*time.Second, Check{Name: "a", Probe: func(context.Context) error {
+		probes++
+		return nil
+	}})
+	now := time.Now()
+	checker.now = func() time.Time { return now }
+
+	checker.Results(context.Background())
+	checker.Results(context.Background())
+	if probes != 1 {
+		t.Errorf("got %d probes within the TTL, want 1", probes)
+	}
+
+	now = now.Add(6 * time.Second)
+	checker.Results(context.Background())
+	if probes != 2 {
+		t.Errorf("got %d probes after the TTL, want 2", probes)
+	}
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	checker := NewChecker(10*time.Millisecond, 0, Check{Name: "slow", Required: true, Probe: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	result := checker.Results(context.Background())["slow"]
+	if result.Status != StatusFailing || result.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Results() = %+v, want a deadline exceeded failure", result)
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"/health", false},
+		{"/broken", true},
+	}
+	for _, tt := range tests {
+		probe := HTTPProbe(backend.Client(), func() string { return backend.URL + tt.path })
+		if err := probe(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("HTTPProbe(%s) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func(version, commit string) { Version, Commit = version, commit }(Version, Commit)
+
+	Version, Commit = "v1.2.3", "abc123"
+	if version, commit := BuildInfo(); version != "v1.2.3" || commit != "abc123" {
+		t.Errorf("BuildInfo() = %q, %q, want the ldflags values", version, commit)
+	}
+
+	Version, Commit = "", ""
+	if version, _ := BuildInfo(); version == "" {
+		t.Error("BuildInfo() returned an empty version")
+	}
+}
@@ -0,0 +1,213 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessFormatCombined = "combined" // Apache Combined Log Format
+	AccessFormatJSON     = "json"     // One JSON object per line
+	AccessFormatTemplate = "template" // A Go text/template executed with the AccessEntry
+)
+
+// AccessEntry describes a served request in the access log.
+type AccessEntry struct {
+	Time            time.Time     // Time the request was received
+	RemoteAddr      string        // Client IP address
+	Method          string        // Request method
+	URI             string        // Request URI, possibly redacted
+	Proto           string        // Protocol, e.g. HTTP/1.1
+	Status          int           // Response status code
+	Bytes           int64         // Size of the response body
+	Duration        time.Duration // Time taken to serve the request
+	Referer         string        // Referer request header
+	UserAgent       string        // User-Agent request header
+	RequestID       string        // ID of the request, also found in application logs
+	Tenant          string        // Tenant serving the request
+	Route           string        // Route serving the request
+	Cache           string        // Cache status, HIT or MISS, when caching is enabled
+	BackendHost     string        // Host of the imgproxy backend, when the request was forwarded
+	UpstreamLatency time.Duration // Time spent fetching the backend response
+}
+
+// AccessLogOptions configures an access logger.
+type AccessLogOptions struct {
+	Format     string  // Format is one of the access log formats; Combined when empty
+	Template   string  // Template is the Go template of the template format
+	SampleRate float64 // SampleRate is the ratio of 2xx responses logged; other responses are always logged
+}
+
+// AccessLogger writes one line per served request to a dedicated stream,
+// separate from application logs. It is safe for concurrent use.
+type AccessLogger struct {
+	w          io.Writer
+	format     string
+	template   *template.Template
+	sampleRate float64
+	sample     func() float64
+
+	mu sync.Mutex
+}
+
+// NewAccessLogger creates an access logger writing to w. It returns an error
+// if the format is unknown or the template is invalid.
+func NewAccessLogger(w io.Writer, options AccessLogOptions) (*AccessLogger, error) {
+	a := &AccessLogger{w: w, format: options.Format, sampleRate: options.SampleRate, sample: rand.Float64}
+	switch options.Format {
+	case "":
+		a.format = AccessFormatCombined
+	case AccessFormatCombined, AccessFormatJSON:
+	case AccessFormatTemplate:
+		tmpl, err := template.New("access").Parse(options.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+		a.template = tmpl
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, must be %s, %s or %s", options.Format, AccessFormatCombined, AccessFormatJSON, AccessFormatTemplate)
+	}
+	return a, nil
+}
+
+// OpenAccessLog opens the destination of the access log: "stdout", "stderr"
+// or the path of a file, which is created if needed and appended to.
+func OpenAccessLog(destination string) (io.WriteCloser, error) {
+	switch destination {
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	}
+	return os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+// nopCloser keeps the standard streams open when the access log is closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Log writes an entry. 2xx responses are sampled with the sample rate, so
+// errors and redirects are always logged.
+func (a *AccessLogger) Log(entry AccessEntry) {
+	if entry.Status >= 200 && entry.Status <= 299 && a.sampleRate < 1 && a.sample() >= a.sampleRate {
+		return
+	}
+
+	var line bytes.Buffer
+	switch a.format {
+	case AccessFormatJSON:
+		json.NewEncoder(&line).Encode(newAccessJSON(entry))
+	case AccessFormatTemplate:
+		if err := a.template.Execute(&line, entry); err != nil {
+			line.Reset()
+			fmt.Fprintf(&line, "access log template error: %v", err)
+		}
+		if line.Len() == 0 || line.Bytes()[line.Len()-1] != '\n' {
+			line.WriteByte('\n')
+		}
+	default:
+		writeCombined(&line, entry)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(line.Bytes())
+}
+
+// writeCombined formats an entry in the Apache Combined Log Format:
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+func writeCombined(line *bytes.Buffer, entry AccessEntry) {
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+	fmt.Fprintf(line, "%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		orDash(entry.RemoteAddr),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, escapeQuoted(entry.URI), entry.Proto,
+		entry.Status, size,
+		orDash(escapeQuoted(entry.Referer)), orDash(escapeQuoted(entry.UserAgent)),
+	)
+}
+
+// orDash returns "-" for empty values, as Apache does.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// escapeQuoted escapes quotes, backslashes and control characters of a value
+// written between quotes, so clients cannot forge log lines.
+func escapeQuoted(value string) string {
+	var b strings.Builder
+	for _, c := range value {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// accessJSON is the JSON encoding of an entry.
+type accessJSON struct {
+	Time            string  `json:"time"`
+	RemoteAddr      string  `json:"remote_addr"`
+	Method          string  `json:"method"`
+	URI             string  `json:"uri"`
+	Proto           string  `json:"proto"`
+	Status          int     `json:"status"`
+	Bytes           int64   `json:"bytes"`
+	Duration        float64 `json:"duration_ms"`
+	Referer         string  `json:"referer,omitempty"`
+	UserAgent       string  `json:"user_agent,omitempty"`
+	RequestID       string  `json:"request_id,omitempty"`
+	Tenant          string  `json:"tenant,omitempty"`
+	Route           string  `json:"route,omitempty"`
+	Cache           string  `json:"cache,omitempty"`
+	BackendHost     string  `json:"backend_host,omitempty"`
+	UpstreamLatency float64 `json:"upstream_latency_ms,omitempty"`
+}
+
+// newAccessJSON converts an entry for JSON encoding, with durations in milliseconds.
+func newAccessJSON(entry AccessEntry) accessJSON {
+	return accessJSON{
+		Time:            entry.Time.Format(time.RFC3339Nano),
+		RemoteAddr:      entry.RemoteAddr,
+		Method:          entry.Method,
+		URI:             entry.URI,
+		Proto:           entry.Proto,
+		Status:          entry.Status,
+		Bytes:           entry.Bytes,
+		Duration:        float64(entry.Duration) / float64(time.Millisecond),
+		Referer:         entry.Referer,
+		UserAgent:       entry.UserAgent,
+		RequestID:       entry.RequestID,
+		Tenant:          entry.Tenant,
+		Route:           entry.Route,
+		Cache:           entry.Cache,
+		BackendHost:     entry.BackendHost,
+		UpstreamLatency: float64(entry.UpstreamLatency) / float64(time.Millisecond),
+	}
+}
@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntry returns an access log entry of a served image.
+func testEntry(status int) AccessEntry {
+	return AccessEntry{
+		Time:        time.Date(2025, 1, 2, 13, 55, 36, 0, time.UTC),
+		RemoteAddr:  "203.0.113.7",
+		Method:      "GET",
+		URI:         "/sig/w:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn",
+		Proto:       "HTTP/1.1",
+		Status:      status,
+		Bytes:       2326,
+		Duration:    42 * time.Millisecond,
+		Referer:     "https://example.com/",
+		UserAgent:   `Mozilla/5.0 "quoted"`,
+		RequestID:   "4f2a9c1e7b3d5a60",
+		Tenant:      "default",
+		Route:       "default",
+		Cache:       "MISS",
+		BackendHost: "imgproxy:8080",
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  AccessLogOptions
+		expected string
+	}{
+		{
+			name:     "Combined",
+			options:  AccessLogOptions{Format: AccessFormatCombined, SampleRate: 1},
+			expected: `203.0.113.7 - - [02/Jan/2025:13:55:36 +0000] "GET /sig/w:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0 \"quoted\""` + "\n",
+		},
+		{
+			name:     "Template",
+			options:  AccessLogOptions{Format: AccessFormatTemplate, Template: "{{.RequestID}} {{.Status}} {{.Duration}} {{.Cache}}", SampleRate: 1},
+			expected: "4f2a9c1e7b3d5a60 200 42ms MISS\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			access, err := NewAccessLogger(&buf, tt.options)
+			if err != nil {
+				t.Fatalf("NewAccessLogger() error = %v", err)
+			}
+			access.Log(testEntry(200))
+			if buf.String() != tt.expected {
+				t.Errorf("Log() wrote %q, want %q", buf.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	access, _ := NewAccessLogger(&buf, AccessLogOptions{Format: AccessFormatJSON, SampleRate: 1})
+	access.Log(testEntry(404))
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Log() did not write JSON: %v", err)
+	}
+	expected := map[string]any{
+		"remote_addr":  "203.0.113.7",
+		"status":       float64(404),
+		"bytes":        float64(2326),
+		"duration_ms":  float64(42),
+		"request_id":   "4f2a9c1e7b3d5a60",
+		"backend_host": "imgproxy:8080",
+	}
+	for key, want := range expected {
+		if entry[key] != want {
+			t.Errorf("field %s = %v, want %v", key, entry[key], want)
+		}
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	access, _ := NewAccessLogger(&buf, AccessLogOptions{Format: AccessFormatTemplate, Template: "{{.Status}}", SampleRate: 0.5})
+	samples := []float64{0.7, 0.2}
+	access.sample = func() float64 {
+		sample := samples[0]
+		samples = samples[1:]
+		return sample
+	}
+
+	// The first 200 is sampled out, the second logged; errors and redirects are always logged
+	for _, status := range []int{200, 200, 304, 404, 502} {
+		access.Log(testEntry(status))
+	}
+	if got := strings.Fields(buf.String()); strings.Join(got, " ") != "200 304 404 502" {
+		t.Errorf("logged statuses %v, want [200 304 404 502]", got)
+	}
+}
+
+func TestNewAccessLoggerErrors(t *testing.T) {
+	tests := []AccessLogOptions{
+		{Format: "common"},
+		{Format: AccessFormatTemplate, Template: "{{.Status"},
+	}
+	for _, options := range tests {
+		if _, err := NewAccessLogger(&bytes.Buffer{}, options); err == nil {
+			t.Errorf("NewAccessLogger(%+v) succeeded, want an error", options)
+		}
+	}
+}
+
+func TestAccessLogEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	access, _ := NewAccessLogger(&buf, AccessLogOptions{SampleRate: 1})
+	entry := testEntry(200)
+	entry.UserAgent = "agent\n203.0.113.8 - - forged"
+	access.Log(entry)
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 {
+		t.Errorf("Log() wrote %d lines, want 1: %q", lines, buf.String())
+	}
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LevelRule sets the level of the messages of matching requests, e.g. to log
+// the requests of one client at debug level in production. A request matches
+// if it satisfies every condition set; at least one condition is required.
+type LevelRule struct {
+	Level           Level     `json:"level"`                       // Level of the messages of matching requests
+	ClientIP        string    `json:"client_ip,omitempty"`         // Client IP address or CIDR range of the requests
+	RequestIDPrefix string    `json:"request_id_prefix,omitempty"` // Prefix of the request IDs, e.g. sent by a client in X-Request-ID
+	Expires         time.Time `json:"expires,omitempty"`           // Time the rule stops applying; never when zero
+}
+
+// levelRule is a LevelRule with its client IP range parsed.
+type levelRule struct {
+	LevelRule
+	clients netip.Prefix
+}
+
+// matches reports whether the rule applies to a request at the given time.
+func (r levelRule) matches(clientIP, requestID string, now time.Time) bool {
+	if !r.Expires.IsZero() && !now.Before(r.Expires) {
+		return false
+	}
+	if r.ClientIP != "" {
+		ip, err := netip.ParseAddr(clientIP)
+		if err != nil || !r.clients.Contains(ip.Unmap()) {
+			return false
+		}
+	}
+	return strings.HasPrefix(requestID, r.RequestIDPrefix)
+}
+
+// levels holds the level and level rules shared by a logger and the loggers
+// derived from it. It implements slog.Leveler with the current level.
+type levels struct {
+	level atomic.Int64
+	rules atomic.Pointer[[]levelRule]
+}
+
+// Level returns the log/slog level of the current level.
+func (v *levels) Level() slog.Level {
+	return Level(v.level.Load()).slogLevel()
+}
+
+// SetLevel changes the minimum level of logged messages. It applies to the
+// logger and all loggers derived from it, including those already in use.
+func (l *Logger) SetLevel(level Level) {
+	l.levels.level.Store(int64(level))
+}
+
+// Level returns the current minimum level of logged messages.
+func (l *Logger) Level() Level {
+	return Level(l.levels.level.Load())
+}
+
+// SetLevelRules replaces the level rules used by ForRequest. It returns an
+// error, keeping the current rules, if a rule is invalid.
+func (l *Logger) SetLevelRules(rules []LevelRule) error {
+	parsed := make([]levelRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Level < LevelDebug || rule.Level > LevelFatal {
+			return fmt.Errorf("rule %d: invalid level %d", i, rule.Level)
+		}
+		if rule.ClientIP == "" && rule.RequestIDPrefix == "" {
+			return fmt.Errorf("rule %d: client_ip or request_id_prefix is required", i)
+		}
+		entry := levelRule{LevelRule: rule}
+		if rule.ClientIP != "" {
+			clients, err := parseClients(rule.ClientIP)
+			if err != nil {
+				return fmt.Errorf("rule %d: invalid client_ip %q", i, rule.ClientIP)
+			}
+			entry.clients = clients
+		}
+		parsed = append(parsed, entry)
+	}
+	l.levels.rules.Store(&parsed)
+	return nil
+}
+
+// parseClients parses an IP address or CIDR range.
+func parseClients(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// LevelRules returns the level rules that have not expired.
+func (l *Logger) LevelRules() []LevelRule {
+	rules := []LevelRule{}
+	if current := l.levels.rules.Load(); current != nil {
+		now := time.Now()
+		for _, rule := range *current {
+			if rule.Expires.IsZero() || now.Before(rule.Expires) {
+				rules = append(rules, rule.LevelRule)
+			}
+		}
+	}
+	return rules
+}
+
+// ForRequest returns the logger to use for a request. If a level rule matches
+// the client IP and request ID, the returned logger logs at the level of the
+// first matching rule; otherwise l is returned.
+func (l *Logger) ForRequest(clientIP, requestID string) *Logger {
+	current := l.levels.rules.Load()
+	if current == nil {
+		return l
+	}
+	now := time.Now()
+	for _, rule := range *current {
+		if !rule.matches(clientIP, requestID, now) {
+			continue
+		}
+		handler, ok := l.logger.Handler().(levelHandler)
+		if !ok {
+			return l
+		}
+		return &Logger{
+			logger:   slog.New(levelHandler{handler.Handler, rule.Level.slogLevel()}),
+			redactor: l.redactor,
+			levels:   l.levels,
+		}
+	}
+	return l
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo, FormatText)
+	derived := logger.With("request_id", "1")
+
+	derived.Debug("hidden")
+	logger.SetLevel(LevelDebug)
+	derived.Debug("shown")
+
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("SetLevel() did not apply to a derived logger: %s", buf.String())
+	}
+	if logger.Level() != LevelDebug {
+		t.Errorf("Level() = %s, want %s", logger.Level(), LevelDebug)
+	}
+}
+
+func TestForRequest(t *testing.T) {
+	rules := []LevelRule{
+		{Level: LevelDebug, ClientIP: "203.0.113.0/24"},
+		{Level: LevelDebug, RequestIDPrefix: "debug-"},
+		{Level: LevelError, ClientIP: "198.51.100.9", RequestIDPrefix: "quiet-"},
+		{Level: LevelDebug, ClientIP: "192.0.2.1", Expires: time.Now().Add(-time.Minute)},
+	}
+
+	tests := []struct {
+		name      string
+		clientIP  string
+		requestID string
+		debug     bool // Whether debug messages are logged
+		info      bool // Whether info messages are logged
+	}{
+		{"Client in range", "203.0.113.7", "4f2a9c1e", true, true},
+		{"Request ID prefix", "192.0.2.7", "debug-checkout-42", true, true},
+		{"All conditions", "198.51.100.9", "quiet-1", false, false},
+		{"Some conditions", "198.51.100.9", "4f2a9c1e", false, true},
+		{"Expired rule", "192.0.2.1", "4f2a9c1e", false, true},
+		{"No match", "192.0.2.7", "4f2a9c1e", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := New(&buf, LevelInfo, FormatText)
+			if err := logger.SetLevelRules(rules); err != nil {
+				t.Fatal(err)
+			}
+
+			request := logger.ForRequest(tt.clientIP, tt.requestID).With("client_ip", tt.clientIP)
+			request.Debug("debug message")
+			request.Info("info message")
+			if got := strings.Contains(buf.String(), "debug message"); got != tt.debug {
+				t.Errorf("debug logged = %v, want %v", got, tt.debug)
+			}
+			if got := strings.Contains(buf.String(), "info message"); got != tt.info {
+				t.Errorf("info logged = %v, want %v", got, tt.info)
+			}
+		})
+	}
+}
+
+func TestSetLevelRulesErrors(t *testing.T) {
+	logger := New(&bytes.Buffer{}, LevelInfo, FormatText)
+	valid := []LevelRule{{Level: LevelDebug, ClientIP: "203.0.113.7"}}
+	if err := logger.SetLevelRules(valid); err != nil {
+		t.Fatalf("SetLevelRules() error = %v", err)
+	}
+
+	for _, rules := range [][]LevelRule{
+		{{Level: LevelDebug}},
+		{{Level: LevelDebug, ClientIP: "not-an-ip"}},
+		{{Level: Level(9), RequestIDPrefix: "debug-"}},
+	} {
+		if err := logger.SetLevelRules(rules); err == nil {
+			t.Errorf("SetLevelRules(%+v) succeeded, want an error", rules)
+		}
+	}
+	if got := logger.LevelRules(); len(got) != 1 || got[0] != valid[0] {
+		t.Errorf("LevelRules() = %+v after invalid updates, want %+v", got, valid)
+	}
+}
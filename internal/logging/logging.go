@@ -1,94 +1,231 @@
 // Package logging provides standardized logging capabilities for the imgproxy proxy service.
+// Logs are written with log/slog as text or JSON, with structured fields
+// attached to the messages of a request.
 package logging
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // For testing purposes, we can swap this out
 var osExit = os.Exit
 
+// Level is the minimum severity of logged messages.
+type Level int
+
 // Log levels
 const (
-	LevelDebug = iota
+	LevelDebug Level = iota
 	LevelInfo
 	LevelWarn
 	LevelError
 	LevelFatal
 )
 
-// Logger is a standardized logger for the application
+// levelNames are the names of the levels, as accepted by ParseLevel.
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name (debug, info, warn, error or fatal, in any
+// case) or its number (0 to 4).
+func ParseLevel(value string) (Level, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "warning" {
+		return LevelWarn, nil
+	}
+	for i, name := range levelNames {
+		if value == name {
+			return Level(i), nil
+		}
+	}
+	if n, err := strconv.Atoi(value); err == nil && n >= int(LevelDebug) && n <= int(LevelFatal) {
+		return Level(n), nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s or 0 to 4", value, strings.Join(levelNames, ", "))
+}
+
+// MarshalText returns the name of the level.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText parses a level with ParseLevel, so levels can be loaded from the environment.
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// slogLevel returns the log/slog level of l. Fatal messages are logged above errors.
+func (l Level) slogLevel() slog.Level {
+	switch l {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	}
+	return slogLevelFatal
+}
+
+// slogLevelFatal is the log/slog level of fatal messages.
+const slogLevelFatal = slog.LevelError + 4
+
+// Output formats
+const (
+	FormatText = "text" // key=value pairs
+	FormatJSON = "json" // One JSON object per line
+)
+
+// Logger is a standardized logger for the application. Messages are formatted
+// printf-style; fields added with With are attached to every message. Messages
+// and fields are passed through the Redactor of the logger before being written.
+//
+// The level can be changed while the logger is in use, and level rules can
+// change it for the messages of matching requests; see ForRequest.
 type Logger struct {
-	debugLogger *log.Logger
-	infoLogger  *log.Logger
-	warnLogger  *log.Logger
-	errorLogger *log.Logger
-	fatalLogger *log.Logger
-	level       int
-}
-
-// NewLogger creates a new logger with the specified minimum log level
-func NewLogger(level int) *Logger {
-	flags := log.Ldate | log.Ltime
-	return NewLoggerWithWriters(level, os.Stdout, os.Stdout, os.Stdout, os.Stderr, os.Stderr, flags)
-}
-
-// NewLoggerWithWriters creates a new logger with custom writers and flags
-// This function is particularly useful for testing to capture log output
-func NewLoggerWithWriters(level int, debugWriter, infoWriter, warnWriter, errorWriter, fatalWriter io.Writer, flags int) *Logger {
-	return &Logger{
-		debugLogger: log.New(debugWriter, "DEBUG: ", flags),
-		infoLogger:  log.New(infoWriter, "INFO: ", flags),
-		warnLogger:  log.New(warnWriter, "WARN: ", flags),
-		errorLogger: log.New(errorWriter, "ERROR: ", flags),
-		fatalLogger: log.New(fatalWriter, "FATAL: ", flags),
-		level:       level,
+	logger   *slog.Logger
+	redactor *Redactor
+	levels   *levels
+}
+
+// NewLogger creates a new text logger writing to standard output with the specified minimum log level
+func NewLogger(level Level) *Logger {
+	return New(os.Stdout, level, FormatText)
+}
+
+// New creates a logger writing messages of at least the given level to w in
+// the given format. Unknown formats are written as text.
+func New(w io.Writer, level Level, format string) *Logger {
+	redactor := NewRedactor()
+	levels := &levels{}
+	levels.level.Store(int64(level))
+	options := &slog.HandlerOptions{
+		Level: slog.LevelDebug, // Filtered by levelHandler
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			return redactor.redactAttr(replaceLevel(groups, attr))
+		},
 	}
+	var handler slog.Handler
+	if format == FormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	return &Logger{logger: slog.New(levelHandler{handler, levels}), redactor: redactor, levels: levels}
+}
+
+// levelHandler filters the messages of a handler with a level that may change.
+type levelHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+// Enabled reports whether messages of the given level are logged.
+func (h levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// WithAttrs returns a handler adding attrs to every message, with the same level.
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+// WithGroup returns a handler nesting fields in a group, with the same level.
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// replaceLevel names the fatal level, which log/slog does not know.
+func replaceLevel(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := attr.Value.Any().(slog.Level); ok && level == slogLevelFatal {
+			attr.Value = slog.StringValue("FATAL")
+		}
+	}
+	return attr
+}
+
+// With returns a logger adding the given key-value pairs as fields to every message.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{logger: l.logger.With(args...), redactor: l.redactor, levels: l.levels}
+}
+
+// Redactor returns the redactor applied to the messages of the logger and
+// of the loggers derived from it with With.
+func (l *Logger) Redactor() *Redactor {
+	return l.redactor
+}
+
+// log formats and writes a message if its level is enabled.
+func (l *Logger) log(level Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level.slogLevel()) {
+		return
+	}
+	l.logger.Log(ctx, level.slogLevel(), fmt.Sprintf(format, v...))
 }
 
 // Debug logs a debug message
 func (l *Logger) Debug(format string, v ...interface{}) {
-	if l.level <= LevelDebug {
-		l.debugLogger.Printf(format, v...)
-	}
+	l.log(LevelDebug, format, v...)
 }
 
 // Info logs an informational message
 func (l *Logger) Info(format string, v ...interface{}) {
-	if l.level <= LevelInfo {
-		l.infoLogger.Printf(format, v...)
-	}
+	l.log(LevelInfo, format, v...)
 }
 
 // Warn logs a warning message
 func (l *Logger) Warn(format string, v ...interface{}) {
-	if l.level <= LevelWarn {
-		l.warnLogger.Printf(format, v...)
-	}
+	l.log(LevelWarn, format, v...)
 }
 
 // Error logs an error message
 func (l *Logger) Error(format string, v ...interface{}) {
-	if l.level <= LevelError {
-		l.errorLogger.Printf(format, v...)
-	}
+	l.log(LevelError, format, v...)
 }
 
 // Fatal logs a fatal error message and exits the application
 func (l *Logger) Fatal(format string, v ...interface{}) {
-	if l.level <= LevelFatal {
-		l.fatalLogger.Printf(format, v...)
-		osExit(1)
-	}
+	l.log(LevelFatal, format, v...)
+	osExit(1)
 }
 
-// RequestLogger logs HTTP request information with timing
-func (l *Logger) RequestLogger(method, path, status string, duration time.Duration) {
-	l.Info("%s %s [%s] %s", method, path, status, duration)
+// RequestLogger logs HTTP request information with timing. The key-value
+// pairs in fields, e.g. the response size, are added to the message.
+func (l *Logger) RequestLogger(method, path, status string, duration time.Duration, fields ...any) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	attrs := append([]any{
+		slog.String("method", method),
+		slog.String("path", path),
+		slog.String("status", status),
+		slog.Float64("duration_ms", float64(duration)/float64(time.Millisecond)),
+	}, fields...)
+	l.logger.Log(ctx, slog.LevelInfo, fmt.Sprintf("%s %s [%s] %s", method, path, status, duration), attrs...)
 }
 
 // Formatter provides consistent message formatting across the application
@@ -2,6 +2,7 @@ package logging
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"strings"
 	"testing"
@@ -9,9 +10,9 @@ import (
 )
 
 // captureLoggerOutput provides a buffer and creates a logger with that buffer as output
-func captureLoggerOutput(level int, f func(*Logger)) string {
+func captureLoggerOutput(level Level, f func(*Logger)) string {
 	var buf bytes.Buffer
-	logger := NewLoggerWithWriters(level, &buf, &buf, &buf, &buf, &buf, 0) // Use flag 0 to avoid timestamps in tests
+	logger := New(&buf, level, FormatText)
 	f(logger)
 	return buf.String()
 }
@@ -19,7 +20,7 @@ func captureLoggerOutput(level int, f func(*Logger)) string {
 func TestLoggerLevels(t *testing.T) {
 	tests := []struct {
 		name      string
-		level     int
+		level     Level
 		logFunc   func(*Logger)
 		contains  string
 		notExists string
@@ -28,7 +29,7 @@ func TestLoggerLevels(t *testing.T) {
 			name:      "Debug level shows debug logs",
 			level:     LevelDebug,
 			logFunc:   func(l *Logger) { l.Debug("debug message") },
-			contains:  "DEBUG: debug message",
+			contains:  `level=DEBUG msg="debug message"`,
 			notExists: "",
 		},
 		{
@@ -36,27 +37,27 @@ func TestLoggerLevels(t *testing.T) {
 			level:     LevelInfo,
 			logFunc:   func(l *Logger) { l.Debug("hidden debug message") },
 			contains:  "",
-			notExists: "DEBUG: hidden debug message",
+			notExists: `level=DEBUG msg="hidden debug message"`,
 		},
 		{
 			name:      "Info level shows info logs",
 			level:     LevelInfo,
 			logFunc:   func(l *Logger) { l.Info("info message") },
-			contains:  "INFO: info message",
+			contains:  `level=INFO msg="info message"`,
 			notExists: "",
 		},
 		{
 			name:      "Warn level shows warn logs",
 			level:     LevelWarn,
 			logFunc:   func(l *Logger) { l.Warn("warning message") },
-			contains:  "WARN: warning message",
+			contains:  `level=WARN msg="warning message"`,
 			notExists: "",
 		},
 		{
 			name:      "Error level shows error logs",
 			level:     LevelError,
 			logFunc:   func(l *Logger) { l.Error("error message") },
-			contains:  "ERROR: error message",
+			contains:  `level=ERROR msg="error message"`,
 			notExists: "",
 		},
 	}
@@ -81,7 +82,7 @@ func TestRequestLogger(t *testing.T) {
 		logger.RequestLogger("GET", "/test", "200", 150*time.Millisecond)
 	})
 
-	expectedParts := []string{"INFO:", "GET", "/test", "[200]"}
+	expectedParts := []string{"level=INFO", "GET", "/test", "[200]", "method=GET", "path=/test", "status=200", "duration_ms=150"}
 	for _, part := range expectedParts {
 		if !strings.Contains(output, part) {
 			t.Errorf("expected output to contain %q, got %q", part, output)
@@ -122,7 +123,7 @@ func TestFormatter(t *testing.T) {
 func TestNewLogger(t *testing.T) {
 	tests := []struct {
 		name  string
-		level int
+		level Level
 		msg   string
 		want  string
 	}{
@@ -130,7 +131,7 @@ func TestNewLogger(t *testing.T) {
 			name:  "Debug level logger",
 			level: LevelDebug,
 			msg:   "test debug message",
-			want:  "DEBUG: ",
+			want:  "level=DEBUG",
 		},
 		{
 			name:  "Info level logger ignores debug",
@@ -142,7 +143,7 @@ func TestNewLogger(t *testing.T) {
 			name:  "Error level logger",
 			level: LevelError,
 			msg:   "test error message",
-			want:  "ERROR: ",
+			want:  "level=ERROR",
 		},
 	}
 
@@ -178,8 +179,8 @@ func TestNewLogger(t *testing.T) {
 
 			// Check for prefix and message content instead of exact match
 			if tt.want != "" {
-				if !strings.HasPrefix(output, tt.want) || !strings.Contains(output, tt.msg) {
-					t.Errorf("NewLogger(%d) output = %q, should start with %q and contain %q",
+				if !strings.Contains(output, tt.want) || !strings.Contains(output, tt.msg) {
+					t.Errorf("NewLogger(%d) output = %q, should contain %q and %q",
 						tt.level, output, tt.want, tt.msg)
 				}
 			} else if len(output) > 0 {
@@ -192,7 +193,7 @@ func TestNewLogger(t *testing.T) {
 func TestFatalLogger(t *testing.T) {
 	// Create a logger with a custom writer to capture output
 	var buf bytes.Buffer
-	logger := NewLoggerWithWriters(LevelFatal, &buf, &buf, &buf, &buf, &buf, 0)
+	logger := New(&buf, LevelFatal, FormatText)
 
 	// We need to mock os.Exit to prevent the test from actually exiting
 	originalOsExit := osExit
@@ -217,11 +218,63 @@ func TestFatalLogger(t *testing.T) {
 	logger.Fatal("fatal error message")
 
 	output := buf.String()
-	if !strings.Contains(output, "FATAL: fatal error message") {
-		t.Errorf("expected output to contain %q, got %q", "FATAL: fatal error message", output)
+	if !strings.Contains(output, `level=FATAL msg="fatal error message"`) {
+		t.Errorf("expected output to contain %q, got %q", `level=FATAL msg="fatal error message"`, output)
 	}
 
 	if exitCode != 1 {
 		t.Errorf("expected exit code 1, got %d", exitCode)
 	}
 }
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Level
+		wantErr  bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warning", LevelWarn, false},
+		{" error ", LevelError, false},
+		{"fatal", LevelFatal, false},
+		{"0", LevelDebug, false},
+		{"3", LevelError, false},
+		{"5", 0, true},
+		{"verbose", 0, true},
+	}
+
+	for _, tt := range tests {
+		level, err := ParseLevel(tt.value)
+		if (err != nil) != tt.wantErr || level != tt.expected {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", tt.value, level, err, tt.expected)
+		}
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo, FormatJSON).With("request_id", "abc123", "tenant", "acme")
+	logger.Debug("hidden")
+	logger.RequestLogger("GET", "/img", "OK", 20*time.Millisecond, "bytes", 512, "cache", "HIT")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("output is not a single JSON object: %v\n%s", err, buf.String())
+	}
+	expected := map[string]any{
+		"level":       "INFO",
+		"request_id":  "abc123",
+		"tenant":      "acme",
+		"method":      "GET",
+		"status":      "OK",
+		"duration_ms": float64(20),
+		"bytes":       float64(512),
+		"cache":       "HIT",
+	}
+	for key, want := range expected {
+		if entry[key] != want {
+			t.Errorf("field %s = %v, want %v", key, entry[key], want)
+		}
+	}
+}
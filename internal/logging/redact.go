@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Redacted replaces masked values in log output.
+const Redacted = "[REDACTED]"
+
+// credentialPattern matches the credentials of Authorization header values.
+var credentialPattern = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+
+// sensitiveKeys are fields whose values are never logged.
+var sensitiveKeys = map[string]bool{"authorization": true, "proxy-authorization": true, "cookie": true, "secret": true}
+
+// Redactor masks secrets, signatures and source URLs in log output. Secrets
+// can be replaced while messages are logged, e.g. when the configuration is
+// reloaded.
+type Redactor struct {
+	mu          sync.RWMutex
+	secrets     []string
+	hashSources bool
+}
+
+// NewRedactor creates a redactor masking Authorization credentials only.
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// SetSecrets replaces the values masked wherever they appear in log output.
+// Empty values are ignored.
+func (r *Redactor) SetSecrets(secrets ...string) {
+	var masked []string
+	for _, secret := range secrets {
+		if secret != "" {
+			masked = append(masked, secret)
+		}
+	}
+	// Longer secrets first, so a secret containing another is masked whole
+	sort.Slice(masked, func(i, j int) bool { return len(masked[i]) > len(masked[j]) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = masked
+}
+
+// SetHashSources sets whether Source logs hashes of source URLs instead of the URLs.
+func (r *Redactor) SetHashSources(hash bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hashSources = hash
+}
+
+// Redact masks secrets and Authorization credentials in s.
+func (r *Redactor) Redact(s string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	r.mu.RUnlock()
+	return credentialPattern.ReplaceAllString(s, "$1 "+Redacted)
+}
+
+// Source returns a source URL as it may be logged. Base64 URL-safe encoded
+// sources are decoded, and credentials and query strings are masked. When
+// hashing is enabled, the source is replaced by a prefix of its SHA-256 hash,
+// so requests for the same source can still be correlated.
+func (r *Redactor) Source(source string) string {
+	if decoded, ok := decodeSource(source); ok {
+		source = decoded
+	}
+
+	r.mu.RLock()
+	hash := r.hashSources
+	r.mu.RUnlock()
+	if hash {
+		sum := sha256.Sum256([]byte(source))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return Redacted
+	}
+	query := u.RawQuery != "" || u.ForceQuery
+	credentials := u.User != nil
+	u.User, u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = nil, "", false, "", ""
+	logged := u.String()
+	if credentials {
+		logged = strings.Replace(logged, "//", "//"+Redacted+"@", 1)
+	}
+	if query {
+		logged += "?" + Redacted
+	}
+	return logged
+}
+
+// decodeSource decodes a Base64 URL-safe encoded source URL, optionally
+// followed by an extension as in imgproxy URLs. It reports false if source
+// does not decode to a URL.
+func decodeSource(source string) (string, bool) {
+	encoded, _, _ := strings.Cut(source, ".")
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil || !utf8.Valid(decoded) {
+		return "", false
+	}
+	s := string(decoded)
+	return s, strings.Contains(s, "://") || strings.HasPrefix(s, "/")
+}
+
+// SignedPath returns a path in the format /{signature}/{options}/{source} as
+// it may be logged: the signature is masked and the source, encoded or plain,
+// is passed to Source. Paths without a source are returned unchanged.
+func (r *Redactor) SignedPath(path string) string {
+	segments := strings.Split(path, "/")
+	first := 0
+	if segments[0] == "" {
+		first = 1
+	}
+	if len(segments)-first < 2 {
+		return path
+	}
+
+	segments[first] = Redacted
+	for i := first + 1; i < len(segments)-1; i++ {
+		if segments[i] == "plain" {
+			plain := strings.Join(segments[i+1:], "/")
+			if unescaped, err := url.PathUnescape(plain); err == nil {
+				plain = unescaped
+			}
+			return strings.Join(segments[:i+1], "/") + "/" + r.Source(plain)
+		}
+	}
+	segments[len(segments)-1] = r.Source(segments[len(segments)-1])
+	return strings.Join(segments, "/")
+}
+
+// redactAttr masks secrets in string and error values, and the values of
+// sensitive fields such as authorization.
+func (r *Redactor) redactAttr(attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		attr.Value = slog.StringValue(Redacted)
+		return attr
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(r.Redact(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			attr.Value = slog.StringValue(r.Redact(err.Error()))
+		}
+	}
+	return attr
+}
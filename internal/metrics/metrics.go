@@ -2,13 +2,108 @@
 package metrics
 
 import (
+	"errors"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Optional labels of request metrics.
+const (
+	LabelRoute  = "route"  // Name of the route serving the request
+	LabelTenant = "tenant" // Tenant metrics label
+	LabelFormat = "format" // Output format of the response, e.g. "webp"
+	LabelPreset = "preset" // imgproxy presets applied to the request
+)
+
+// allLabels lists the optional labels in the order they appear in metrics.
+var allLabels = []string{LabelRoute, LabelTenant, LabelFormat, LabelPreset}
+
+// Values used in place of missing or excess label values.
+const (
+	noneValue  = "none"
+	otherValue = "other"
+)
+
+// LabelPolicy controls which optional labels are attached to metrics and how
+// many distinct values each label may take. Values seen after the limit is
+// reached are recorded as "other", so the number of time series stays bounded
+// however many distinct URLs are requested.
+type LabelPolicy struct {
+	Labels    []string // Labels enabled, a subset of route, tenant, format and preset
+	MaxValues int      // Maximum distinct values per label (unlimited when 0)
+}
+
+// DefaultLabelPolicy enables all optional labels with at most 100 values each.
+func DefaultLabelPolicy() LabelPolicy {
+	return LabelPolicy{Labels: allLabels, MaxValues: 100}
+}
+
+// enabled reports whether the policy attaches the label.
+func (p LabelPolicy) enabled(name string) bool {
+	for _, label := range p.Labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+// names returns the fixed labels followed by the enabled optional labels among optional.
+func (p LabelPolicy) names(fixed []string, optional ...string) []string {
+	names := append([]string(nil), fixed...)
+	for _, name := range optional {
+		if p.enabled(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RequestLabels describes a request with bounded label values. Raw request
+// paths are never used as labels, as every signed URL is unique.
+type RequestLabels struct {
+	Route  string
+	Tenant string
+	Format string
+	Preset string
+}
+
+// value returns the value of the named label.
+func (l RequestLabels) value(name string) string {
+	switch name {
+	case LabelRoute:
+		return l.Route
+	case LabelTenant:
+		return l.Tenant
+	case LabelFormat:
+		return l.Format
+	case LabelPreset:
+		return l.Preset
+	}
+	return ""
+}
+
+// Option configures Metrics.
+type Option func(*options)
+
+// options holds the settings applied by Option.
+type options struct {
+	policy LabelPolicy
+}
+
+// WithLabelPolicy sets the label policy of request metrics.
+func WithLabelPolicy(policy LabelPolicy) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
 // Metrics holds all the prometheus metrics used in the application
 type Metrics struct {
 	RequestsTotal      *prometheus.CounterVec
@@ -16,91 +111,399 @@ type Metrics struct {
 	RequestsInProgress *prometheus.GaugeVec
 	BackendErrors      *prometheus.CounterVec
 	SignatureErrors    *prometheus.CounterVec
+	MethodNotAllowed   *prometheus.CounterVec
+	SourceRejections   *prometheus.CounterVec
+	RateLimited        *prometheus.CounterVec
+	ResponseSize       *prometheus.HistogramVec
+	BackendTTFB        *prometheus.HistogramVec
+	BackendDuration    *prometheus.HistogramVec
+	ProxyOverhead      *prometheus.HistogramVec
+	OutputFormats      *prometheus.CounterVec
+	OptionUsage        *prometheus.CounterVec
+	BackendResponses   *prometheus.CounterVec
+	ClientAborts       *prometheus.CounterVec
+	CacheResults       *prometheus.CounterVec
+
+	policy LabelPolicy
+	mu     sync.Mutex
+	seen   map[string]map[string]bool // Values seen per label, bounded by policy.MaxValues
+}
+
+// NewMetrics creates all prometheus metrics and registers them with reg, so
+// instances with their own registries are independent. Metrics already
+// registered with reg by an earlier instance are reused. The metrics are not
+// registered when reg is nil. It panics if reg holds incompatible metrics with
+// the same names, e.g. created with a different label policy.
+func NewMetrics(reg prometheus.Registerer, namespace string, opts ...Option) *Metrics {
+	o := options{policy: DefaultLabelPolicy()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return newMetrics(reg, namespace, o.policy)
+}
+
+// newMetrics creates the metrics and registers them with reg.
+func newMetrics(reg prometheus.Registerer, namespace string, policy LabelPolicy) *Metrics {
+	f := factory{reg: reg}
+	return &Metrics{
+		policy: policy,
+		seen:   make(map[string]map[string]bool),
+		RequestsTotal: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "requests_total",
+				Help:      "Total number of image proxy requests processed",
+			},
+			policy.names([]string{"status"}, allLabels...),
+		),
+		RequestDuration: f.histogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "request_duration_seconds",
+				Help:      "Duration of image proxy requests in seconds",
+				Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			},
+			policy.names([]string{"status"}, allLabels...),
+		),
+		RequestsInProgress: f.gaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "requests_in_progress",
+				Help:      "Current number of image proxy requests being processed",
+			},
+			policy.names(nil, LabelRoute, LabelTenant),
+		),
+		BackendErrors: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "backend_errors_total",
+				Help:      "Total number of backend errors during image proxying",
+			},
+			policy.names([]string{"type"}, LabelTenant),
+		),
+		SignatureErrors: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "signature_errors_total",
+				Help:      "Total number of signature validation errors",
+			},
+			policy.names([]string{"type"}, LabelTenant),
+		),
+		MethodNotAllowed: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "method_not_allowed_total",
+				Help:      "Total number of requests rejected because of their HTTP method",
+			},
+			policy.names([]string{"method"}, LabelTenant),
+		),
+		SourceRejections: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "source_rejections_total",
+				Help:      "Total number of requests rejected because their source URL is not allowed",
+			},
+			policy.names([]string{"reason"}, LabelTenant),
+		),
+		RateLimited: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "rate_limited_total",
+				Help:      "Total number of requests rejected by a tenant rate limit",
+			},
+			policy.names(nil, LabelTenant),
+		),
+		ResponseSize: f.histogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "response_size_bytes",
+				Help:      "Size of image responses sent to clients in bytes",
+				Buckets:   prometheus.ExponentialBuckets(1024, 4, 8), // 1KiB to 16MiB
+			},
+			policy.names(nil, LabelRoute, LabelTenant, LabelFormat),
+		),
+		BackendTTFB: f.histogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "backend_ttfb_seconds",
+				Help:      "Time until the backend imgproxy service returned response headers, in seconds",
+				Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			},
+			policy.names(nil, LabelRoute, LabelTenant),
+		),
+		BackendDuration: f.histogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "backend_duration_seconds",
+				Help:      "Total time spent fetching responses from the backend imgproxy service, in seconds",
+				Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			},
+			policy.names(nil, LabelRoute, LabelTenant),
+		),
+		ProxyOverhead: f.histogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "proxy_overhead_seconds",
+				Help:      "Time spent in the proxy itself, excluding the backend fetch, in seconds",
+				Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5},
+			},
+			policy.names(nil, LabelRoute, LabelTenant),
+		),
+		OutputFormats: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "output_format_total",
+				Help:      "Total number of image responses by output format",
+			},
+			policy.names([]string{"format"}, LabelTenant),
+		),
+		OptionUsage: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "option_usage_total",
+				Help:      "Total number of image requests by the kind of processing options used",
+			},
+			policy.names([]string{"usage"}, LabelTenant),
+		),
+		BackendResponses: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "backend_responses_total",
+				Help:      "Total number of backend imgproxy responses by status class",
+			},
+			policy.names([]string{"class"}, LabelTenant),
+		),
+		ClientAborts: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "client_aborts_total",
+				Help:      "Total number of requests abandoned by the client before the response was complete",
+			},
+			policy.names(nil, LabelTenant),
+		),
+		CacheResults: f.counterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "cache_requests_total",
+				Help:      "Total number of rendition cache lookups by result",
+			},
+			policy.names([]string{"result"}, LabelTenant),
+		),
+	}
+}
+
+// factory creates metrics and registers them.
+type factory struct {
+	reg prometheus.Registerer
+}
+
+// counterVec creates and registers a counter vector.
+func (f factory) counterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	return register(f.reg, prometheus.NewCounterVec(opts, labels))
+}
+
+// histogramVec creates and registers a histogram vector.
+func (f factory) histogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	return register(f.reg, prometheus.NewHistogramVec(opts, labels))
+}
+
+// gaugeVec creates and registers a gauge vector.
+func (f factory) gaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	return register(f.reg, prometheus.NewGaugeVec(opts, labels))
+}
+
+// register registers the collector with reg, returning the collector already
+// registered under the same description if there is one.
+func register[T prometheus.Collector](reg prometheus.Registerer, collector T) T {
+	if reg == nil {
+		return collector
+	}
+	if err := reg.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return collector
+}
+
+// NewRegistry creates a registry for the service metrics, with the Go runtime
+// and process collectors when enabled.
+func NewRegistry(goCollector bool, processCollector bool) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	if goCollector {
+		reg.MustRegister(collectors.NewGoCollector())
+	}
+	if processCollector {
+		reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	return reg
+}
+
+// Handler returns an HTTP handler exposing the metrics gathered from reg.
+func Handler(reg *prometheus.Registry) http.Handler {
+	return promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
 }
 
-// Add a package-level variable to hold the singleton instance
-var metricsInstance *Metrics
-
-// Add a mutex to ensure thread-safe initialization
-var metricsOnce sync.Once
-
-// NewMetrics creates and registers all prometheus metrics (singleton pattern)
-func NewMetrics(namespace string) *Metrics {
-	metricsOnce.Do(func() {
-		metricsInstance = &Metrics{
-			RequestsTotal: promauto.NewCounterVec(
-				prometheus.CounterOpts{
-					Namespace: namespace,
-					Name:      "requests_total",
-					Help:      "Total number of image proxy requests processed",
-				},
-				[]string{"status", "path"},
-			),
-			RequestDuration: promauto.NewHistogramVec(
-				prometheus.HistogramOpts{
-					Namespace: namespace,
-					Name:      "request_duration_seconds",
-					Help:      "Duration of image proxy requests in seconds",
-					Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
-				},
-				[]string{"status", "path"},
-			),
-			RequestsInProgress: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: namespace,
-					Name:      "requests_in_progress",
-					Help:      "Current number of image proxy requests being processed",
-				},
-				[]string{"path"},
-			),
-			BackendErrors: promauto.NewCounterVec(
-				prometheus.CounterOpts{
-					Namespace: namespace,
-					Name:      "backend_errors_total",
-					Help:      "Total number of backend errors during image proxying",
-				},
-				[]string{"type"},
-			),
-			SignatureErrors: promauto.NewCounterVec(
-				prometheus.CounterOpts{
-					Namespace: namespace,
-					Name:      "signature_errors_total",
-					Help:      "Total number of signature validation errors",
-				},
-				[]string{"type"},
-			),
+// labels returns the enabled labels among names with their bounded values,
+// plus the given fixed label and value pairs.
+func (m *Metrics) labels(l RequestLabels, names []string, fixed ...string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(names)+len(fixed)/2)
+	for i := 0; i+1 < len(fixed); i += 2 {
+		labels[fixed[i]] = fixed[i+1]
+	}
+	for _, name := range names {
+		if m.policy.enabled(name) {
+			labels[name] = m.bound(name, l.value(name))
 		}
-	})
-	return metricsInstance
+	}
+	return labels
+}
+
+// bound returns the value to record for a label, "none" for empty values and
+// "other" once the label has reached the maximum number of distinct values.
+func (m *Metrics) bound(name string, value string) string {
+	if value == "" {
+		return noneValue
+	}
+	if m.policy.MaxValues <= 0 {
+		return value
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := m.seen[name]
+	if seen == nil {
+		seen = make(map[string]bool)
+		m.seen[name] = seen
+	}
+	if !seen[value] {
+		if len(seen) >= m.policy.MaxValues {
+			return otherValue
+		}
+		seen[value] = true
+	}
+	return value
 }
 
 // ObserveRequestDuration records the duration of a request
-func (m *Metrics) ObserveRequestDuration(start time.Time, status string, path string) {
+func (m *Metrics) ObserveRequestDuration(start time.Time, status string, labels RequestLabels) {
 	duration := time.Since(start).Seconds()
-	m.RequestDuration.WithLabelValues(status, path).Observe(duration)
+	m.RequestDuration.With(m.labels(labels, allLabels, "status", status)).Observe(duration)
 }
 
 // IncrementRequestsTotal increments the total requests counter
-func (m *Metrics) IncrementRequestsTotal(status string, path string) {
-	m.RequestsTotal.WithLabelValues(status, path).Inc()
+func (m *Metrics) IncrementRequestsTotal(status string, labels RequestLabels) {
+	m.RequestsTotal.With(m.labels(labels, allLabels, "status", status)).Inc()
 }
 
 // AddRequestInProgress increments the in-progress requests gauge
-func (m *Metrics) AddRequestInProgress(path string) {
-	m.RequestsInProgress.WithLabelValues(path).Inc()
+func (m *Metrics) AddRequestInProgress(labels RequestLabels) {
+	m.RequestsInProgress.With(m.labels(labels, []string{LabelRoute, LabelTenant})).Inc()
 }
 
 // RemoveRequestInProgress decrements the in-progress requests gauge
-func (m *Metrics) RemoveRequestInProgress(path string) {
-	m.RequestsInProgress.WithLabelValues(path).Dec()
+func (m *Metrics) RemoveRequestInProgress(labels RequestLabels) {
+	m.RequestsInProgress.With(m.labels(labels, []string{LabelRoute, LabelTenant})).Dec()
 }
 
 // IncrementBackendError increments the backend error counter
-func (m *Metrics) IncrementBackendError(errorType string) {
-	m.BackendErrors.WithLabelValues(errorType).Inc()
+func (m *Metrics) IncrementBackendError(errorType string, tenant string) {
+	m.BackendErrors.With(m.tenantLabels(tenant, "type", errorType)).Inc()
 }
 
 // IncrementSignatureError increments the signature error counter
-func (m *Metrics) IncrementSignatureError(errorType string) {
-	m.SignatureErrors.WithLabelValues(errorType).Inc()
+func (m *Metrics) IncrementSignatureError(errorType string, tenant string) {
+	m.SignatureErrors.With(m.tenantLabels(tenant, "type", errorType)).Inc()
+}
+
+// IncrementSourceRejected increments the rejected source URL counter
+func (m *Metrics) IncrementSourceRejected(reason string, tenant string) {
+	m.SourceRejections.With(m.tenantLabels(tenant, "reason", reason)).Inc()
+}
+
+// knownMethods bounds the method label to the standard HTTP methods.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "CONNECT": true, "OPTIONS": true, "TRACE": true,
+}
+
+// IncrementMethodNotAllowed increments the rejected method counter.
+// Non-standard methods are counted as "OTHER" to keep the label bounded.
+func (m *Metrics) IncrementMethodNotAllowed(method string, tenant string) {
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	m.MethodNotAllowed.With(m.tenantLabels(tenant, "method", method)).Inc()
+}
+
+// IncrementRateLimited increments the rate limited requests counter
+func (m *Metrics) IncrementRateLimited(tenant string) {
+	m.RateLimited.With(m.tenantLabels(tenant)).Inc()
+}
+
+// tenantLabels returns the labels of a metric with a tenant label and the
+// given fixed label and value pairs.
+func (m *Metrics) tenantLabels(tenant string, fixed ...string) prometheus.Labels {
+	return m.labels(RequestLabels{Tenant: tenant}, []string{LabelTenant}, fixed...)
+}
+
+// ObserveResponseSize records the size of an image response
+func (m *Metrics) ObserveResponseSize(bytes int64, labels RequestLabels) {
+	m.ResponseSize.With(m.labels(labels, []string{LabelRoute, LabelTenant, LabelFormat})).Observe(float64(bytes))
+}
+
+// ObserveBackendTTFB records the time until the backend returned response headers
+func (m *Metrics) ObserveBackendTTFB(duration time.Duration, labels RequestLabels) {
+	m.BackendTTFB.With(m.labels(labels, []string{LabelRoute, LabelTenant})).Observe(duration.Seconds())
+}
+
+// ObserveBackendDuration records the total time spent fetching a backend response
+func (m *Metrics) ObserveBackendDuration(duration time.Duration, labels RequestLabels) {
+	m.BackendDuration.With(m.labels(labels, []string{LabelRoute, LabelTenant})).Observe(duration.Seconds())
+}
+
+// ObserveProxyOverhead records the time a request spent in the proxy outside of the backend fetch
+func (m *Metrics) ObserveProxyOverhead(duration time.Duration, labels RequestLabels) {
+	m.ProxyOverhead.With(m.labels(labels, []string{LabelRoute, LabelTenant})).Observe(duration.Seconds())
+}
+
+// IncrementOutputFormat increments the image responses counter of the response format.
+// The format label is always attached, bounded like the optional labels.
+func (m *Metrics) IncrementOutputFormat(labels RequestLabels) {
+	m.OutputFormats.With(m.labels(labels, []string{LabelTenant}, "format", m.bound(LabelFormat, labels.Format))).Inc()
+}
+
+// IncrementOptionUsage increments the counter of the kind of processing options used, e.g. "resize"
+func (m *Metrics) IncrementOptionUsage(usage string, tenant string) {
+	m.OptionUsage.With(m.tenantLabels(tenant, "usage", usage)).Inc()
+}
+
+// IncrementBackendResponse increments the backend responses counter of the status class, e.g. "2xx"
+func (m *Metrics) IncrementBackendResponse(status int, tenant string) {
+	class := "other"
+	if status >= 100 && status < 600 {
+		class = strconv.Itoa(status/100) + "xx"
+	}
+	m.BackendResponses.With(m.tenantLabels(tenant, "class", class)).Inc()
+}
+
+// IncrementClientAbort increments the counter of requests abandoned by the client
+func (m *Metrics) IncrementClientAbort(tenant string) {
+	m.ClientAborts.With(m.tenantLabels(tenant)).Inc()
+}
+
+// Cache lookup results.
+const (
+	CacheHit    = "hit"    // Served from the cache
+	CacheMiss   = "miss"   // Fetched from the backend and stored
+	CacheBypass = "bypass" // Fetched from the backend but not stored, e.g. too large or not cacheable
+)
+
+// IncrementCacheResult increments the cache lookups counter of the result
+func (m *Metrics) IncrementCacheResult(result string, tenant string) {
+	m.CacheResults.With(m.tenantLabels(tenant, "result", result)).Inc()
 }
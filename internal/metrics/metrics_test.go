@@ -1,13 +1,19 @@
 package metrics
 
 import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewMetrics(t *testing.T) {
 	// Create a metrics instance with a test namespace
-	m := NewMetrics("test")
+	m := NewMetrics(prometheus.NewRegistry(), "test")
 
 	// Verify that all metrics were created
 	if m.RequestsTotal == nil {
@@ -29,22 +35,23 @@ func TestNewMetrics(t *testing.T) {
 
 func TestMetricsIncrementAndObserve(t *testing.T) {
 	// Create a metrics instance with a unique test namespace
-	m := NewMetrics("test_increment")
+	m := NewMetrics(prometheus.NewRegistry(), "test_increment")
 
 	// Test incrementing request counter
-	m.IncrementRequestsTotal("200", "/test")
+	labels := RequestLabels{Route: "default", Tenant: "default", Format: "webp"}
+	m.IncrementRequestsTotal("200", labels)
 
 	// Test observing request duration
 	start := time.Now().Add(-100 * time.Millisecond) // 100ms ago
-	m.ObserveRequestDuration(start, "200", "/test")
+	m.ObserveRequestDuration(start, "200", labels)
 
 	// Test request in progress
-	m.AddRequestInProgress("/test")
-	m.RemoveRequestInProgress("/test")
+	m.AddRequestInProgress(labels)
+	m.RemoveRequestInProgress(labels)
 
 	// Test error counters
-	m.IncrementBackendError("test_error")
-	m.IncrementSignatureError("test_error")
+	m.IncrementBackendError("test_error", "default")
+	m.IncrementSignatureError("test_error", "default")
 
 	// We're not testing the actual Prometheus values as that would require
 	// more complex setup with registries, but we've verified the methods don't panic
@@ -52,24 +59,205 @@ func TestMetricsIncrementAndObserve(t *testing.T) {
 
 func TestMetricsRequestFlow(t *testing.T) {
 	// Create a metrics instance with a unique test namespace to avoid conflicts
-	m := NewMetrics("test_flow")
+	m := NewMetrics(prometheus.NewRegistry(), "test_flow")
 
 	// Simulate a complete request flow
-	path := "/test/image"
+	labels := RequestLabels{Route: "default", Tenant: "default"}
 
 	// Start request
-	m.AddRequestInProgress(path)
+	m.AddRequestInProgress(labels)
 
 	// Simulate some work
 	time.Sleep(10 * time.Millisecond)
 
 	// End request successfully
-	m.RemoveRequestInProgress(path)
+	m.RemoveRequestInProgress(labels)
 	status := "200"
 	start := time.Now().Add(-50 * time.Millisecond)
-	m.ObserveRequestDuration(start, status, path)
-	m.IncrementRequestsTotal(status, path)
+	labels.Format = "jpeg"
+	m.ObserveRequestDuration(start, status, labels)
+	m.IncrementRequestsTotal(status, labels)
 
 	// Since we can't easily assert on the prometheus metrics in a regular test
 	// without more complex setup, we're just verifying that the methods don't panic
 }
+
+func TestIncrementMethodNotAllowed(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry(), "test_methods")
+
+	m.IncrementMethodNotAllowed("POST", "default")
+	m.IncrementMethodNotAllowed("BREW", "default")
+
+	if got := testutil.ToFloat64(m.MethodNotAllowed.WithLabelValues("POST", "default")); got != 1 {
+		t.Errorf("expected POST to be counted once, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.MethodNotAllowed.WithLabelValues("OTHER", "default")); got != 1 {
+		t.Errorf("expected non-standard method to be counted as OTHER, got %v", got)
+	}
+}
+
+// TestLabelCardinality checks that the number of request series stays fixed
+// however many distinct label values are recorded.
+func TestLabelCardinality(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry(), "test_cardinality", WithLabelPolicy(LabelPolicy{Labels: allLabels, MaxValues: 3}))
+
+	for i := 0; i < 1000; i++ {
+		m.IncrementRequestsTotal("OK", RequestLabels{Route: "default", Tenant: "default", Format: "webp", Preset: fmt.Sprintf("preset%d", i)})
+	}
+
+	// Three distinct presets plus "other"
+	if got := testutil.CollectAndCount(m.RequestsTotal); got != 4 {
+		t.Errorf("got %d series, want 4", got)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("OK", "default", "default", "webp", "other")); got != 997 {
+		t.Errorf("got %v requests counted as other, want 997", got)
+	}
+}
+
+func TestLabelPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy LabelPolicy
+		labels prometheus.Labels
+	}{
+		{"All labels", DefaultLabelPolicy(), prometheus.Labels{"status": "OK", "route": "default", "tenant": "acme", "format": "none", "preset": "thumb"}},
+		{"Tenant only", LabelPolicy{Labels: []string{LabelTenant}}, prometheus.Labels{"status": "OK", "tenant": "acme"}},
+		{"No labels", LabelPolicy{}, prometheus.Labels{"status": "OK"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry(), "test_policy", WithLabelPolicy(tt.policy))
+			m.IncrementRequestsTotal("OK", RequestLabels{Route: "default", Tenant: "acme", Preset: "thumb"})
+			m.IncrementBackendError("connection_error", "acme")
+
+			if got := testutil.ToFloat64(m.RequestsTotal.With(tt.labels)); got != 1 {
+				t.Errorf("requests_total%v = %v, want 1", tt.labels, got)
+			}
+			if got := testutil.CollectAndCount(m.BackendErrors); got != 1 {
+				t.Errorf("got %d backend error series, want 1", got)
+			}
+		})
+	}
+}
+
+func TestIncrementBackendResponse(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry(), "test_backend")
+
+	tests := []struct {
+		status int
+		class  string
+	}{
+		{200, "2xx"},
+		{304, "3xx"},
+		{404, "4xx"},
+		{502, "5xx"},
+		{999, "other"},
+	}
+	for _, tt := range tests {
+		m.IncrementBackendResponse(tt.status, "default")
+		if got := testutil.ToFloat64(m.BackendResponses.WithLabelValues(tt.class, "default")); got != 1 {
+			t.Errorf("IncrementBackendResponse(%d) counted %v in class %s, want 1", tt.status, got, tt.class)
+		}
+	}
+}
+
+func TestObserveResponseMetrics(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry(), "test_response")
+	labels := RequestLabels{Route: "default", Tenant: "default", Format: "avif"}
+
+	m.ObserveResponseSize(2048, labels)
+	m.ObserveBackendTTFB(20*time.Millisecond, labels)
+	m.ObserveBackendDuration(30*time.Millisecond, labels)
+	m.ObserveProxyOverhead(time.Millisecond, labels)
+	m.IncrementOutputFormat(labels)
+	m.IncrementOptionUsage("resize", "default")
+	m.IncrementClientAbort("default")
+	m.IncrementCacheResult(CacheHit, "default")
+
+	for name, collector := range map[string]prometheus.Collector{
+		"response_size_bytes":      m.ResponseSize,
+		"backend_ttfb_seconds":     m.BackendTTFB,
+		"backend_duration_seconds": m.BackendDuration,
+		"proxy_overhead_seconds":   m.ProxyOverhead,
+		"output_format_total":      m.OutputFormats,
+		"option_usage_total":       m.OptionUsage,
+		"client_aborts_total":      m.ClientAborts,
+		"cache_requests_total":     m.CacheResults,
+	} {
+		if got := testutil.CollectAndCount(collector); got != 1 {
+			t.Errorf("%s has %d series, want 1", name, got)
+		}
+	}
+	if got := testutil.ToFloat64(m.OutputFormats.WithLabelValues("avif", "default")); got != 1 {
+		t.Errorf("output_format_total{format=avif} = %v, want 1", got)
+	}
+}
+
+func TestNewMetricsInstances(t *testing.T) {
+	first, second := prometheus.NewRegistry(), prometheus.NewRegistry()
+	a := NewMetrics(first, "first")
+	b := NewMetrics(second, "second")
+	a.IncrementRateLimited("default")
+
+	if got := testutil.ToFloat64(b.RateLimited.WithLabelValues("default")); got != 0 {
+		t.Errorf("instances share counters: got %v in the second instance, want 0", got)
+	}
+	if got, err := testutil.GatherAndCount(first, "second_rate_limited_total"); err != nil || got != 0 {
+		t.Errorf("GatherAndCount() = %d, %v, want the second instance kept out of the first registry", got, err)
+	}
+
+	// A second instance on the same registry reuses the registered metrics
+	c := NewMetrics(first, "first")
+	c.IncrementRateLimited("default")
+	if got := testutil.ToFloat64(a.RateLimited.WithLabelValues("default")); got != 2 {
+		t.Errorf("got %v rate limited requests, want 2 across instances on one registry", got)
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	tests := []struct {
+		name      string
+		goMetrics bool
+		process   bool
+		metric    string
+		expected  bool
+	}{
+		{"Go collector enabled", true, false, "go_goroutines", true},
+		{"Go collector disabled", false, false, "go_goroutines", false},
+		{"Process collector enabled", false, true, "process_start_time_seconds", true},
+		{"Process collector disabled", true, false, "process_start_time_seconds", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry(tt.goMetrics, tt.process)
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, family := range families {
+				found = found || family.GetName() == tt.metric
+			}
+			if tt.metric == "process_start_time_seconds" && tt.expected && !found {
+				t.Skip("process metrics are not available on this platform")
+			}
+			if found != tt.expected {
+				t.Errorf("%s registered = %v, want %v", tt.metric, found, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry(false, false)
+	m := NewMetrics(reg, "test_handler")
+	m.IncrementRateLimited("default")
+
+	rr := httptest.NewRecorder()
+	Handler(reg).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `test_handler_rate_limited_total{tenant="default"} 1`) {
+		t.Errorf("metrics output is missing the rate limited counter:\n%s", rr.Body.String())
+	}
+}
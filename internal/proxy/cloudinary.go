@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cloudinaryDialect translates Cloudinary transformation paths, e.g.
+// /w_300,h_200,c_fill,g_auto,q_80,f_auto/v1612345678/folder/img.jpg.
+// Chained transformation segments are merged, later values winning.
+// Unsupported transformations are ignored.
+type cloudinaryDialect struct{}
+
+// cloudinaryParam matches a single transformation parameter such as "w_300".
+var cloudinaryParam = regexp.MustCompile(`^[a-z]{1,3}_[^,/]+$`)
+
+// cloudinaryVersion matches the optional version segment such as "v1612345678".
+var cloudinaryVersion = regexp.MustCompile(`^v\d+$`)
+
+// cloudinaryCrops maps Cloudinary crop modes to imgproxy options.
+var cloudinaryCrops = map[string][]string{
+	"fill":  {"rt:fill"},
+	"lfill": {"rt:fill"},
+	"thumb": {"rt:fill"},
+	"crop":  {"rt:fill"},
+	"fit":   {"rt:fit"},
+	"limit": {"rt:fit"},
+	"scale": {"rt:force"},
+	"pad":   {"rt:fit", "ex:1"},
+	"lpad":  {"rt:fit", "ex:1"},
+}
+
+// cloudinaryGravities maps Cloudinary gravities to imgproxy gravity types.
+var cloudinaryGravities = map[string]string{
+	"auto":       "sm",
+	"face":       "sm",
+	"faces":      "sm",
+	"center":     "ce",
+	"north":      "no",
+	"south":      "so",
+	"east":       "ea",
+	"west":       "we",
+	"north_east": "noea",
+	"north_west": "nowe",
+	"south_east": "soea",
+	"south_west": "sowe",
+}
+
+// Name implements Dialect.
+func (cloudinaryDialect) Name() string { return "cloudinary" }
+
+// Translate implements Dialect.
+func (cloudinaryDialect) Translate(path string, query url.Values) (Translation, error) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	params := map[string]string{}
+	var order []string
+	for len(segments) > 1 && isCloudinaryTransformation(segments[0]) {
+		for _, param := range strings.Split(segments[0], ",") {
+			key, value, _ := strings.Cut(param, "_")
+			if _, seen := params[key]; !seen {
+				order = append(order, key)
+			}
+			params[key] = value
+		}
+		segments = segments[1:]
+	}
+	if len(segments) > 1 && cloudinaryVersion.MatchString(segments[0]) {
+		segments = segments[1:]
+	}
+
+	translation := Translation{Source: strings.Join(segments, "/")}
+	if translation.Source == "" {
+		return translation, fmt.Errorf("missing image path")
+	}
+
+	for _, key := range order {
+		value := params[key]
+		switch key {
+		case "w", "h":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return translation, fmt.Errorf("invalid %s_ transformation %q", key, value)
+			}
+			translation.Options = append(translation.Options, key+":"+strconv.Itoa(min(size, maxDialectSize)))
+		case "c":
+			translation.Options = append(translation.Options, cloudinaryCrops[value]...)
+		case "g":
+			if gravity, ok := cloudinaryGravities[value]; ok {
+				translation.Options = append(translation.Options, "g:"+gravity)
+			}
+		case "q":
+			if quality, err := strconv.Atoi(value); err == nil && quality >= 1 && quality <= 100 {
+				translation.Options = append(translation.Options, "q:"+strconv.Itoa(quality))
+			}
+		case "dpr":
+			if dpr, err := strconv.ParseFloat(value, 64); err == nil && dpr > 0 {
+				translation.Options = append(translation.Options, "dpr:"+strconv.FormatFloat(min(dpr, maxDialectDPR), 'f', -1, 64))
+			}
+		case "f":
+			if value == "auto" {
+				translation.AutoFormat = true
+			} else if format, ok := formatAliases[value]; ok {
+				translation.Options = append(translation.Options, "f:"+format)
+			}
+		}
+	}
+
+	return translation, nil
+}
+
+// isCloudinaryTransformation reports whether a path segment is a transformation
+// such as "w_300,c_fill" rather than part of the public ID.
+func isCloudinaryTransformation(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	for _, param := range strings.Split(segment, ",") {
+		if !cloudinaryParam.MatchString(param) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"imgproxy-proxy/internal/cache"
+)
+
+// conditionalHeaders are the request headers that make the backend return a
+// partial or empty response. They are stripped when the full body is needed.
+var conditionalHeaders = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Match",
+	"If-Unmodified-Since",
+	"If-Range",
+	"Range",
+}
+
+// ensureStrongETag makes sure the entry carries a strong ETag. A strong ETag
+// sent by the backend is kept; otherwise one is computed from the body so that
+// range and conditional requests can be validated against it.
+func ensureStrongETag(entry *cache.Entry) {
+	if etag := entry.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return
+	}
+	entry.Header.Set("ETag", fmt.Sprintf("\"%x\"", sha256.Sum256(entry.Body)))
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison required for If-None-Match (RFC 9110, 13.1.2).
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveEntry writes a cached rendition to the client. Conditional requests,
+// byte ranges and HEAD requests are answered from the cached body.
+func serveEntry(w http.ResponseWriter, r *http.Request, entry *cache.Entry, cacheStatus string) {
+	for k, v := range entry.Header {
+		if k == "Content-Length" || isProxyHeader(k) {
+			continue
+		}
+		if k == "Vary" {
+			mergeVary(w.Header(), v)
+			continue
+		}
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set("X-Cache", cacheStatus)
+
+	modTime, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(entry.Body))
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"imgproxy-proxy/internal/cache"
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		etag        string
+		expected    bool
+	}{
+		{"Empty header", "", `"abc"`, false},
+		{"No ETag", `"abc"`, "", false},
+		{"Exact match", `"abc"`, `"abc"`, true},
+		{"Wildcard", "*", `"abc"`, true},
+		{"List match", `"x", "abc"`, `"abc"`, true},
+		{"Weak candidate", `W/"abc"`, `"abc"`, true},
+		{"Weak ETag", `"abc"`, `W/"abc"`, true},
+		{"No match", `"x", "y"`, `"abc"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.expected {
+				t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEnsureStrongETag(t *testing.T) {
+	tests := []struct {
+		name     string
+		etag     string
+		keepSame bool
+	}{
+		{"Missing ETag is computed", "", false},
+		{"Weak ETag is replaced", `W/"weak"`, false},
+		{"Strong ETag is kept", `"strong"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &cache.Entry{Header: http.Header{}, Body: []byte("body")}
+			if tt.etag != "" {
+				entry.Header.Set("ETag", tt.etag)
+			}
+			ensureStrongETag(entry)
+
+			got := entry.Header.Get("ETag")
+			if tt.keepSame && got != tt.etag {
+				t.Errorf("ETag = %q, want %q", got, tt.etag)
+			}
+			if !tt.keepSame && (got == tt.etag || strings.HasPrefix(got, "W/") || !strings.HasPrefix(got, `"`)) {
+				t.Errorf("expected a computed strong ETag, got %q", got)
+			}
+		})
+	}
+}
+
+// TestHandleImageProxyConditional tests ETag, Range and HEAD handling end-to-end
+func TestHandleImageProxyConditional(t *testing.T) {
+	var backendMethods []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendMethods = append(backendMethods, r.Method)
+		if r.Header.Get("Range") != "" || r.Header.Get("If-None-Match") != "" {
+			t.Errorf("conditional headers should not reach the backend when caching")
+		}
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("0123456789"))
+	}))
+	defer backend.Close()
+
+	newHandler := func(cacheEnabled bool) *ProxyHandler {
+		config := Config{
+			Key:               "0123456789abcdef0123456789abcdef",
+			Salt:              "0123456789abcdef0123456789abcdef",
+			BaseURL:           backend.URL,
+			Encode:            true,
+			SignatureSize:     32,
+			CacheEnabled:      cacheEnabled,
+			CacheMaxSize:      1024,
+			CacheMaxEntrySize: 1024,
+		}
+		return NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	}
+
+	handler := newHandler(true)
+	path := signedRequestPath(t, handler.Config(), "w:100", "https://example.com/cat.jpg")
+
+	// First request populates the cache and returns a strong ETag
+	rr := httptest.NewRecorder()
+	handler.HandleImageProxy(rr, httptest.NewRequest("GET", path, nil))
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("expected 200 with strong ETag, got %d %q", rr.Code, etag)
+	}
+
+	t.Run("If-None-Match answered locally", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("If-None-Match", etag)
+		rr := httptest.NewRecorder()
+		handler.HandleImageProxy(rr, req)
+		if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+			t.Errorf("expected empty 304, got %d with %d bytes", rr.Code, rr.Body.Len())
+		}
+	})
+
+	t.Run("Range served from cache", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Range", "bytes=2-5")
+		rr := httptest.NewRecorder()
+		handler.HandleImageProxy(rr, req)
+		if rr.Code != http.StatusPartialContent || rr.Body.String() != "2345" {
+			t.Errorf("expected 206 with %q, got %d with %q", "2345", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("HEAD served from cache without body", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.HandleImageProxy(rr, httptest.NewRequest("HEAD", path, nil))
+		if rr.Code != http.StatusOK || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "10" {
+			t.Errorf("expected bodiless 200 with Content-Length 10, got %d with %d bytes", rr.Code, rr.Body.Len())
+		}
+	})
+
+	if len(backendMethods) != 1 {
+		t.Errorf("expected 1 backend call, got %v", backendMethods)
+	}
+
+	t.Run("HEAD forwarded as HEAD without cache", func(t *testing.T) {
+		backendMethods = nil
+		uncached := newHandler(false)
+		rr := httptest.NewRecorder()
+		uncached.HandleImageProxy(rr, httptest.NewRequest("HEAD", path, nil))
+		if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+			t.Errorf("expected bodiless 200, got %d with %d bytes", rr.Code, rr.Body.Len())
+		}
+		if len(backendMethods) != 1 || backendMethods[0] != http.MethodHead {
+			t.Errorf("expected a single HEAD backend request, got %v", backendMethods)
+		}
+	})
+}
@@ -4,63 +4,338 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/internal/tracing"
 
-	"github.com/kelseyhightower/envconfig"
+	"github.com/sethvargo/go-envconfig"
 )
 
 // Config holds configuration options for generating imgproxy URLs.
 type Config struct {
-	Encode        bool   `envconfig:"IMGPROXY_ENCODE" default:"true"`       // Encode indicates whether the source URI should be Base64 encoded.
-	Salt          string `envconfig:"IMGPROXY_SALT"`                        // Salt is the hex-encoded salt used for signing secure URLs.
-	Key           string `envconfig:"IMGPROXY_KEY"`                         // Key is the hex-encoded key used for signing secure URLs.
-	SignatureSize int    `envconfig:"IMGPROXY_SIGNATURE_SIZE" default:"32"` // SignatureSize specifies the desired length of the generated signature in bytes (max 32).
-	BaseURL       string `envconfig:"IMGPROXY_BASE_URL"`                    // BaseURL is the base URL of the imgproxy service.
-	Secret        string `envconfig:"IMGPROXY_SECRET"`                      // Secret is the authorization token sent as Bearer token to imgproxy.
+	Encode        bool   `env:"IMGPROXY_ENCODE, default=true"`       // Encode indicates whether the source URI should be Base64 encoded.
+	Salt          string `env:"IMGPROXY_SALT"`                       // Salt is the hex-encoded salt used for signing secure URLs.
+	Key           string `env:"IMGPROXY_KEY"`                        // Key is the hex-encoded key used for signing secure URLs.
+	SignatureSize int    `env:"IMGPROXY_SIGNATURE_SIZE, default=32"` // SignatureSize specifies the desired length of the generated signature in bytes (max 32).
+	BaseURL       string `env:"IMGPROXY_BASE_URL"`                   // BaseURL is the base URL of the imgproxy service.
+	Secret        string `env:"IMGPROXY_SECRET"`                     // Secret is the authorization token sent as Bearer token to imgproxy.
+
+	// Secrets may instead be read from files, e.g. Docker or Kubernetes secret mounts
+	KeyFile        string   `env:"IMGPROXY_KEY_FILE"`    // File containing the signing key
+	SaltFile       string   `env:"IMGPROXY_SALT_FILE"`   // File containing the signing salt
+	SecretFile     string   `env:"IMGPROXY_SECRET_FILE"` // File containing the backend authorization token
+	SecretRefFiles []string // Files read through "secret:file:" references, watched like the _FILE variants
 
 	// Metrics and logging configuration
-	MetricsEnabled   bool   `envconfig:"METRICS_ENABLED" default:"true"`             // Whether to enable Prometheus metrics
-	MetricsEndpoint  string `envconfig:"METRICS_ENDPOINT" default:"/metrics"`        // Endpoint for Prometheus metrics
-	MetricsNamespace string `envconfig:"METRICS_NAMESPACE" default:"imgproxy_proxy"` // Namespace for Prometheus metrics
-	LogLevel         int    `envconfig:"LOG_LEVEL" default:"1"`                      // Log level (0=DEBUG, 1=INFO, 2=WARN, 3=ERROR, 4=FATAL)
-	ServerPort       string `envconfig:"SERVER_PORT" default:":8080"`                // Port on which the server listens
+	MetricsEnabled          bool          `env:"METRICS_ENABLED, default=true"`                      // Whether to enable Prometheus metrics
+	MetricsEndpoint         string        `env:"METRICS_ENDPOINT, default=/metrics"`                 // Endpoint for Prometheus metrics
+	MetricsNamespace        string        `env:"METRICS_NAMESPACE, default=imgproxy_proxy"`          // Namespace for Prometheus metrics
+	MetricsLabels           []string      `env:"METRICS_LABELS, default=route,tenant,format,preset"` // Labels attached to request metrics
+	MetricsLabelMaxValues   int           `env:"METRICS_LABEL_MAX_VALUES, default=100"`              // Maximum distinct values per label, further values are recorded as "other" (0 disables the limit)
+	MetricsGoCollector      bool          `env:"METRICS_GO_COLLECTOR, default=true"`                 // Whether to export Go runtime metrics
+	MetricsProcessCollector bool          `env:"METRICS_PROCESS_COLLECTOR, default=true"`            // Whether to export process metrics (CPU, memory, file descriptors)
+	LogLevel                logging.Level `env:"LOG_LEVEL, default=info"`                            // Log level, by name (debug, info, warn, error, fatal) or number (0=DEBUG, 1=INFO, 2=WARN, 3=ERROR, 4=FATAL)
+	LogFormat               string        `env:"LOG_FORMAT, default=text"`                           // Log output format, "text" or "json"
+	LogHashSources          bool          `env:"LOG_HASH_SOURCES, default=false"`                    // Whether to log hashes of source URLs instead of the decoded URLs
+	LogTrustedProxies       []string      `env:"LOG_TRUSTED_PROXIES"`                                // Proxies (addresses or CIDR ranges) whose forwarding headers give the client address matched by log level rules
+	AccessLog               string        `env:"ACCESS_LOG"`                                         // Access log destination: "stdout", "stderr" or a file path (disabled when empty)
+	AccessLogFormat         string        `env:"ACCESS_LOG_FORMAT, default=combined"`                // Access log format: "combined", "json" or "template"
+	AccessLogTemplate       string        `env:"ACCESS_LOG_TEMPLATE"`                                // Go template of access log lines in the template format
+	AccessLogSampleRate     float64       `env:"ACCESS_LOG_SAMPLE_RATE, default=1"`                  // Ratio of 2xx responses written to the access log; other responses are always written
+	AccessLogRedact         bool          `env:"ACCESS_LOG_REDACT, default=false"`                   // Whether to mask signatures and source URLs in the access log
+	ServerPort              string        `env:"SERVER_PORT, default=:8080"`                         // Port on which the server listens
+
+	// HTTP server and shutdown configuration
+	ServerReadTimeout       time.Duration `env:"SERVER_READ_TIMEOUT, default=30s"`         // Maximum time to read a whole request (0 disables the limit)
+	ServerReadHeaderTimeout time.Duration `env:"SERVER_READ_HEADER_TIMEOUT, default=10s"`  // Maximum time to read request headers (0 disables the limit)
+	ServerWriteTimeout      time.Duration `env:"SERVER_WRITE_TIMEOUT, default=60s"`        // Maximum time to write a response, including the backend fetch (0 disables the limit)
+	ServerIdleTimeout       time.Duration `env:"SERVER_IDLE_TIMEOUT, default=120s"`        // How long idle keep-alive connections are kept open
+	ServerMaxHeaderBytes    int           `env:"SERVER_MAX_HEADER_BYTES, default=1048576"` // Maximum size of request headers in bytes
+	ShutdownTimeout         time.Duration `env:"SHUTDOWN_TIMEOUT, default=30s"`            // How long in-flight requests may take to finish on SIGTERM
+	ShutdownDelay           time.Duration `env:"SHUTDOWN_DELAY, default=0s"`               // How long to keep serving while reporting not ready before draining starts
+
+	// Readiness checks
+	HealthCheckBackendPath string        `env:"HEALTH_CHECK_BACKEND_PATH, default=/health"` // Path of the imgproxy health endpoint probed by /readyz (the backend is not probed when empty)
+	HealthCheckTimeout     time.Duration `env:"HEALTH_CHECK_TIMEOUT, default=2s"`           // Timeout of each readiness check
+	HealthCheckCacheTTL    time.Duration `env:"HEALTH_CHECK_CACHE_TTL, default=5s"`         // How long readiness check results are reused
+
+	// Tracing, configured with the standard OpenTelemetry variables
+	TracesExporter     string  `env:"OTEL_TRACES_EXPORTER, default=none"`                         // Trace exporter, "otlp" or "none"
+	OTLPEndpoint       string  `env:"OTEL_EXPORTER_OTLP_ENDPOINT, default=http://localhost:4318"` // Base URL of the OTLP/HTTP collector; spans are sent to /v1/traces
+	OTLPTracesEndpoint string  `env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`                         // Full URL spans are sent to, overriding OTEL_EXPORTER_OTLP_ENDPOINT
+	OTLPHeaders        string  `env:"OTEL_EXPORTER_OTLP_HEADERS"`                                 // Headers sent to the collector as comma-separated key=value pairs
+	ServiceName        string  `env:"OTEL_SERVICE_NAME, default=imgproxy-proxy"`                  // Service name reported with spans
+	TracesSampleRatio  float64 `env:"OTEL_TRACES_SAMPLER_ARG, default=1"`                         // Ratio of new traces that are sampled; traces continued from a caller follow its decision
+
+	// Rendition cache configuration
+	CacheEnabled      bool          `env:"CACHE_ENABLED, default=false"`           // Whether to cache processed images in memory
+	CacheMaxSize      int64         `env:"CACHE_MAX_SIZE, default=268435456"`      // Maximum total size of cached images in bytes
+	CacheMaxEntrySize int64         `env:"CACHE_MAX_ENTRY_SIZE, default=10485760"` // Maximum size of a single cached image in bytes
+	CacheTTL          time.Duration `env:"CACHE_TTL, default=1h"`                  // How long a cached image is served (0 disables expiry)
+
+	// CORS configuration
+	CORSAllowedOrigins   []string `env:"CORS_ALLOWED_ORIGINS"`                  // Allowed origins ("*", "https://app.example.com" or "https://*.example.com"); CORS is disabled when empty
+	CORSAllowCredentials bool     `env:"CORS_ALLOW_CREDENTIALS, default=false"` // Whether to send Access-Control-Allow-Credentials
+	CORSAllowedHeaders   []string `env:"CORS_ALLOWED_HEADERS"`                  // Request headers allowed in preflight responses (echoes the requested headers when empty)
+	CORSExposedHeaders   []string `env:"CORS_EXPOSED_HEADERS"`                  // Response headers exposed to scripts
+	CORSMaxAge           int      `env:"CORS_MAX_AGE, default=3600"`            // How long preflight responses may be cached, in seconds
+
+	// Source URL restrictions
+	SourceAllowedSchemes []string `env:"SOURCE_ALLOWED_SCHEMES, default=http,https,local,s3,gs,abs,swift"` // Source URL schemes forwarded to imgproxy (any scheme when empty)
+	SourceAllowedHosts   []string `env:"SOURCE_ALLOWED_HOSTS"`                                             // Allowed source hosts or bucket names, "*.example.com" matches subdomains (any host when empty)
+
+	// Networks http(s) source hosts must not resolve to (loopback, link-local and private ranges by default)
+	SourceDenyCIDRs []string `env:"SOURCE_DENY_CIDRS, default=127.0.0.0/8,::1/128,0.0.0.0/8,169.254.0.0/16,fe80::/10,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,fc00::/7"`
+
+	// Source URL rewriting, applied before the source restrictions
+	SourceOrigins      NamedOrigins `env:"SOURCE_ORIGINS"`       // Named origins for "origin:name/path" sources, as name=base-url pairs
+	SourceRewriteRules RewriteRules `env:"SOURCE_REWRITE_RULES"` // Semicolon-separated "from => to" rules, from being a prefix or "regex:pattern"
+
+	// Next.js image loader compatible endpoint
+	NextImageEnabled        bool   `env:"NEXT_IMAGE_ENABLED, default=false"`                                     // Whether to serve the Next.js image optimization API
+	NextImagePath           string `env:"NEXT_IMAGE_PATH, default=/_next/image"`                                 // Path of the Next.js image endpoint
+	NextImageBaseURL        string `env:"NEXT_IMAGE_BASE_URL"`                                                   // Base URL for relative "url" parameters (relative URLs are rejected when empty)
+	NextImageDeviceSizes    []int  `env:"NEXT_IMAGE_DEVICE_SIZES, default=640,750,828,1080,1200,1920,2048,3840"` // Allowed widths, matching images.deviceSizes in next.config.js
+	NextImageSizes          []int  `env:"NEXT_IMAGE_SIZES, default=16,32,48,64,96,128,256,384"`                  // Allowed widths, matching images.imageSizes in next.config.js
+	NextImageDefaultQuality int    `env:"NEXT_IMAGE_DEFAULT_QUALITY, default=75"`                                // Quality used when "q" is omitted
+
+	// URL dialects of other image services, served under their own path prefixes
+	DialectRoutes DialectRoutes `env:"DIALECT_ROUTES"` // Comma-separated /prefix/=dialect@source-base entries, e.g. "/imgix/=imgix@https://cms.example.com/uploads/"
+
+	// Route table with per-host and per-prefix settings
+	RoutesFile string  `env:"ROUTES_FILE"` // Path of a JSON route table (see README)
+	Routes     []Route // Routes loaded from RoutesFile
+
+	// Multi-tenant mode
+	TenantMode  string   `env:"TENANT_MODE"`  // How tenants are resolved: "host" or "path" (disabled when empty)
+	TenantsFile string   `env:"TENANTS_FILE"` // Path of a JSON tenant list (see README)
+	Tenants     []Tenant // Tenants loaded from TenantsFile
+
+	// Config file and hot reload
+	ConfigFile          string        `env:"CONFIG_FILE"`                       // Path of a JSON, YAML or TOML config file; environment variables take precedence
+	ConfigWatchInterval time.Duration `env:"CONFIG_WATCH_INTERVAL, default=5s"` // How often config, routes, tenants and secret files are checked for changes (0 disables watching)
+
+	// Admin API configuration
+	AdminAddr         string `env:"ADMIN_ADDR"`                 // Address of the admin API listener (disabled when empty)
+	AdminToken        string `env:"ADMIN_TOKEN"`                // Bearer token required by the admin API
+	AdminTokenFile    string `env:"ADMIN_TOKEN_FILE"`           // File containing the admin API token
+	AdminUsername     string `env:"ADMIN_USERNAME"`             // Basic auth user name accepted by the admin listener
+	AdminPassword     string `env:"ADMIN_PASSWORD"`             // Basic auth password accepted by the admin listener
+	AdminPasswordFile string `env:"ADMIN_PASSWORD_FILE"`        // File containing the admin basic auth password
+	AdminPprof        bool   `env:"ADMIN_PPROF, default=false"` // Whether to serve pprof under /debug/pprof/ on the admin listener
 }
 
-// LoadConfig loads configuration from environment variables.
-// It returns a Config struct and an error if the configuration is invalid.
+// LoadConfig loads configuration from environment variables and, if CONFIG_FILE
+// is set, from a JSON, YAML or TOML config file. Environment variables take
+// precedence over the file. Secrets are read from their _FILE variants or
+// secret providers. It returns the loaded Config and, if the
+// configuration is invalid, a ValidationError listing all problems.
 func LoadConfig() (Config, error) {
 	var config Config
 
-	if err := envconfig.Process("", &config); err != nil {
-		return config, fmt.Errorf("error loading configuration: %w", err)
+	var fileValues map[string]string
+	if path := os.Getenv(configFileEnv); path != "" {
+		values, err := ReadConfigFile(path)
+		if err != nil {
+			return config, ValidationError{{Field: configFileEnv, Message: err.Error()}}
+		}
+		fileValues = values
 	}
 
-	// Validate required fields
-	if config.Key == "" {
-		return config, fmt.Errorf("IMGPROXY_KEY environment variable is required")
+	decodeErrs, err := decodeConfig(&config, envconfig.MultiLookuper(envconfig.OsLookuper(), envconfig.MapLookuper(fileValues)))
+	if err != nil {
+		return config, err
+	}
+
+	// Collect every problem, including those in secrets and the routes and tenants files
+	errs := resolveSecrets(&config)
+	if config.RoutesFile != "" {
+		routes, err := LoadRoutesFile(config.RoutesFile)
+		if err != nil {
+			errs.add("ROUTES_FILE", "%v", err)
+		}
+		config.Routes = routes
 	}
-	if config.Salt == "" {
-		return config, fmt.Errorf("IMGPROXY_SALT environment variable is required")
+	if config.TenantMode != "" && config.TenantsFile != "" {
+		tenants, err := LoadTenantsFile(config.TenantsFile)
+		if err != nil {
+			errs.add("TENANTS_FILE", "%v", err)
+		}
+		config.Tenants = tenants
 	}
-	if config.BaseURL == "" {
-		return config, fmt.Errorf("IMGPROXY_BASE_URL environment variable is required")
+	var validationErr ValidationError
+	if errors.As(config.Validate(), &validationErr) {
+		errs = append(errs, validationErr...)
 	}
 
-	return config, nil
+	return config, append(decodeErrs, errs.without(decodeErrs)...).err()
+}
+
+// decodeConfig loads config from lookuper. Values that cannot be decoded are
+// reported as field errors and left at their defaults, so the rest of the
+// configuration is still loaded and validated.
+func decodeConfig(config *Config, lookuper envconfig.Lookuper) (ValidationError, error) {
+	var errs ValidationError
+	skipped := make(map[string]bool)
+	for {
+		*config = Config{}
+		err := envconfig.ProcessWith(context.Background(), &envconfig.Config{
+			Target:   config,
+			Lookuper: skipLookuper{lookuper, skipped},
+		})
+		if err == nil {
+			return errs, nil
+		}
+
+		// Defaults are not looked up, so a failing skipped key cannot be retried
+		fieldErr, ok := decodeError(err)
+		if !ok || skipped[fieldErr.Field] {
+			return errs, fmt.Errorf("error loading configuration: %w", err)
+		}
+		errs = append(errs, fieldErr)
+		skipped[fieldErr.Field] = true
+	}
 }
 
-// MustLoadConfig loads configuration from environment variables and
-// exits the program if the configuration is invalid.
+// skipLookuper hides the skipped keys from the wrapped lookuper.
+type skipLookuper struct {
+	envconfig.Lookuper
+	skipped map[string]bool
+}
+
+// Lookup implements envconfig.Lookuper.
+func (l skipLookuper) Lookup(key string) (string, bool) {
+	if l.skipped[key] {
+		return "", false
+	}
+	return l.Lookuper.Lookup(key)
+}
+
+// redactedValue replaces secrets in printed configurations.
+const redactedValue = logging.Redacted
+
+// redact masks a secret, keeping empty values empty so unset secrets stay visible.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// MetricsLabelPolicy returns the label policy of request metrics.
+func (c Config) MetricsLabelPolicy() metrics.LabelPolicy {
+	return metrics.LabelPolicy{Labels: c.MetricsLabels, MaxValues: c.MetricsLabelMaxValues}
+}
+
+// Trace exporters selected by OTEL_TRACES_EXPORTER.
+const (
+	TracesExporterNone = "none" // Tracing is disabled
+	TracesExporterOTLP = "otlp" // Spans are sent to an OTLP/HTTP collector
+)
+
+// AccessLogOptions returns the options of the access logger.
+func (c Config) AccessLogOptions() logging.AccessLogOptions {
+	return logging.AccessLogOptions{Format: c.AccessLogFormat, Template: c.AccessLogTemplate, SampleRate: c.AccessLogSampleRate}
+}
+
+// OTLPTracesURL returns the URL OTLP spans are sent to.
+func (c Config) OTLPTracesURL() string {
+	if c.OTLPTracesEndpoint != "" {
+		return c.OTLPTracesEndpoint
+	}
+	return strings.TrimSuffix(c.OTLPEndpoint, "/") + "/v1/traces"
+}
+
+// Redacted returns a copy of the configuration with signing keys, salts,
+// secrets and tokens masked, including those of routes and tenants.
+func (c Config) Redacted() Config {
+	c.Key, c.Salt, c.Secret, c.AdminToken = redact(c.Key), redact(c.Salt), redact(c.Secret), redact(c.AdminToken)
+	c.AdminPassword, c.OTLPHeaders = redact(c.AdminPassword), redact(c.OTLPHeaders)
+
+	routes := make([]Route, len(c.Routes))
+	for i, route := range c.Routes {
+		route.Backend = route.Backend.redacted()
+		route.AuthTokens = make([]string, len(route.AuthTokens))
+		for j := range route.AuthTokens {
+			route.AuthTokens[j] = redactedValue
+		}
+		routes[i] = route
+	}
+	c.Routes = routes
+
+	tenants := make([]Tenant, len(c.Tenants))
+	for i, tenant := range c.Tenants {
+		tenant.Backend = tenant.Backend.redacted()
+		tenants[i] = tenant
+	}
+	c.Tenants = tenants
+	return c
+}
+
+// Secrets returns the secret values of the configuration, including those of
+// routes and tenants. They are masked wherever they appear in logs.
+func (c Config) Secrets() []string {
+	secrets := []string{c.Key, c.Salt, c.Secret, c.AdminToken, c.AdminPassword, c.OTLPHeaders}
+	if headers, err := tracing.ParseHeaders(c.OTLPHeaders); err == nil {
+		for _, value := range headers {
+			secrets = append(secrets, value)
+		}
+	}
+	for _, route := range c.Routes {
+		secrets = append(secrets, route.Key, route.Salt, route.Secret)
+		secrets = append(secrets, route.AuthTokens...)
+	}
+	for _, tenant := range c.Tenants {
+		secrets = append(secrets, tenant.Key, tenant.Salt, tenant.Secret)
+	}
+	return secrets
+}
+
+// Settings returns the configuration as NAME=value lines in field order,
+// using the environment variable names.
+func (c Config) Settings() []string {
+	var settings []string
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envKey(t.Field(i))
+		if name == "" {
+			continue
+		}
+		settings = append(settings, name+"="+formatSetting(v.Field(i)))
+	}
+	return settings
+}
+
+// formatSetting formats a field value the way it is written in an environment variable.
+func formatSetting(value reflect.Value) string {
+	if stringer, ok := value.Interface().(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	if value.Kind() == reflect.Slice {
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(value.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// MustLoadConfig loads configuration like LoadConfig and exits the program if
+// the configuration is invalid.
 func MustLoadConfig() Config {
-	logger := logging.NewLogger(logging.LevelInfo)
 	config, err := LoadConfig()
 	if err != nil {
-		logger.Fatal("Configuration error: %v", err)
+		logging.NewLogger(logging.LevelInfo).Fatal("Configuration error: %v", err)
 	}
-
-	// Update logger with configured log level
-	logger = logging.NewLogger(config.LogLevel)
 	return config
 }
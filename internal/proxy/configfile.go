@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileEnv names the environment variable holding the config file path.
+const configFileEnv = "CONFIG_FILE"
+
+// ReadConfigFile reads a config file into settings keyed by environment
+// variable name, e.g. {"IMGPROXY_BASE_URL": "http://imgproxy:8080"}. The format is
+// chosen by extension: .json, .yaml/.yml or .toml. Lists are joined with commas
+// and tables become comma-separated key=value pairs, matching the env var syntax.
+func ReadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var raw map[string]any
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q, use .json, .yaml or .toml", filepath.Ext(path))
+	}
+	if err == nil {
+		values, err = configValues(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	known := configKeys()
+	normalized := make(map[string]string, len(values))
+	for key, value := range values {
+		key = strings.ToUpper(strings.TrimSpace(key))
+		if !known[key] {
+			return nil, fmt.Errorf("unknown setting %q in config file %s", key, path)
+		}
+		normalized[key] = value
+	}
+	return normalized, nil
+}
+
+// configKeys returns the environment variable names of all Config fields.
+func configKeys() map[string]bool {
+	keys := map[string]bool{configFileEnv: true}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := envKey(t.Field(i)); name != "" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+// envKey returns the environment variable name in the env tag of a Config field.
+func envKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+	return strings.TrimSpace(key)
+}
+
+// configValues formats the decoded settings of a config file as environment variable values.
+func configValues(raw map[string]any) (map[string]string, error) {
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := configValueString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
+
+// configValueString formats a decoded JSON, YAML or TOML value the way it
+// would be written in an environment variable.
+func configValueString(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
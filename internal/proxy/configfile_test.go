@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	expected := map[string]string{
+		"IMGPROXY_BASE_URL":    "http://imgproxy:8080",
+		"IMGPROXY_ENCODE":      "false",
+		"CACHE_TTL":            "10m",
+		"CORS_ALLOWED_ORIGINS": "https://a.example.com,https://b.example.com",
+	}
+
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		expected  map[string]string
+		expectErr bool
+	}{
+		{
+			name:     "JSON",
+			file:     "config.json",
+			content:  `{"IMGPROXY_BASE_URL": "http://imgproxy:8080", "imgproxy_encode": false, "CACHE_TTL": "10m", "CORS_ALLOWED_ORIGINS": ["https://a.example.com", "https://b.example.com"]}`,
+			expected: expected,
+		},
+		{
+			name: "YAML",
+			file: "config.yaml",
+			content: "# proxy settings\n---\nIMGPROXY_BASE_URL: http://imgproxy:8080\nIMGPROXY_ENCODE: false # keep plain URLs\n" +
+				"CACHE_TTL: '10m'\nCORS_ALLOWED_ORIGINS: [\"https://a.example.com\", https://b.example.com]\n",
+			expected: expected,
+		},
+		{
+			name: "TOML",
+			file: "config.toml",
+			content: "IMGPROXY_BASE_URL = \"http://imgproxy:8080\"\nimgproxy_encode = false\n\n" +
+				"CACHE_TTL = \"10m\"\nCORS_ALLOWED_ORIGINS = [\"https://a.example.com\", \"https://b.example.com\"]\n",
+			expected: expected,
+		},
+		{name: "JSON object", file: "c.json", content: `{"SOURCE_ORIGINS": {"products": "s3://bucket/", "cms": "https://cms/"}}`, expected: map[string]string{"SOURCE_ORIGINS": "cms=https://cms/,products=s3://bucket/"}},
+		{name: "YAML block list", file: "c.yml", content: "CORS_ALLOWED_ORIGINS:\n  - https://a.example.com\n  - https://b.example.com\nIMGPROXY_SIGNATURE_SIZE: 16\n", expected: map[string]string{"CORS_ALLOWED_ORIGINS": "https://a.example.com,https://b.example.com", "IMGPROXY_SIGNATURE_SIZE": "16"}},
+		{name: "TOML inline table", file: "c.toml", content: "SOURCE_ORIGINS = { products = \"s3://bucket/\", cms = \"https://cms/\" }\n", expected: map[string]string{"SOURCE_ORIGINS": "cms=https://cms/,products=s3://bucket/"}},
+		{name: "Unknown key", file: "c.json", content: `{"IMGPROXY_KYE": "x"}`, expectErr: true},
+		{name: "Nested YAML", file: "c.yaml", content: "imgproxy:\n  key: abc\n", expectErr: true},
+		{name: "TOML table", file: "c.toml", content: "[imgproxy]\nkey = \"abc\"\n", expectErr: true},
+		{name: "Unterminated string", file: "c.toml", content: "IMGPROXY_KEY = \"abc\n", expectErr: true},
+		{name: "Unsupported format", file: "c.ini", content: "IMGPROXY_KEY=abc", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadConfigFile(path)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("ReadConfigFile() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("ReadConfigFile() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "IMGPROXY_KEY: 0123456789abcdef\nIMGPROXY_SALT: 0123456789abcdef\nIMGPROXY_BASE_URL: http://file:8080\nCACHE_TTL: 10m\nLOG_LEVEL: debug\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("IMGPROXY_BASE_URL", "http://env:8080")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.BaseURL != "http://env:8080" {
+		t.Errorf("BaseURL = %v, want the environment to override the file", config.BaseURL)
+	}
+	if config.Key != "0123456789abcdef" || config.CacheTTL != 10*time.Minute || config.LogLevel != logging.LevelDebug {
+		t.Errorf("expected settings from the file, got Key %q, CacheTTL %v and LogLevel %v", config.Key, config.CacheTTL, config.LogLevel)
+	}
+	if _, set := os.LookupEnv("IMGPROXY_KEY"); set {
+		t.Error("expected settings from the file not to leak into the environment")
+	}
+}
+
+func TestLoadConfigFileInvalidValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("IMGPROXY_SIGNATURE_SIZE = \"large\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+
+	_, err := LoadConfig()
+	var validationErr ValidationError
+	if !errors.As(err, &validationErr) || validationErr[0].Field != "IMGPROXY_SIGNATURE_SIZE" {
+		t.Errorf("LoadConfig() error = %v, want an IMGPROXY_SIGNATURE_SIZE field error", err)
+	}
+}
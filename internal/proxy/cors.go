@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy decides which cross-origin requests may read images served by the proxy.
+// Its headers replace any CORS headers returned by the backend imgproxy service.
+type CORSPolicy struct {
+	allowAll         bool
+	origins          map[string]bool
+	wildcards        []string // Origin suffixes for "scheme://*.domain" patterns, stored as "scheme://" + ".domain"
+	allowCredentials bool
+	allowedHeaders   string
+	exposedHeaders   string
+	maxAge           int
+}
+
+// NewCORSPolicy builds a CORS policy from the configuration.
+// It returns nil when no allowed origins are configured, which disables CORS.
+func NewCORSPolicy(config Config) *CORSPolicy {
+	if len(config.CORSAllowedOrigins) == 0 {
+		return nil
+	}
+
+	policy := &CORSPolicy{
+		origins:          make(map[string]bool),
+		allowCredentials: config.CORSAllowCredentials,
+		allowedHeaders:   strings.Join(config.CORSAllowedHeaders, ", "),
+		exposedHeaders:   strings.Join(config.CORSExposedHeaders, ", "),
+		maxAge:           config.CORSMaxAge,
+	}
+	for _, origin := range config.CORSAllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		switch {
+		case origin == "*":
+			policy.allowAll = true
+		case strings.Contains(origin, "://*."):
+			policy.wildcards = append(policy.wildcards, strings.Replace(origin, "://*.", "://.", 1))
+		case origin != "":
+			policy.origins[origin] = true
+		}
+	}
+	return policy
+}
+
+// AllowsOrigin reports whether the given Origin header value is allowed.
+// Wildcard patterns such as "https://*.example.com" match any subdomain but not the apex domain.
+func (p *CORSPolicy) AllowsOrigin(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+	if p.allowAll {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, wildcard := range p.wildcards {
+		scheme, suffix, _ := strings.Cut(wildcard, "://")
+		host, ok := strings.CutPrefix(origin, scheme+"://")
+		if ok && strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the CORS headers of an actual (non-preflight) response.
+func (p *CORSPolicy) Apply(header http.Header, origin string) {
+	if p == nil {
+		return
+	}
+	header.Add("Vary", "Origin")
+	if !p.AllowsOrigin(origin) {
+		return
+	}
+
+	p.setAllowOrigin(header, origin)
+	if p.exposedHeaders != "" {
+		header.Set("Access-Control-Expose-Headers", p.exposedHeaders)
+	}
+}
+
+// mergeVary adds the Vary values of a backend or cached response to header
+// without dropping the ones set by the CORS policy.
+func mergeVary(header http.Header, values []string) {
+	seen := make(map[string]bool)
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			seen[strings.ToLower(strings.TrimSpace(field))] = true
+		}
+	}
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field != "" && !seen[strings.ToLower(field)] {
+				seen[strings.ToLower(field)] = true
+				header.Add("Vary", field)
+			}
+		}
+	}
+}
+
+// Preflight sets the CORS headers answering a preflight request.
+// It returns false if the origin is not allowed.
+func (p *CORSPolicy) Preflight(header http.Header, r *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	if !p.AllowsOrigin(origin) {
+		return false
+	}
+
+	p.setAllowOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", allowedMethods)
+	if p.allowedHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", p.allowedHeaders)
+	} else if requestHeaders := r.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", requestHeaders)
+	}
+	if p.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+	}
+	return true
+}
+
+// setAllowOrigin sets Access-Control-Allow-Origin and, if enabled, Access-Control-Allow-Credentials.
+// Credentialed requests never get the "*" wildcard, as browsers reject it.
+func (p *CORSPolicy) setAllowOrigin(header http.Header, origin string) {
+	if p.allowAll && !p.allowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// isCORSHeader reports whether a response header is controlled by the CORS policy.
+func isCORSHeader(key string) bool {
+	return strings.HasPrefix(http.CanonicalHeaderKey(key), "Access-Control-")
+}
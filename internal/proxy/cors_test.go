@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	policy := NewCORSPolicy(Config{
+		CORSAllowedOrigins: []string{"https://app.example.com", "https://*.cdn.example.com/"},
+	})
+
+	tests := []struct {
+		origin   string
+		expected bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"http://app.example.com", false},
+		{"https://img.cdn.example.com", true},
+		{"https://a.b.cdn.example.com", true},
+		{"https://cdn.example.com", false},
+		{"https://evilcdn.example.com", false},
+		{"http://img.cdn.example.com", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := policy.AllowsOrigin(tt.origin); got != tt.expected {
+				t.Errorf("AllowsOrigin(%q) = %v, want %v", tt.origin, got, tt.expected)
+			}
+		})
+	}
+
+	if NewCORSPolicy(Config{}) != nil {
+		t.Error("expected nil policy when no origins are configured")
+	}
+}
+
+func TestCORSPolicyHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		config          Config
+		origin          string
+		wantAllowOrigin string
+		wantCredentials string
+	}{
+		{
+			name:            "Wildcard without credentials",
+			config:          Config{CORSAllowedOrigins: []string{"*"}},
+			origin:          "https://app.example.com",
+			wantAllowOrigin: "*",
+		},
+		{
+			name:            "Wildcard with credentials echoes origin",
+			config:          Config{CORSAllowedOrigins: []string{"*"}, CORSAllowCredentials: true},
+			origin:          "https://app.example.com",
+			wantAllowOrigin: "https://app.example.com",
+			wantCredentials: "true",
+		},
+		{
+			name:            "Disallowed origin",
+			config:          Config{CORSAllowedOrigins: []string{"https://app.example.com"}},
+			origin:          "https://evil.example.com",
+			wantAllowOrigin: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			NewCORSPolicy(tt.config).Apply(header, tt.origin)
+
+			if got := header.Get("Access-Control-Allow-Origin"); got != tt.wantAllowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllowOrigin)
+			}
+			if got := header.Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+			if header.Get("Vary") != "Origin" {
+				t.Errorf("expected Vary: Origin, got %q", header.Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	policy := NewCORSPolicy(Config{
+		CORSAllowedOrigins: []string{"https://*.example.com"},
+		CORSAllowedHeaders: []string{"Accept", "X-Custom"},
+		CORSMaxAge:         600,
+	})
+
+	req := httptest.NewRequest("OPTIONS", "/sig/enc", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	header := http.Header{}
+
+	if !policy.Preflight(header, req) {
+		t.Fatal("expected preflight to be allowed")
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers": "Accept, X-Custom",
+		"Access-Control-Max-Age":       "600",
+	}
+	for key, want := range expected {
+		if got := header.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	req.Header.Set("Origin", "https://example.org")
+	if policy.Preflight(http.Header{}, req) {
+		t.Error("expected preflight from unknown origin to be rejected")
+	}
+}
+
+// TestHandleImageProxyCORSOverridesBackend tests that backend CORS headers are replaced by the policy
+func TestHandleImageProxyCORSOverridesBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example.com")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:                "0123456789abcdef0123456789abcdef",
+		Salt:               "0123456789abcdef0123456789abcdef",
+		BaseURL:            backend.URL,
+		Encode:             true,
+		SignatureSize:      32,
+		CORSAllowedOrigins: []string{"https://app.example.com"},
+		CORSExposedHeaders: []string{"ETag"},
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	req := httptest.NewRequest("GET", signedRequestPath(t, config, "", "https://example.com/cat.png"), nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	handler.HandleImageProxy(rr, req)
+
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the proxy's policy", got)
+	}
+	if got := rr.Header().Get("Access-Control-Expose-Headers"); got != "ETag" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want %q", got, "ETag")
+	}
+}
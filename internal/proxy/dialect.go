@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Dialect translates the URL syntax of another image service into the
+// imgproxy option model, so existing URLs keep working behind the proxy.
+type Dialect interface {
+	// Name returns the name used to select the dialect in DIALECT_ROUTES.
+	Name() string
+	// Translate converts the request path (relative to the route prefix) and
+	// query into the source path and imgproxy options.
+	Translate(path string, query url.Values) (Translation, error)
+}
+
+// Translation is the result of translating a dialect URL.
+type Translation struct {
+	Source     string   // Source path, relative to the route's source base URL
+	Options    []string // imgproxy options, e.g. "w:300" or "rt:fill"
+	AutoFormat bool     // Whether the output format should be negotiated from the Accept header
+}
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = map[string]Dialect{}
+)
+
+// RegisterDialect makes a dialect available to DIALECT_ROUTES under its name.
+func RegisterDialect(d Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	dialects[d.Name()] = d
+}
+
+// LookupDialect returns the registered dialect with the given name.
+func LookupDialect(name string) (Dialect, bool) {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	d, ok := dialects[name]
+	return d, ok
+}
+
+func init() {
+	RegisterDialect(imgixDialect{})
+	RegisterDialect(cloudinaryDialect{})
+}
+
+// DialectRoute serves URLs under Prefix using a dialect, resolving source
+// paths against SourceBase.
+type DialectRoute struct {
+	Prefix     string // Path prefix, always ending with "/"
+	Dialect    string // Name of a registered dialect
+	SourceBase string // Base URL prepended to translated source paths, e.g. "https://cms.example.com/uploads/" or "origin:products/"
+}
+
+// DialectRoutes decodes from a comma-separated list of prefix=dialect@source-base
+// entries, e.g. "/imgix/=imgix@https://cms.example.com/uploads/,/cld/=cloudinary@origin:products/".
+type DialectRoutes []DialectRoute
+
+// EnvDecode implements envconfig.Decoder.
+func (routes *DialectRoutes) EnvDecode(value string) error {
+	var decoded DialectRoutes
+	for _, spec := range strings.Split(value, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		prefix, rest, ok := strings.Cut(spec, "=")
+		name, base, hasBase := strings.Cut(rest, "@")
+		prefix, name, base = strings.TrimSpace(prefix), strings.TrimSpace(name), strings.TrimSpace(base)
+		if !ok || !hasBase || !strings.HasPrefix(prefix, "/") || name == "" || base == "" {
+			return fmt.Errorf("invalid dialect route %q, expected /prefix/=dialect@source-base", spec)
+		}
+		if _, ok := LookupDialect(name); !ok {
+			return fmt.Errorf("invalid dialect route %q: unknown dialect %q", spec, name)
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		decoded = append(decoded, DialectRoute{Prefix: prefix, Dialect: name, SourceBase: base})
+	}
+
+	// Longest prefixes first, so the most specific route wins
+	sort.SliceStable(decoded, func(i, j int) bool { return len(decoded[i].Prefix) > len(decoded[j].Prefix) })
+	*routes = decoded
+	return nil
+}
+
+// String formats the routes in the form accepted by EnvDecode.
+func (routes DialectRoutes) String() string {
+	specs := make([]string, len(routes))
+	for i, route := range routes {
+		specs[i] = route.Prefix + "=" + route.Dialect + "@" + route.SourceBase
+	}
+	return strings.Join(specs, ",")
+}
+
+// parseDialectRequest translates unsigned URLs written in the syntax of another
+// image service, such as imgix (/img.jpg?w=300&fit=crop&auto=format) or Cloudinary
+// (/w_300,c_fill/img.jpg), into a source URL and imgproxy options. The dialect is
+// the route type; sources are resolved against the route's source base and
+// restricted by the source policy. It returns false if an error response has been written.
+func (h *ProxyHandler) parseDialectRequest(w http.ResponseWriter, r *http.Request, req *imageRequest) (string, string, bool) {
+	dialect, ok := LookupDialect(req.route.Type)
+	if !ok {
+		req.logger.Error("Unknown dialect %q for route %s", req.route.Type, req.route.Name)
+		h.fail(w, req, http.StatusNotFound, "Not found")
+		return "", "", false
+	}
+
+	translation, err := dialect.Translate(strings.TrimPrefix(req.route.relativePath(r.URL.Path), "/"), r.URL.Query())
+	if err != nil {
+		req.logger.Warn("Invalid %s URL: %v", dialect.Name(), err)
+		h.fail(w, req, http.StatusBadRequest, err.Error())
+		return "", "", false
+	}
+
+	req.rawSource = translation.Source
+	options := strings.Join(translation.Options, "/")
+	if translation.AutoFormat {
+		options = addFormatFromAcceptHeader(options, r.Header.Get("Accept"))
+	}
+	source := strings.TrimSuffix(req.route.SourceBase, "/") + "/" + strings.TrimPrefix(translation.Source, "/")
+	return source, options, true
+}
+
+// gravities maps compass directions, in any order, to imgproxy gravity types.
+var gravities = map[string]string{
+	"top":          "no",
+	"bottom":       "so",
+	"left":         "we",
+	"right":        "ea",
+	"top,left":     "nowe",
+	"left,top":     "nowe",
+	"top,right":    "noea",
+	"right,top":    "noea",
+	"bottom,left":  "sowe",
+	"left,bottom":  "sowe",
+	"bottom,right": "soea",
+	"right,bottom": "soea",
+	"center":       "ce",
+}
+
+// formatAliases maps format names used by other image services to imgproxy formats.
+var formatAliases = map[string]string{
+	"jpg":   "jpg",
+	"pjpg":  "jpg",
+	"png":   "png",
+	"png8":  "png",
+	"png32": "png",
+	"webp":  "webp",
+	"avif":  "avif",
+	"gif":   "gif",
+}
+
+// Limits of dialect sizes, matching the ones of imgix. Larger values are
+// clamped, since dialect routes are unsigned.
+const (
+	maxDialectSize = 8192 // Maximum width or height in pixels
+	maxDialectDPR  = 5    // Maximum device pixel ratio
+)
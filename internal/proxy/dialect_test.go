@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/pkg/signing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestImgixDialectTranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		query    string
+		expected Translation
+		wantErr  bool
+	}{
+		{
+			name:     "Resize and crop with auto format",
+			path:     "img.jpg",
+			query:    "w=300&h=200&fit=crop&auto=format",
+			expected: Translation{Source: "img.jpg", Options: []string{"w:300", "h:200", "rt:fill"}, AutoFormat: true},
+		},
+		{
+			name:     "Explicit format wins over auto",
+			path:     "a/b.png",
+			query:    "w=100&fm=webp&auto=format,compress&q=70",
+			expected: Translation{Source: "a/b.png", Options: []string{"w:100", "q:70", "f:webp"}},
+		},
+		{
+			name:     "Crop gravity and dpr",
+			path:     "img.jpg",
+			query:    "fit=crop&crop=top,left&dpr=2",
+			expected: Translation{Source: "img.jpg", Options: []string{"rt:fill", "g:nowe", "dpr:2"}},
+		},
+		{
+			name:     "Focal point",
+			path:     "img.jpg",
+			query:    "crop=focalpoint&fp-x=0.3&fp-y=0.6",
+			expected: Translation{Source: "img.jpg", Options: []string{"g:fp:0.3:0.6"}},
+		},
+		{
+			name:     "Unknown parameters ignored",
+			path:     "img.jpg",
+			query:    "txt=hello&fit=unknown",
+			expected: Translation{Source: "img.jpg"},
+		},
+		{
+			name:     "Sizes clamped",
+			path:     "img.jpg",
+			query:    "w=100000&h=8193&dpr=10",
+			expected: Translation{Source: "img.jpg", Options: []string{"w:8192", "h:8192", "dpr:5"}},
+		},
+		{name: "Invalid width", path: "img.jpg", query: "w=abc", wantErr: true},
+		{name: "Invalid quality", path: "img.jpg", query: "q=0", wantErr: true},
+		{name: "Missing path", path: "", query: "w=100", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			got, err := imgixDialect{}.Translate(tt.path, values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Translate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Translate() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCloudinaryDialectTranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected Translation
+		wantErr  bool
+	}{
+		{
+			name:     "Fill with auto format",
+			path:     "w_300,h_200,c_fill,g_auto,f_auto/folder/img.jpg",
+			expected: Translation{Source: "folder/img.jpg", Options: []string{"w:300", "h:200", "rt:fill", "g:sm"}, AutoFormat: true},
+		},
+		{
+			name:     "Chained transformations and version",
+			path:     "w_300,q_80/w_150,f_webp/v1612345678/img.jpg",
+			expected: Translation{Source: "img.jpg", Options: []string{"w:150", "q:80", "f:webp"}},
+		},
+		{
+			name:     "No transformation",
+			path:     "folder/img_1.jpg",
+			expected: Translation{Source: "folder/img_1.jpg"},
+		},
+		{
+			name:     "Gravity and dpr",
+			path:     "c_thumb,g_north_east,dpr_2.0/img.jpg",
+			expected: Translation{Source: "img.jpg", Options: []string{"rt:fill", "g:noea", "dpr:2"}},
+		},
+		{
+			name:     "Sizes clamped",
+			path:     "w_100000,h_9000,dpr_7.5/img.jpg",
+			expected: Translation{Source: "img.jpg", Options: []string{"w:8192", "h:8192", "dpr:5"}},
+		},
+		{name: "Invalid width", path: "w_abc/img.jpg", wantErr: true},
+		{name: "Missing path", path: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cloudinaryDialect{}.Translate(tt.path, url.Values{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Translate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Translate() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDialectRoutesDecode(t *testing.T) {
+	var routes DialectRoutes
+	if err := routes.EnvDecode("/img=imgix@https://cms.example.com/uploads/, /img/cld/=cloudinary@origin:products/"); err != nil {
+		t.Fatalf("EnvDecode() error = %v", err)
+	}
+
+	if len(routes) != 2 || routes[0].Dialect != "cloudinary" || routes[0].Prefix != "/img/cld/" {
+		t.Errorf("expected the longest prefix first, got %+v", routes)
+	}
+	if routes[1].Dialect != "imgix" || routes[1].Prefix != "/img/" {
+		t.Errorf("unexpected route %+v", routes[1])
+	}
+
+	for _, value := range []string{"/x/=unknown@https://a/", "/x/=imgix", "x/=imgix@https://a/"} {
+		if err := routes.EnvDecode(value); err == nil {
+			t.Errorf("EnvDecode(%q) expected error", value)
+		}
+	}
+}
+
+func TestHandleDialect(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+		w.Write([]byte("image"))
+	}))
+	defer backend.Close()
+
+	var routes DialectRoutes
+	if err := routes.EnvDecode("/imgix/=imgix@https://cms.example.com/uploads/"); err != nil {
+		t.Fatalf("EnvDecode() error = %v", err)
+	}
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       backend.URL,
+		Encode:        true,
+		SignatureSize: 32,
+		DialectRoutes: routes,
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	req := httptest.NewRequest("GET", "/imgix/products/cat.jpg?w=300&fit=crop&auto=format", nil)
+	req.Header.Set("Accept", "image/avif,image/webp")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	encoded := signing.UrlSafeEncode([]byte("https://cms.example.com/uploads/products/cat.jpg"))
+	if !strings.HasSuffix(backendPath, "/w:300/rt:fill/f:avif/"+encoded) {
+		t.Errorf("unexpected backend path %q", backendPath)
+	}
+}
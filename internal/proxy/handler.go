@@ -1,31 +1,159 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"imgproxy-proxy/internal/cache"
 	"imgproxy-proxy/internal/logging"
 	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/internal/tracing"
 	"imgproxy-proxy/pkg/signing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ProxyHandler encapsulates the dependencies needed for handling image proxy requests
 type ProxyHandler struct {
-	config  Config
 	logger  *logging.Logger
 	metrics *metrics.Metrics
+	cache   *cache.Cache
+	tracer  trace.Tracer
+	access  *logging.AccessLogger
+	state   atomic.Pointer[handlerState]
+}
+
+// handlerState holds the configuration of the handler and the policies built
+// from it. It is replaced as a whole when the configuration is reloaded, so a
+// request always sees one consistent configuration.
+type handlerState struct {
+	config   Config
+	cors     *CORSPolicy
+	sources  *SourcePolicy
+	rewriter *SourceRewriter
+	routes   *RouteTable
+	tenants  *Tenants
+	trusted  []netip.Prefix // Proxies trusted to forward the client address to log level rules
+}
+
+// newHandlerState builds the policies for a configuration, keeping the state
+// of tenant rate limiters from the previous state, which may be nil. The
+// returned state is usable even if an error is returned; invalid policies are left out.
+func newHandlerState(config Config, previous *handlerState) (*handlerState, error) {
+	state := &handlerState{
+		config:   config,
+		cors:     NewCORSPolicy(config),
+		rewriter: NewSourceRewriter(config),
+		routes:   NewRouteTable(config),
+	}
+	sources, err := NewSourcePolicy(config)
+	state.sources = sources
+	if err != nil {
+		return state, fmt.Errorf("invalid source policy: %w", err)
+	}
+	trusted, err := parsePrefixes(config.LogTrustedProxies)
+	state.trusted = trusted
+	if err != nil {
+		return state, fmt.Errorf("invalid LOG_TRUSTED_PROXIES: %w", err)
+	}
+	var previousTenants *Tenants
+	if previous != nil {
+		previousTenants = previous.tenants
+	}
+	tenants, err := NewTenants(config, previousTenants)
+	if err != nil {
+		return state, fmt.Errorf("invalid tenant configuration: %w", err)
+	}
+	state.tenants = tenants
+	return state, nil
 }
 
-// NewProxyHandler creates a new instance of ProxyHandler with the provided dependencies
+// NewProxyHandler creates a new instance of ProxyHandler with the provided dependencies.
+// A rendition cache is created when caching is enabled in the configuration.
 func NewProxyHandler(config Config, logger *logging.Logger, metrics *metrics.Metrics) *ProxyHandler {
-	return &ProxyHandler{
-		config:  config,
+	handler := &ProxyHandler{
 		logger:  logger,
 		metrics: metrics,
+		tracer:  tracing.Tracer(nil),
 	}
+	state, err := newHandlerState(config, nil)
+	if err != nil {
+		logger.Error("%v", err)
+	}
+	handler.state.Store(state)
+	handler.redactLogs(config)
+	if config.CacheEnabled {
+		handler.cache = cache.New(config.CacheMaxSize, config.CacheTTL)
+	}
+	return handler
+}
+
+// Reload atomically replaces the handler configuration. Requests in flight
+// finish with the configuration they started with. If the configuration is
+// invalid, the current one is kept and an error is returned.
+//
+// A changed log level replaces the level set at runtime. The cache and its
+// size limits are not reloaded.
+func (h *ProxyHandler) Reload(config Config) error {
+	state, err := newHandlerState(config, h.state.Load())
+	if err != nil {
+		return err
+	}
+	old := h.state.Swap(state).config
+	h.redactLogs(config)
+	if config.LogLevel != old.LogLevel {
+		h.logger.SetLevel(config.LogLevel)
+	}
+	return nil
+}
+
+// redactLogs masks the secrets of the configuration in all messages of the
+// handler logger and sets how source URLs are logged.
+func (h *ProxyHandler) redactLogs(config Config) {
+	redactor := h.logger.Redactor()
+	redactor.SetSecrets(config.Secrets()...)
+	redactor.SetHashSources(config.LogHashSources)
+}
+
+// Config returns the current handler configuration.
+func (h *ProxyHandler) Config() Config {
+	return h.state.Load().config
+}
+
+// Cache returns the rendition cache used by the handler, or nil if caching is disabled.
+func (h *ProxyHandler) Cache() *cache.Cache {
+	return h.cache
+}
+
+// SetAccessLog writes an access log line for every request to access instead
+// of logging completed requests with the application logger. It must be called
+// before the handler serves requests.
+func (h *ProxyHandler) SetAccessLog(access *logging.AccessLogger) {
+	h.access = access
+}
+
+// SetTracerProvider enables tracing of requests with spans created by provider.
+// It must be called before the handler serves requests; a nil provider
+// disables tracing.
+func (h *ProxyHandler) SetTracerProvider(provider trace.TracerProvider) {
+	h.tracer = tracing.Tracer(provider)
 }
 
 // getClientIP extracts the real client IP address from request headers.
@@ -74,6 +202,207 @@ func getClientIP(r *http.Request) string {
 	return ip
 }
 
+// ruleClientIP returns the client address matched by log level rules. Unlike
+// getClientIP, it only believes forwarding headers on connections from trusted
+// proxies, and reads X-Forwarded-For from the right, skipping trusted proxies,
+// so clients cannot pick the level of their own requests by sending the headers.
+func ruleClientIP(r *http.Request, trusted []netip.Prefix) string {
+	addr, err := netip.ParseAddr(r.RemoteAddr)
+	if addrPort, portErr := netip.ParseAddrPort(r.RemoteAddr); portErr == nil {
+		addr, err = addrPort.Addr(), nil
+	}
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	if !containsAddr(trusted, addr) {
+		return addr.String()
+	}
+
+	if ip, err := netip.ParseAddr(r.Header.Get("CF-Connecting-IP")); err == nil {
+		return ip.Unmap().String()
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !containsAddr(trusted, addr) {
+				break
+			}
+		}
+		return addr.String()
+	}
+	if ip, err := netip.ParseAddr(r.Header.Get("X-Real-IP")); err == nil {
+		return ip.Unmap().String()
+	}
+	return addr.String()
+}
+
+// parsePrefixes parses IP addresses and CIDR ranges; an address is a range of
+// one address. Invalid entries are reported in the returned error.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	var invalid []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			invalid = append(invalid, value)
+		}
+	}
+	if len(invalid) > 0 {
+		return prefixes, fmt.Errorf("invalid addresses or CIDR ranges: %s", strings.Join(invalid, ", "))
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether one of prefixes contains addr.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageRequest holds the state of an image request as it moves through the handler.
+type imageRequest struct {
+	startTime  time.Time
+	id         string        // Request ID used in logs
+	client     *http.Request // Request as received from the client
+	clientIP   string
+	path       string       // Request path as received, logged with logPath
+	requestURI string       // Request URI as sent by the client
+	tenant     string       // Tenant label used in metrics
+	owner      *tenantState // Tenant of the request, nil when multi-tenant mode is disabled
+	sources    *SourcePolicy
+	state      *handlerState
+	route      *Route
+	routePath  string // Request path relative to the route prefix
+	config     Config // Configuration with the route and tenant overrides applied
+	format     string // Output format label, set once the response is known
+	preset     string // Presets applied to the request, used in metrics
+	span       trace.Span
+	logger     *logging.Logger // Logger adding the request fields to every message
+	signature  string          // Signature found in the request URI, masked in redacted logs
+	rawSource  string          // Source URL found in the request URI, masked in redacted logs
+
+	backendHost string        // Host of the imgproxy backend the request was forwarded to
+	backendTime time.Duration // Time spent fetching the backend response
+}
+
+// labels returns the bounded metrics labels of the request.
+func (req *imageRequest) labels() metrics.RequestLabels {
+	labels := metrics.RequestLabels{Tenant: req.tenant, Format: req.format, Preset: req.preset}
+	if req.route != nil {
+		labels.Route = req.route.Name
+	}
+	return labels
+}
+
+// newImageRequest starts tracking a request served with the global configuration.
+// It echoes the request ID on the response and starts the server span of the
+// request, continuing the trace of the client if it sent a traceparent header.
+// It returns the request with the span in its context; the caller must end the span.
+func (h *ProxyHandler) newImageRequest(w http.ResponseWriter, r *http.Request) (*http.Request, *imageRequest) {
+	state := h.state.Load()
+	clientIP := getClientIP(r)
+	id := requestID(r)
+	w.Header().Set(RequestIDHeader, id)
+	ctx, span := h.tracer.Start(tracing.Extract(r.Context(), r.Header), r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("server.address", r.Host),
+		attribute.String("client.address", clientIP),
+		attribute.String("http.request.header.x-request-id", id),
+	))
+	return r.WithContext(ctx), &imageRequest{
+		startTime:  time.Now(),
+		id:         id,
+		client:     r,
+		clientIP:   clientIP,
+		path:       r.URL.Path,
+		requestURI: r.URL.RequestURI(),
+		tenant:     DefaultTenant,
+		sources:    state.sources,
+		state:      state,
+		span:       span,
+		logger:     h.logger.ForRequest(ruleClientIP(r, state.trusted), id).With("request_id", id, "client_ip", clientIP),
+	}
+}
+
+// RequestIDHeader is the header carrying the ID of a request. It is accepted
+// from clients, forwarded to imgproxy and echoed on responses.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// requestID returns the request ID sent by the client, or a new one if the
+// client sent none or an invalid one. Accepted IDs consist of printable ASCII
+// characters without spaces, so they cannot break log lines.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// isProxyHeader reports whether a response header is set by the proxy itself,
+// so it is not copied from backend or cached responses.
+func isProxyHeader(key string) bool {
+	return isCORSHeader(key) || http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(RequestIDHeader)
+}
+
+// ServeHTTP serves image requests. In multi-tenant mode the tenant is resolved
+// from the Host header or the first path segment, then the route is selected
+// by host and path prefix. Each route serves signed proxy URLs, the Next.js
+// image API or a URL dialect.
+func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, req := h.newImageRequest(w, r)
+	defer req.span.End()
+
+	if req.state.tenants != nil {
+		tenant, path, ok := req.state.tenants.resolve(r)
+		if !ok {
+			req.tenant = unknownTenant
+			req.logger.Warn("Unknown tenant for request to %s", r.Host)
+			h.fail(w, req, http.StatusNotFound, "Unknown tenant")
+			return
+		}
+		req.tenant = tenant.MetricsLabel
+		req.owner = tenant
+		req.sources = tenant.sources
+		r = withPath(r, path)
+	}
+
+	h.serveRoute(w, r, req, req.state.routes.Match(r.Host, r.URL.Path))
+}
+
 // HandleImageProxy processes incoming image proxy requests by verifying signatures,
 // handling image optimization options, and forwarding requests to the underlying imgproxy service.
 //
@@ -82,57 +411,129 @@ func getClientIP(r *http.Request) string {
 //   - signature: A URL-safe Base64 encoded HMAC-SHA256 signature
 //   - options: Optional image processing parameters (e.g., "w:100/h:50/q:80")
 //   - encoded-uri: Base64 encoded or plain source image URI
+//
+// Tenants and the route table are bypassed; use ServeHTTP to serve them.
 func (h *ProxyHandler) HandleImageProxy(w http.ResponseWriter, r *http.Request) {
-	startTime := time.Now()
-	path := r.URL.Path
+	r, req := h.newImageRequest(w, r)
+	defer req.span.End()
+	h.serveRoute(w, r, req, req.state.routes.Default())
+}
 
-	// Get client IP address using the dedicated function
-	clientIP := getClientIP(r)
+// Routes returns the route table used by ServeHTTP.
+func (h *ProxyHandler) Routes() *RouteTable {
+	return h.state.Load().routes
+}
+
+// withPath returns a shallow copy of r with a new URL path, like http.StripPrefix.
+func withPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// serveRoute handles a request with the given route. Route backend settings
+// never override those of the tenant.
+func (h *ProxyHandler) serveRoute(w http.ResponseWriter, r *http.Request, req *imageRequest, route *Route) {
+	req.route = route
+	req.routePath = route.relativePath(r.URL.Path)
+	req.config = route.Backend.apply(req.state.config)
+	if req.owner != nil {
+		req.config = req.owner.Backend.apply(req.config)
+	}
+	req.logger = req.logger.With("tenant", req.tenant, "route", route.Name)
+	req.span.SetName(r.Method + " " + route.Name)
+	req.span.SetAttributes(attribute.String("imgproxy_proxy.route", route.Name), attribute.String("imgproxy_proxy.tenant", req.tenant))
 
 	// Track request metrics
-	h.metrics.AddRequestInProgress(path)
-	defer h.metrics.RemoveRequestInProgress(path)
+	inProgress := req.labels()
+	h.metrics.AddRequestInProgress(inProgress)
+	defer h.metrics.RemoveRequestInProgress(inProgress)
 
 	// Log request start with IP
-	h.logger.Debug("Received request: %s %s from IP: %s", r.Method, path, clientIP)
+	req.logger.Debug("Received request: %s %s", r.Method, req.logPath())
+
+	// Only GET, HEAD and OPTIONS are meaningful for images
+	if !h.checkMethod(w, r, req) {
+		return
+	}
+
+	// Enforce the tenant's rate limit
+	if req.owner != nil && req.owner.limiter != nil {
+		if ok, retryAfter := req.owner.limiter.allow(); !ok {
+			h.metrics.IncrementRateLimited(req.tenant)
+			req.logger.Warn("Rate limit exceeded for tenant %s", req.owner.ID)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			h.fail(w, req, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+	}
 
+	if !route.authorize(r) {
+		req.logger.Warn("Unauthorized request for route %s: %s", route.Name, req.logPath())
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imgproxy-proxy"`)
+		h.fail(w, req, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var source, options string
+	var ok bool
+	switch route.Type {
+	case RouteTypeSigned:
+		source, options, ok = h.parseSignedRequest(w, r, req)
+	case RouteTypeNextJS:
+		source, options, ok = h.parseNextImageRequest(w, r, req)
+	default:
+		source, options, ok = h.parseDialectRequest(w, r, req)
+	}
+	if !ok {
+		return
+	}
+
+	h.serveImage(w, r, req, source, route.applyOptions(options))
+}
+
+// parseSignedRequest verifies the signature of a signed proxy URL and returns its
+// source URL and options. It returns false if an error response has been written.
+func (h *ProxyHandler) parseSignedRequest(w http.ResponseWriter, r *http.Request, req *imageRequest) (string, string, bool) {
 	// Parse URL and extract parts
-	urlPath := r.URL.Path
-	parts := strings.Split(urlPath, "/")
+	parts := strings.Split(req.routePath, "/")
 	if len(parts) < 3 {
-		status := http.StatusBadRequest
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Warn("Invalid URL format: %s", path)
-		http.Error(w, "Invalid URL format", status)
-		return
+		req.logger.Warn("Invalid URL format: %s", req.logPath())
+		h.fail(w, req, http.StatusBadRequest, "Invalid URL format")
+		return "", "", false
 	}
 
 	// Extract signature and verify
 	signature := parts[1]
+	req.signature, req.rawSource = signature, parts[len(parts)-1]
 	signablePath := strings.Join(parts[2:], "/")
-	expectedSignature, err := signing.Sign(h.config.Key, h.config.Salt, "/"+signablePath, h.config.SignatureSize)
+	_, span := h.tracer.Start(r.Context(), "verify_signature")
+	expectedSignature, err := signing.Sign(req.config.Key, req.config.Salt, "/"+signablePath, req.config.SignatureSize)
+	tracing.RecordError(span, err)
+	if err == nil && signature != expectedSignature {
+		span.SetStatus(codes.Error, "invalid signature")
+	}
+	span.End()
 	if err != nil {
-		status := http.StatusInternalServerError
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.IncrementSignatureError("invalid_key_salt")
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Error("Error verifying signature: %v", err)
-		http.Error(w, "Error verifying signature", status)
-		return
+		h.metrics.IncrementSignatureError("invalid_key_salt", req.tenant)
+		req.logger.Error("Error verifying signature: %v", err)
+		h.fail(w, req, http.StatusInternalServerError, "Error verifying signature")
+		return "", "", false
 	}
 
 	if signature != expectedSignature {
-		status := http.StatusForbidden
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.IncrementSignatureError("invalid_signature")
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Warn("Invalid signature for path: %s", path)
-		http.Error(w, "Invalid signature", status)
-		return
+		h.metrics.IncrementSignatureError("invalid_signature", req.tenant)
+		req.logger.Warn("Invalid signature for path: %s", req.logPath())
+		h.fail(w, req, http.StatusForbidden, "Invalid signature")
+		return "", "", false
 	}
 
 	// Parse existing options and query parameters
+	_, span = h.tracer.Start(r.Context(), "merge_options")
 	existingOpts := ParsePathOptions(parts[2:])
 	queryOpts := ParseQueryToOptions(r.URL.Query())
 
@@ -141,92 +542,433 @@ func (h *ProxyHandler) HandleImageProxy(w http.ResponseWriter, r *http.Request)
 
 	// Determine best image format based on Accept header
 	finalOpts = addFormatFromAcceptHeader(finalOpts, r.Header.Get("Accept"))
+	span.End()
 
-	// Generate new signed URL with updated options
-	var b64TargetUri string // Base64 encoded target URI
-	if len(parts) > 2 {
-		b64TargetUri = parts[len(parts)-1]
+	// Decode the target URI if it was Base64 encoded
+	decodedTargetUrl, err := signing.UrlSafeDecode(parts[len(parts)-1])
+	if err != nil {
+		req.logger.Error("Error decoding URL: %v", err)
+		h.fail(w, req, http.StatusBadRequest, "Error decoding URL")
+		return "", "", false
 	}
 
-	// Decode the target URI if it was Base64 encoded
-	decodedTargetUrl, err := signing.UrlSafeDecode(b64TargetUri)
+	return string(decodedTargetUrl), finalOpts, true
+}
+
+// fail records a failed request in metrics and writes an error response.
+func (h *ProxyHandler) fail(w http.ResponseWriter, req *imageRequest, status int, message string) {
+	h.metrics.IncrementRequestsTotal(http.StatusText(status), req.labels())
+	h.metrics.ObserveRequestDuration(req.startTime, http.StatusText(status), req.labels())
+	tracing.SetHTTPStatus(req.span, trace.SpanKindServer, status)
+	body := message + "\nRequest ID: " + req.id
+	h.logAccess(req, status, int64(len(body)+1), "")
+	http.Error(w, body, status)
+}
+
+// checkMethod applies the method policy of image routes. GET and HEAD requests
+// continue with CORS headers set; OPTIONS requests are answered and any other
+// method is rejected. It returns false if the request has been fully handled.
+func (h *ProxyHandler) checkMethod(w http.ResponseWriter, r *http.Request, req *imageRequest) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		req.state.cors.Apply(w.Header(), r.Header.Get("Origin"))
+		return true
+	case http.MethodOptions:
+		h.handleOptions(w, r, req)
+		h.metrics.IncrementRequestsTotal(http.StatusText(http.StatusNoContent), req.labels())
+		h.metrics.ObserveRequestDuration(req.startTime, http.StatusText(http.StatusNoContent), req.labels())
+		tracing.SetHTTPStatus(req.span, trace.SpanKindServer, http.StatusNoContent)
+		h.logAccess(req, http.StatusNoContent, 0, "")
+		return false
+	default:
+		h.metrics.IncrementMethodNotAllowed(r.Method, req.tenant)
+		req.logger.Warn("Method not allowed: %s %s", r.Method, req.logPath())
+		w.Header().Set("Allow", allowedMethods)
+		h.fail(w, req, http.StatusMethodNotAllowed, "Method not allowed")
+		return false
+	}
+}
+
+// serveImage serves a rendition of the source URL processed with the given imgproxy options.
+// The source is rewritten and checked against the source policy, then the
+// rendition is served from cache or fetched from the backend imgproxy service.
+func (h *ProxyHandler) serveImage(w http.ResponseWriter, r *http.Request, req *imageRequest, source string, options string) {
+	req.preset = presetLabel(options)
+
+	// Map the signed source URL to the URL imgproxy should fetch
+	sourceUrl, err := req.state.rewriter.Rewrite(source)
 	if err != nil {
-		status := http.StatusBadRequest
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Error("Error decoding URL: %v", err)
-		http.Error(w, "Error decoding URL", status)
+		req.logger.Warn("Error rewriting source URL %s: %v", req.logger.Redactor().Source(source), err)
+		h.fail(w, req, http.StatusBadRequest, "Unknown source origin")
 		return
 	}
 
-	newUrl, err := GenerateURL(string(decodedTargetUrl), finalOpts, h.config)
+	// Refuse sources imgproxy must not fetch
+	if err := req.sources.Check(r.Context(), sourceUrl); err != nil {
+		reason := SourceRejectInvalidURL
+		var sourceErr *SourceError
+		if errors.As(err, &sourceErr) {
+			reason = sourceErr.Reason
+		}
+		h.metrics.IncrementSourceRejected(reason, req.tenant)
+		req.logger.Warn("Rejected source URL %s: %s", req.logger.Redactor().Source(sourceUrl), reason)
+		h.fail(w, req, http.StatusForbidden, "Source URL not allowed")
+		return
+	}
+
+	_, span := h.tracer.Start(r.Context(), "generate_url")
+	newUrl, err := GenerateURL(sourceUrl, options, req.config)
+	tracing.RecordError(span, err)
+	span.End()
 	if err != nil {
-		status := http.StatusInternalServerError
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Error("Error generating URL: %v", err)
-		http.Error(w, "Error generating URL", status)
+		req.logger.Error("Error generating URL: %v", err)
+		h.fail(w, req, http.StatusInternalServerError, "Error generating URL")
 		return
 	}
 
+	h.metrics.IncrementOptionUsage(optionUsage(options), req.tenant)
+
+	// Serve the rendition from cache if we already have it
+	sw := &statusWriter{ResponseWriter: w}
+	if h.cache != nil {
+		if entry, ok := h.cache.Get(newUrl); ok {
+			h.metrics.IncrementCacheResult(metrics.CacheHit, req.tenant)
+			serveEntry(sw, r, entry, "HIT")
+			h.complete(r, req, sw)
+			return
+		}
+	}
+	useCache := h.cache != nil && r.Method == http.MethodGet
+
 	// Forward the request
-	h.logger.Debug("Forwarding request to backend: %s", newUrl)
+	req.logger.Debug("Forwarding request for %s to backend %s", req.logger.Redactor().Source(sourceUrl), req.config.BaseURL)
 
-	// Create request
-	req, err := http.NewRequest("GET", newUrl, nil)
+	// Create request. HEAD is forwarded as HEAD so the backend never sends the image body.
+	// The backend request is cancelled when the client goes away.
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	ctx, fetchSpan := h.tracer.Start(r.Context(), "backend_fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("http.request.method", method)))
+	defer fetchSpan.End()
+	backendReq, err := http.NewRequestWithContext(ctx, method, newUrl, nil)
 	if err != nil {
-		status := http.StatusInternalServerError
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.IncrementBackendError("request_creation_error")
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Error("Error creating request: %v", err)
-		http.Error(w, "Error creating request", status)
+		tracing.RecordError(fetchSpan, err)
+		h.metrics.IncrementBackendError("request_creation_error", req.tenant)
+		req.logger.Error("Error creating request: %v", err)
+		h.fail(w, req, http.StatusInternalServerError, "Error creating request")
 		return
 	}
 
 	// Copy headers from original request
 	for key, values := range r.Header {
 		for _, value := range values {
-			req.Header.Add(key, value)
+			backendReq.Header.Add(key, value)
 		}
 	}
-	h.logger.Debug("Copied headers from original request")
+	req.logger.Debug("Copied headers from original request")
+
+	// Conditional and range requests are answered locally from the cached body,
+	// so the backend must always return the full image
+	if useCache {
+		for _, key := range conditionalHeaders {
+			backendReq.Header.Del(key)
+		}
+	}
+
+	// Let imgproxy log the same request ID
+	backendReq.Header.Set(RequestIDHeader, req.id)
+
+	// Continue the trace in imgproxy with the fetch span as parent
+	req.backendHost = backendReq.URL.Host
+	fetchSpan.SetAttributes(attribute.String("server.address", req.backendHost))
+	tracing.Inject(ctx, backendReq.Header)
+
+	// Route tokens are meant for the proxy, never for the backend
+	if len(req.route.AuthTokens) > 0 {
+		backendReq.Header.Del("Authorization")
+	}
 
 	// Add Authorization header if secret is configured
-	if h.config.Secret != "" {
-		req.Header.Set("Authorization", "Bearer "+h.config.Secret)
-		h.logger.Debug("Added Authorization header with bearer token")
+	if req.config.Secret != "" {
+		backendReq.Header.Set("Authorization", "Bearer "+req.config.Secret)
+		req.logger.Debug("Added Authorization header with the backend secret")
 	}
 
 	// Execute request
 	client := &http.Client{}
-	resp, err := client.Do(req)
+	backendStart := time.Now()
+	resp, err := client.Do(backendReq)
 	if err != nil {
-		status := http.StatusInternalServerError
-		h.metrics.IncrementRequestsTotal(http.StatusText(status), path)
-		h.metrics.IncrementBackendError("connection_error")
-		h.metrics.ObserveRequestDuration(startTime, http.StatusText(status), path)
-		h.logger.Error("Error fetching image from backend: %v", err)
-		http.Error(w, "Error fetching image", status)
+		tracing.RecordError(fetchSpan, err)
+		if r.Context().Err() != nil {
+			h.metrics.IncrementClientAbort(req.tenant)
+			req.logger.Debug("Client went away while fetching image from backend: %v", backendError(err))
+			h.fail(w, req, http.StatusServiceUnavailable, "Request cancelled")
+			return
+		}
+		h.metrics.IncrementBackendError("connection_error", req.tenant)
+		req.logger.Error("Error fetching image from backend: %v", backendError(err))
+		h.fail(w, req, http.StatusInternalServerError, "Error fetching image")
 		return
 	}
 	defer resp.Body.Close()
+	tracing.SetHTTPStatus(fetchSpan, trace.SpanKindClient, resp.StatusCode)
+	h.metrics.ObserveBackendTTFB(time.Since(backendStart), req.labels())
+	h.metrics.IncrementBackendResponse(resp.StatusCode, req.tenant)
+
+	// Buffer cacheable responses that fit in a cache entry, then serve them like a cache hit
+	var body io.Reader = resp.Body
+	if useCache && isCacheable(r, resp) && resp.ContentLength <= req.config.CacheMaxEntrySize {
+		buffered, err := io.ReadAll(io.LimitReader(resp.Body, req.config.CacheMaxEntrySize+1))
+		if err != nil {
+			if r.Context().Err() != nil {
+				h.metrics.IncrementClientAbort(req.tenant)
+				req.logger.Debug("Client went away while reading the backend response: %v", err)
+				h.fail(w, req, http.StatusServiceUnavailable, "Request cancelled")
+				return
+			}
+			h.metrics.IncrementBackendError("response_read_error", req.tenant)
+			req.logger.Error("Error reading response body: %v", err)
+			h.fail(w, req, http.StatusInternalServerError, "Error fetching image")
+			return
+		}
+
+		if int64(len(buffered)) <= req.config.CacheMaxEntrySize {
+			req.backendTime = time.Since(backendStart)
+			entry := &cache.Entry{
+				Key:        newUrl,
+				SourceURL:  source,
+				ProxyURL:   req.requestURI,
+				StatusCode: resp.StatusCode,
+				Header:     resp.Header.Clone(),
+				Body:       buffered,
+			}
+			ensureStrongETag(entry)
+			if req.route.CacheTTL > 0 {
+				h.cache.SetWithTTL(entry, time.Duration(req.route.CacheTTL))
+			} else {
+				h.cache.Set(entry)
+			}
+
+			h.metrics.IncrementCacheResult(metrics.CacheMiss, req.tenant)
+			serveEntry(sw, r, entry, "MISS")
+			h.complete(r, req, sw)
+			return
+		}
+
+		// Too large to cache: stream what was read followed by the rest
+		body = io.MultiReader(bytes.NewReader(buffered), resp.Body)
+	}
 
-	// Copy headers and content
+	// Copy headers and content, leaving CORS to the proxy's own policy
 	for k, v := range resp.Header {
-		w.Header()[k] = v
+		switch {
+		case isProxyHeader(k):
+		case k == "Vary":
+			mergeVary(w.Header(), v)
+		default:
+			w.Header()[k] = v
+		}
+	}
+	if h.cache != nil {
+		h.metrics.IncrementCacheResult(metrics.CacheBypass, req.tenant)
+		w.Header().Set("X-Cache", "MISS")
 	}
-	w.WriteHeader(resp.StatusCode)
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		h.logger.Error("Error copying response body: %v", err)
-		h.metrics.IncrementBackendError("response_copy_error")
+	// Answer conditional requests locally when the backend ignored them
+	if resp.StatusCode == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), resp.Header.Get("ETag")) {
+		w.Header().Del("Content-Length")
+		sw.WriteHeader(http.StatusNotModified)
+	} else {
+		sw.WriteHeader(resp.StatusCode)
+		if r.Method != http.MethodHead {
+			if _, err := io.Copy(sw, body); err != nil {
+				if r.Context().Err() != nil {
+					h.metrics.IncrementClientAbort(req.tenant)
+					req.logger.Debug("Client went away while copying response body: %v", err)
+				} else {
+					req.logger.Error("Error copying response body: %v", err)
+					h.metrics.IncrementBackendError("response_copy_error", req.tenant)
+				}
+			}
+		}
 	}
+	req.backendTime = time.Since(backendStart)
+
+	h.complete(r, req, sw)
+}
+
+// complete records the metrics of a served image response and logs it.
+func (h *ProxyHandler) complete(r *http.Request, req *imageRequest, sw *statusWriter) {
+	req.format = formatLabel(sw.Header().Get("Content-Type"))
+	labels := req.labels()
+	status := http.StatusText(sw.Status())
+	duration := time.Since(req.startTime)
 
-	// Record final metrics and log
-	h.metrics.IncrementRequestsTotal(http.StatusText(resp.StatusCode), path)
-	h.metrics.ObserveRequestDuration(startTime, http.StatusText(resp.StatusCode), path)
-	h.logger.RequestLogger(r.Method, path, http.StatusText(resp.StatusCode), time.Since(startTime))
+	h.metrics.IncrementRequestsTotal(status, labels)
+	h.metrics.ObserveRequestDuration(req.startTime, status, labels)
+	h.metrics.ObserveResponseSize(sw.Bytes(), labels)
+	h.metrics.IncrementOutputFormat(labels)
+	if req.backendTime > 0 {
+		h.metrics.ObserveBackendDuration(req.backendTime, labels)
+	}
+	h.metrics.ObserveProxyOverhead(duration-req.backendTime, labels)
+	tracing.SetHTTPStatus(req.span, trace.SpanKindServer, sw.Status())
+	cacheStatus := sw.Header().Get("X-Cache")
+	if h.access != nil {
+		h.logAccess(req, sw.Status(), sw.Bytes(), cacheStatus)
+		return
+	}
+
+	fields := []any{"bytes", sw.Bytes(), "format", req.format}
+	if cacheStatus != "" {
+		fields = append(fields, "cache", cacheStatus)
+	}
+	if req.backendHost != "" {
+		fields = append(fields, "backend_host", req.backendHost, "upstream_latency_ms", float64(req.backendTime)/float64(time.Millisecond))
+	}
+	req.logger.RequestLogger(r.Method, req.logPath(), status, duration, fields...)
+}
+
+// logAccess writes the access log line of a request if the access log is enabled.
+func (h *ProxyHandler) logAccess(req *imageRequest, status int, bytes int64, cacheStatus string) {
+	if h.access == nil {
+		return
+	}
+	uri := req.requestURI
+	if req.state.config.AccessLogRedact {
+		uri = req.redactedURI()
+	}
+	entry := logging.AccessEntry{
+		Time:            req.startTime,
+		RemoteAddr:      req.clientIP,
+		Method:          req.client.Method,
+		URI:             uri,
+		Proto:           req.client.Proto,
+		Status:          status,
+		Bytes:           bytes,
+		Duration:        time.Since(req.startTime),
+		Referer:         req.client.Referer(),
+		UserAgent:       req.client.UserAgent(),
+		RequestID:       req.id,
+		Tenant:          req.tenant,
+		Cache:           cacheStatus,
+		BackendHost:     req.backendHost,
+		UpstreamLatency: req.backendTime,
+	}
+	if req.route != nil {
+		entry.Route = req.route.Name
+	}
+	h.access.Log(entry)
+}
+
+// redactedURI returns the request URI with the signature and the source URL
+// of the request masked.
+func (req *imageRequest) redactedURI() string {
+	uri := req.requestURI
+	if req.signature != "" {
+		uri = strings.Replace(uri, "/"+req.signature+"/", "/"+redactedValue+"/", 1)
+	}
+	if req.rawSource != "" {
+		uri = strings.Replace(uri, req.rawSource, redactedValue, 1)
+	}
+	if req.route != nil && req.route.Type == RouteTypeNextJS {
+		path, query, _ := strings.Cut(uri, "?")
+		if values, err := url.ParseQuery(query); err == nil && values.Has("url") {
+			values.Set("url", redactedValue)
+			uri = path + "?" + values.Encode()
+		}
+	}
+	return uri
+}
+
+// logPath returns the request path as it may be logged. The signature of
+// signed routes is masked and source URLs are decoded or hashed.
+func (req *imageRequest) logPath() string {
+	if req.route == nil || req.route.Type == RouteTypeNextJS {
+		return req.path
+	}
+	prefix := ""
+	if strings.HasSuffix(req.path, req.routePath) {
+		prefix = strings.TrimSuffix(req.path, req.routePath)
+	}
+	redactor := req.logger.Redactor()
+	if req.route.Type == RouteTypeSigned {
+		return prefix + redactor.SignedPath(req.routePath)
+	}
+	return prefix + "/" + redactor.Source(strings.TrimPrefix(req.routePath, "/"))
+}
+
+// backendError strips the backend URL, which holds the imgproxy signature and
+// the source URL, from an error of the backend client.
+func backendError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// allowedMethods is the value of the Allow header for the image route.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// handleOptions answers OPTIONS requests, including CORS preflight requests.
+func (h *ProxyHandler) handleOptions(w http.ResponseWriter, r *http.Request, req *imageRequest) {
+	w.Header().Set("Allow", allowedMethods)
+	if r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		if !req.state.cors.Preflight(w.Header(), r) {
+			req.logger.Debug("Rejected CORS preflight from origin: %s", r.Header.Get("Origin"))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isCacheable reports whether a backend response to the given request may be stored in the cache.
+func isCacheable(r *http.Request, resp *http.Response) bool {
+	if r.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+}
+
+// statusWriter is an http.ResponseWriter that remembers the status code written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status code before delegating to the wrapped writer.
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status before delegating to the wrapped writer.
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Bytes returns the number of body bytes written.
+func (sw *statusWriter) Bytes() int64 {
+	return sw.bytes
+}
+
+// Status returns the status code written so far, defaulting to 200.
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
 }
 
 // addFormatFromAcceptHeader adds format option based on Accept header.
@@ -253,11 +995,100 @@ func addFormatFromAcceptHeader(options string, acceptHeader string) string {
 	return options
 }
 
+// imageFormats maps image media types to output format labels.
+var imageFormats = map[string]string{
+	"image/jpeg":               "jpeg",
+	"image/png":                "png",
+	"image/webp":               "webp",
+	"image/avif":               "avif",
+	"image/gif":                "gif",
+	"image/svg+xml":            "svg",
+	"image/tiff":               "tiff",
+	"image/bmp":                "bmp",
+	"image/heic":               "heic",
+	"image/heif":               "heic",
+	"image/jxl":                "jxl",
+	"image/x-icon":             "ico",
+	"image/vnd.microsoft.icon": "ico",
+}
+
+// formatLabel returns the output format label of a response Content-Type,
+// "other" for unknown types and "" when there is none.
+func formatLabel(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if format, ok := imageFormats[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+		return format
+	}
+	return "other"
+}
+
+// presetLabel returns the imgproxy presets named in the options, joined with
+// ":", or "" when none are used.
+func presetLabel(options string) string {
+	var presets []string
+	for _, option := range strings.Split(options, "/") {
+		name, args, _ := strings.Cut(option, ":")
+		if name == "pr" || name == "preset" {
+			presets = append(presets, strings.Split(args, ":")...)
+		}
+	}
+	return strings.Join(presets, ":")
+}
+
+// Options by the processing they request, used to classify option usage in metrics.
+var (
+	resizeOptions  = []string{"rs", "resize", "s", "size", "w", "width", "h", "height", "z", "zoom", "dpr"}
+	qualityOptions = []string{"q", "quality", "fq", "format_quality"}
+	formatOptions  = []string{"f", "format", "ext"}
+)
+
+// optionUsage classifies imgproxy options as "resize" when they change the
+// image size, "quality" when they only change the quality and format,
+// "format" when they only change the format, "preset" when they only apply
+// presets, "none" when empty and "other" otherwise.
+func optionUsage(options string) string {
+	var resize, quality, format, preset, other bool
+	for _, option := range strings.Split(options, "/") {
+		name, _, _ := strings.Cut(option, ":")
+		switch {
+		case name == "":
+		case containsString(resizeOptions, name):
+			resize = true
+		case containsString(qualityOptions, name):
+			quality = true
+		case containsString(formatOptions, name):
+			format = true
+		case name == "pr" || name == "preset":
+			preset = true
+		default:
+			other = true
+		}
+	}
+
+	switch {
+	case resize:
+		return "resize"
+	case other:
+		return "other"
+	case quality:
+		return "quality"
+	case format:
+		return "format"
+	case preset:
+		return "preset"
+	}
+	return "none"
+}
+
 // CreateHandler returns an HTTP handler function that uses the provided configuration.
+// Its metrics are registered with the default Prometheus registry.
 func CreateHandler(config Config) http.HandlerFunc {
-	logger := logging.NewLogger(config.LogLevel)
-	pMetrics := metrics.NewMetrics(config.MetricsNamespace)
+	logger := logging.New(os.Stdout, config.LogLevel, config.LogFormat)
+	pMetrics := metrics.NewMetrics(prometheus.DefaultRegisterer, config.MetricsNamespace, metrics.WithLabelPolicy(config.MetricsLabelPolicy()))
 	handler := NewProxyHandler(config, logger, pMetrics)
 
-	return handler.HandleImageProxy
+	return handler.ServeHTTP
 }
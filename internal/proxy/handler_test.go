@@ -1,12 +1,29 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"imgproxy-proxy/internal/logging"
 	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/internal/tracing"
+	"imgproxy-proxy/pkg/signing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestAddFormatFromAcceptHeader(t *testing.T) {
@@ -101,7 +118,7 @@ func TestProxyHandler(t *testing.T) {
 		LogLevel:         logging.LevelInfo,
 	}
 	logger := logging.NewLogger(logging.LevelDebug)
-	metrics := metrics.NewMetrics("test") // Use NewTestMetrics instead of NewMetrics
+	metrics := metrics.NewMetrics(prometheus.NewRegistry(), "test")
 
 	// Create handler
 	handler := NewProxyHandler(config, logger, metrics)
@@ -111,8 +128,8 @@ func TestProxyHandler(t *testing.T) {
 	}
 
 	// Simple validation of handler properties
-	if handler.config.Key != config.Key {
-		t.Errorf("handler has incorrect Key, got %s, want %s", handler.config.Key, config.Key)
+	if handler.Config().Key != config.Key {
+		t.Errorf("handler has incorrect Key, got %s, want %s", handler.Config().Key, config.Key)
 	}
 
 	if handler.logger == nil {
@@ -163,7 +180,7 @@ func TestHandleImageProxyBadRequest(t *testing.T) {
 		MetricsNamespace: "test",
 	}
 	logger := logging.NewLogger(logging.LevelDebug)
-	m := metrics.NewMetrics("test") // Use NewTestMetrics instead of NewMetrics
+	m := metrics.NewMetrics(prometheus.NewRegistry(), "test")
 
 	// Create handler
 	handler := NewProxyHandler(config, logger, m)
@@ -285,3 +302,800 @@ func TestGetClientIP(t *testing.T) {
 		})
 	}
 }
+
+func TestRuleClientIP(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expectedIP string
+	}{
+		{"Untrusted connection with spoofed headers", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.1", "CF-Connecting-IP": "198.51.100.1", "X-Real-IP": "198.51.100.1"}, "203.0.113.7"},
+		{"Trusted proxy with CF-Connecting-IP", "10.1.1.1:1234", map[string]string{"CF-Connecting-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"Trusted proxy with X-Forwarded-For", "10.1.1.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.99, 203.0.113.7, 192.0.2.1"}, "203.0.113.7"},
+		{"Trusted proxies only", "10.1.1.1:1234", map[string]string{"X-Forwarded-For": "10.2.2.2"}, "10.2.2.2"},
+		{"Trusted proxy with X-Real-IP", "192.0.2.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"Trusted proxy without headers", "10.1.1.1:1234", nil, "10.1.1.1"},
+		{"IPv6 RemoteAddr", "[2001:db8::1]:8080", nil, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := ruleClientIP(req, trusted); got != tt.expectedIP {
+				t.Errorf("ruleClientIP() = %v, want %v", got, tt.expectedIP)
+			}
+		})
+	}
+}
+
+// signedRequestPath builds a client request path signed with the config's key and salt.
+func signedRequestPath(t *testing.T, config Config, options string, sourceURL string) string {
+	t.Helper()
+	path := "/" + signing.UrlSafeEncode([]byte(sourceURL))
+	if options != "" {
+		path = "/" + options + path
+	}
+	signature, err := signing.Sign(config.Key, config.Salt, path, config.SignatureSize)
+	if err != nil {
+		t.Fatalf("failed to sign path: %v", err)
+	}
+	return "/" + signature + path
+}
+
+// TestHandleImageProxyCache tests that renditions are served from cache after the first request
+func TestHandleImageProxyCache(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:               "0123456789abcdef0123456789abcdef",
+		Salt:              "0123456789abcdef0123456789abcdef",
+		BaseURL:           backend.URL,
+		Encode:            true,
+		SignatureSize:     32,
+		CacheEnabled:      true,
+		CacheMaxSize:      1024,
+		CacheMaxEntrySize: 1024,
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	path := signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg")
+
+	for i, wantCache := range []string{"MISS", "HIT"} {
+		rr := httptest.NewRecorder()
+		handler.HandleImageProxy(rr, httptest.NewRequest("GET", path, nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, rr.Code, http.StatusOK)
+		}
+		if got := rr.Header().Get("X-Cache"); got != wantCache {
+			t.Errorf("request %d: X-Cache = %q, want %q", i, got, wantCache)
+		}
+		if rr.Body.String() != "image-bytes" {
+			t.Errorf("request %d: unexpected body %q", i, rr.Body.String())
+		}
+	}
+
+	if backendCalls != 1 {
+		t.Errorf("expected 1 backend call, got %d", backendCalls)
+	}
+
+	entries := handler.Cache().Entries(nil)
+	if len(entries) != 1 || entries[0].SourceURL != "https://example.com/cat.jpg" || entries[0].ProxyURL != path {
+		t.Errorf("unexpected cache entries %+v", entries)
+	}
+}
+
+// TestHandleImageProxyCacheOptionOrder tests that repeated requests with several
+// options map to the same cache key
+func TestHandleImageProxyCacheOptionOrder(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:               "0123456789abcdef0123456789abcdef",
+		Salt:              "0123456789abcdef0123456789abcdef",
+		BaseURL:           backend.URL,
+		Encode:            true,
+		SignatureSize:     32,
+		CacheEnabled:      true,
+		CacheMaxSize:      1024,
+		CacheMaxEntrySize: 1024,
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	path := signedRequestPath(t, config, "", "https://example.com/cat.jpg") + "?w=100&h=80&q=75"
+
+	for i := 0; i < 20; i++ {
+		rr := httptest.NewRecorder()
+		handler.HandleImageProxy(rr, httptest.NewRequest("GET", path, nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, rr.Code, http.StatusOK)
+		}
+	}
+
+	if backendCalls != 1 {
+		t.Errorf("expected 1 backend call, got %d", backendCalls)
+	}
+}
+
+// spanAttribute returns the value of the attribute of span with the given key.
+func spanAttribute(span tracetest.SpanStub, key string) attribute.Value {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// TestHandleImageProxyTracing tests that a request is traced with a server span,
+// child spans for each processing step and the trace continued in imgproxy
+func TestHandleImageProxyTracing(t *testing.T) {
+	var backendTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get(tracing.TraceparentHeader)
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       backend.URL,
+		Encode:        true,
+		SignatureSize: 32,
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	handler.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	const clientTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest("GET", signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg"), nil)
+	r.Header.Set(tracing.TraceparentHeader, clientTraceparent)
+	rr := httptest.NewRecorder()
+	handler.HandleImageProxy(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	server, ok := spans["GET default"]
+	if !ok {
+		t.Fatalf("no server span in %+v", exporter.GetSpans())
+	}
+	if server.SpanKind != trace.SpanKindServer || server.Parent.SpanID().String() != "00f067aa0ba902b7" || server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span = %+v, want a child of the client span", server)
+	}
+	if got := spanAttribute(server, "http.response.status_code"); got != attribute.IntValue(http.StatusOK) {
+		t.Errorf("server span status code = %v, want %d", got.Emit(), http.StatusOK)
+	}
+	for _, name := range []string{"verify_signature", "merge_options", "generate_url", "backend_fetch"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != server.SpanContext.SpanID() || span.Status.Code == codes.Error {
+			t.Errorf("%s span = %+v, want a successful child of the server span", name, span)
+		}
+	}
+
+	fetch := spans["backend_fetch"].SpanContext
+	if want := "00-" + fetch.TraceID().String() + "-" + fetch.SpanID().String() + "-01"; backendTraceparent != want {
+		t.Errorf("imgproxy received traceparent %q, want %q", backendTraceparent, want)
+	}
+
+	// A forged signature fails the verification span
+	exporter.Reset()
+	handler.HandleImageProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/forged/w:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", nil))
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "verify_signature" && span.Status.Code != codes.Error {
+			t.Errorf("verify_signature span = %+v, want an error", span)
+		}
+		if span.Name == "backend_fetch" {
+			t.Error("request with an invalid signature was fetched")
+		}
+	}
+}
+
+// TestRequestLogFields tests that the access log line of a request carries its structured fields
+func TestRequestLogFields(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:               "0123456789abcdef0123456789abcdef",
+		Salt:              "0123456789abcdef0123456789abcdef",
+		BaseURL:           backend.URL,
+		Encode:            true,
+		SignatureSize:     32,
+		CacheEnabled:      true,
+		CacheMaxSize:      1024,
+		CacheMaxEntrySize: 1024,
+	}
+	var buf bytes.Buffer
+	handler := NewProxyHandler(config, logging.New(&buf, logging.LevelInfo, logging.FormatJSON), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	r := httptest.NewRequest("GET", signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg"), nil)
+	r.RemoteAddr = "203.0.113.7:4321"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON access log line: %v\n%s", err, buf.String())
+	}
+	expected := map[string]any{
+		"client_ip":    "203.0.113.7",
+		"tenant":       DefaultTenant,
+		"route":        "default",
+		"status":       "OK",
+		"bytes":        float64(len("image-bytes")),
+		"format":       "webp",
+		"cache":        "MISS",
+		"backend_host": strings.TrimPrefix(backend.URL, "http://"),
+	}
+	for key, want := range expected {
+		if entry[key] != want {
+			t.Errorf("field %s = %v, want %v", key, entry[key], want)
+		}
+	}
+	if id, _ := entry["request_id"].(string); id == "" {
+		t.Error("access log line has no request ID")
+	}
+	if _, ok := entry["upstream_latency_ms"].(float64); !ok {
+		t.Error("access log line has no upstream latency")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var backendID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get(RequestIDHeader)
+		w.Header().Set(RequestIDHeader, backendID)
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:               "0123456789abcdef0123456789abcdef",
+		Salt:              "0123456789abcdef0123456789abcdef",
+		BaseURL:           backend.URL,
+		Encode:            true,
+		SignatureSize:     32,
+		CacheEnabled:      true,
+		CacheMaxSize:      1024,
+		CacheMaxEntrySize: 1024,
+	}
+	var logs bytes.Buffer
+	exporter := tracetest.NewInMemoryExporter()
+	handler := NewProxyHandler(config, logging.New(&logs, logging.LevelDebug, logging.FormatText), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	handler.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	path := signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg")
+
+	tests := []struct {
+		name     string
+		path     string
+		incoming string
+		status   int
+		keep     bool // Whether the incoming ID is used
+		fetched  bool // Whether the image is fetched from imgproxy rather than the cache
+	}{
+		{"Incoming ID", path, "req-123", http.StatusOK, true, true},
+		{"Cached response with the ID of the first request", path, "req-456", http.StatusOK, true, false},
+		{"Generated ID", path, "", http.StatusOK, false, false},
+		{"Invalid ID", path, "bad id\r\nforged", http.StatusOK, false, false},
+		{"Too long ID", path, strings.Repeat("a", 129), http.StatusOK, false, false},
+		{"Error response", "/forged/w:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", "req-789", http.StatusForbidden, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			exporter.Reset()
+			backendID = ""
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.incoming != "" {
+				r.Header.Set(RequestIDHeader, tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			id := rr.Header().Get(RequestIDHeader)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rr.Code, tt.status)
+			}
+			if tt.keep && id != tt.incoming {
+				t.Errorf("response request ID = %q, want %q", id, tt.incoming)
+			}
+			if !tt.keep && (len(id) != 32 || id == tt.incoming) {
+				t.Errorf("response request ID = %q, want a generated ID", id)
+			}
+			if rr.Header().Values(RequestIDHeader)[0] != id || len(rr.Header().Values(RequestIDHeader)) != 1 {
+				t.Errorf("response has request IDs %v, want only %q", rr.Header().Values(RequestIDHeader), id)
+			}
+			if tt.status != http.StatusOK && !strings.Contains(rr.Body.String(), id) {
+				t.Errorf("error body %q does not contain the request ID", rr.Body.String())
+			}
+			if tt.fetched && backendID != id {
+				t.Errorf("imgproxy received request ID %q, want %q", backendID, id)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if !strings.Contains(line, "request_id="+id) {
+					t.Errorf("log line without the request ID: %s", line)
+				}
+			}
+			for _, span := range exporter.GetSpans() {
+				if got := spanAttribute(span, "http.request.header.x-request-id"); span.SpanKind == trace.SpanKindServer && got.AsString() != id {
+					t.Errorf("server span request ID = %v, want %q", got.Emit(), id)
+				}
+			}
+		})
+	}
+}
+
+// TestAccessLog tests that requests are written to the access log, with
+// signatures and source URLs masked when redaction is enabled
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:             "0123456789abcdef0123456789abcdef",
+		Salt:            "0123456789abcdef0123456789abcdef",
+		BaseURL:         backend.URL,
+		Encode:          true,
+		SignatureSize:   32,
+		AccessLogRedact: true,
+	}
+	var appLog, accessLog bytes.Buffer
+	access, err := logging.NewAccessLogger(&accessLog, logging.AccessLogOptions{Format: logging.AccessFormatJSON, SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewProxyHandler(config, logging.New(&appLog, logging.LevelInfo, logging.FormatText), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	handler.SetAccessLog(access)
+
+	path := signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg")
+	parts := strings.Split(path, "/")
+	signature, source := parts[1], parts[len(parts)-1]
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/forged/w:100/"+source, nil))
+
+	if strings.Contains(appLog.String(), "[OK]") {
+		t.Errorf("completed requests were logged to the application log: %s", appLog.String())
+	}
+	type line struct {
+		URI    string `json:"uri"`
+		Status int    `json:"status"`
+	}
+	output := accessLog.String()
+	var lines []line
+	decoder := json.NewDecoder(strings.NewReader(output))
+	for decoder.More() {
+		var l line
+		if err := decoder.Decode(&l); err != nil {
+			t.Fatalf("invalid access log line: %v", err)
+		}
+		lines = append(lines, l)
+	}
+	expected := []line{
+		{URI: "/[REDACTED]/w:100/[REDACTED]", Status: http.StatusOK},
+		{URI: "/[REDACTED]/w:100/[REDACTED]", Status: http.StatusForbidden},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("access log lines = %+v, want %+v", lines, expected)
+	}
+	if strings.Contains(output, signature) || strings.Contains(output, source) {
+		t.Error("access log contains the signature or source URL")
+	}
+}
+
+func TestRequestLogLevel(t *testing.T) {
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       "http://imgproxy:8080",
+		Encode:        true,
+		SignatureSize: 32,
+		LogLevel:      logging.LevelInfo,
+	}
+	var buf bytes.Buffer
+	logger := logging.New(&buf, config.LogLevel, logging.FormatText)
+	if err := logger.SetLevelRules([]logging.LevelRule{{Level: logging.LevelDebug, RequestIDPrefix: "debug-"}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewProxyHandler(config, logger, metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	for _, id := range []string{"debug-checkout-1", "checkout-2"} {
+		r := httptest.NewRequest("OPTIONS", "/sig/w:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", nil)
+		r.Header.Set(RequestIDHeader, id)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	output := buf.String()
+	if !strings.Contains(output, "request_id=debug-checkout-1") || strings.Contains(output, "request_id=checkout-2") {
+		t.Errorf("debug messages were not logged for the matching request only:\n%s", output)
+	}
+
+	// Reloading a changed LOG_LEVEL replaces the level set at runtime
+	logger.SetLevel(logging.LevelDebug)
+	if err := handler.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if logger.Level() != logging.LevelDebug {
+		t.Errorf("Reload() with an unchanged LOG_LEVEL set level %s, want %s", logger.Level(), logging.LevelDebug)
+	}
+	config.LogLevel = logging.LevelWarn
+	if err := handler.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if logger.Level() != logging.LevelWarn {
+		t.Errorf("Reload() set level %s, want %s", logger.Level(), logging.LevelWarn)
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		hashSources bool
+		logged      string // Source URL as logged
+	}{
+		{"Decoded sources", false, "https://example.com/cat.jpg?[REDACTED]"},
+		{"Hashed sources", true, "sha256:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/webp")
+				w.Write([]byte("image-bytes"))
+			}))
+			defer backend.Close()
+
+			config := Config{
+				Key:            "0123456789abcdef0123456789abcdef",
+				Salt:           "fedcba9876543210fedcba9876543210",
+				Secret:         "backend-bearer-token",
+				BaseURL:        backend.URL,
+				Encode:         true,
+				SignatureSize:  32,
+				LogHashSources: tt.hashSources,
+			}
+			var buf bytes.Buffer
+			logger := logging.New(&buf, logging.LevelDebug, logging.FormatText)
+			handler := NewProxyHandler(config, logger, metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+			source := "https://example.com/cat.jpg?token=s3cr3t"
+			path := signedRequestPath(t, config, "w:100", source)
+			parts := strings.Split(path, "/")
+			signature, encoded := parts[1], parts[len(parts)-1]
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set("Authorization", "Bearer client-token")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/forged/w:100/"+encoded, nil))
+
+			// Backend errors include the backend URL, which holds the imgproxy signature
+			backend.Close()
+			config.Secret = "rotated-bearer-token"
+			if err := handler.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			logger.Info("Secrets in messages are masked: %s %s", config.Secret, config.Key)
+
+			output := buf.String()
+			for _, leaked := range []string{config.Key, config.Salt, "backend-bearer-token", config.Secret, "client-token", signature, encoded, "s3cr3t"} {
+				if strings.Contains(output, leaked) {
+					t.Errorf("log output contains %q:\n%s", leaked, output)
+				}
+			}
+			if !strings.Contains(output, tt.logged) || (tt.hashSources && strings.Contains(output, "example.com")) {
+				t.Errorf("log output does not contain the source as %q:\n%s", tt.logged, output)
+			}
+		})
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		got      string
+		expected string
+	}{
+		{"WebP", formatLabel("image/webp"), "webp"},
+		{"JPEG with parameters", formatLabel("image/jpeg; charset=binary"), "jpeg"},
+		{"SVG", formatLabel("image/svg+xml"), "svg"},
+		{"Unknown type", formatLabel("text/plain; charset=utf-8"), "other"},
+		{"No type", formatLabel(""), ""},
+		{"Route preset", presetLabel("pr:thumb/w:100"), "thumb"},
+		{"Several presets", presetLabel("pr:thumb:sharp/preset:dark"), "thumb:sharp:dark"},
+		{"No preset", presetLabel("w:100/q:80"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Errorf("got %q, want %q", tt.got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOptionUsage(t *testing.T) {
+	tests := []struct {
+		options  string
+		expected string
+	}{
+		{"", "none"},
+		{"w:100/q:80/f:webp", "resize"},
+		{"rs:fit:300:200", "resize"},
+		{"q:80/f:avif", "quality"},
+		{"f:webp", "format"},
+		{"pr:thumb", "preset"},
+		{"bl:5/f:webp", "other"},
+	}
+
+	for _, tt := range tests {
+		if got := optionUsage(tt.options); got != tt.expected {
+			t.Errorf("optionUsage(%q) = %q, want %q", tt.options, got, tt.expected)
+		}
+	}
+}
+
+// TestImageResponseMetrics tests that served images record their size,
+// format, option usage, backend status class and cache result
+func TestImageResponseMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/avif")
+		w.Write([]byte("avif-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:               "0123456789abcdef0123456789abcdef",
+		Salt:              "0123456789abcdef0123456789abcdef",
+		BaseURL:           backend.URL,
+		Encode:            true,
+		SignatureSize:     32,
+		CacheEnabled:      true,
+		CacheMaxSize:      1024,
+		CacheMaxEntrySize: 1024,
+	}
+	m := metrics.NewMetrics(prometheus.NewRegistry(), "test")
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), m)
+	path := signedRequestPath(t, config, "w:100", "https://example.com/metrics.jpg")
+
+	counters := func() []float64 {
+		return []float64{
+			testutil.ToFloat64(m.OutputFormats.WithLabelValues("avif", DefaultTenant)),
+			testutil.ToFloat64(m.OptionUsage.WithLabelValues("resize", DefaultTenant)),
+			testutil.ToFloat64(m.BackendResponses.WithLabelValues("2xx", DefaultTenant)),
+			testutil.ToFloat64(m.CacheResults.WithLabelValues(metrics.CacheMiss, DefaultTenant)),
+			testutil.ToFloat64(m.CacheResults.WithLabelValues(metrics.CacheHit, DefaultTenant)),
+		}
+	}
+	before := counters()
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	after := counters()
+
+	// Two avif responses with resize options, one backend fetch stored in the cache and one hit
+	expected := []float64{2, 2, 1, 1, 1}
+	for i := range expected {
+		if got := after[i] - before[i]; got != expected[i] {
+			t.Errorf("counter %d increased by %v, want %v", i, got, expected[i])
+		}
+	}
+	if got := testutil.CollectAndCount(m.ResponseSize); got == 0 {
+		t.Error("expected response sizes to be observed")
+	}
+}
+
+// TestClientAbortMetrics tests that requests cancelled by the client are counted as aborts
+func TestClientAbortMetrics(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       backend.URL,
+		Encode:        true,
+		SignatureSize: 32,
+	}
+	m := metrics.NewMetrics(prometheus.NewRegistry(), "test")
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg"), nil).WithContext(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	before := testutil.ToFloat64(m.ClientAborts.WithLabelValues(DefaultTenant))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got := testutil.ToFloat64(m.ClientAborts.WithLabelValues(DefaultTenant)) - before; got != 1 {
+		t.Errorf("client aborts increased by %v, want 1", got)
+	}
+}
+
+// TestMetricsCardinality is a regression test ensuring request metrics are not
+// labelled with the request path, so distinct URLs do not create new series
+func TestMetricsCardinality(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       backend.URL,
+		Encode:        true,
+		SignatureSize: 32,
+	}
+	m := metrics.NewMetrics(prometheus.NewRegistry(), "test")
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), m)
+
+	serve := func(i int) {
+		source := fmt.Sprintf("https://example.com/%d.jpg", i)
+		for _, path := range []string{
+			signedRequestPath(t, config, fmt.Sprintf("w:%d", i), source),
+			"/invalid-signature" + signedRequestPath(t, config, "", source)[1:],
+		} {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+
+	serve(0)
+	series := func() []int {
+		return []int{testutil.CollectAndCount(m.RequestsTotal), testutil.CollectAndCount(m.RequestDuration), testutil.CollectAndCount(m.RequestsInProgress)}
+	}
+	before := series()
+	for i := 1; i <= 500; i++ {
+		serve(i)
+	}
+	if after := series(); !reflect.DeepEqual(after, before) {
+		t.Errorf("series counts grew from %v to %v across distinct URLs", before, after)
+	}
+}
+
+// TestHandleImageProxyMethods tests that only GET, HEAD and OPTIONS are accepted
+func TestHandleImageProxyMethods(t *testing.T) {
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       "http://localhost:8081",
+		Encode:        true,
+		SignatureSize: 32,
+
+		CORSAllowedOrigins: []string{"https://app.example.com"},
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	tests := []struct {
+		name           string
+		method         string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{"POST rejected", "POST", nil, http.StatusMethodNotAllowed},
+		{"PUT rejected", "PUT", nil, http.StatusMethodNotAllowed},
+		{"DELETE rejected", "DELETE", nil, http.StatusMethodNotAllowed},
+		{"Custom method rejected", "PURGE", nil, http.StatusMethodNotAllowed},
+		{"OPTIONS answered", "OPTIONS", nil, http.StatusNoContent},
+		{"Preflight answered", "OPTIONS", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET"}, http.StatusNoContent},
+		{"GET passes method check", "GET", nil, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/invalidpath", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			rr := httptest.NewRecorder()
+			handler.HandleImageProxy(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("got status %d, want %d", rr.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus == http.StatusMethodNotAllowed || tt.expectedStatus == http.StatusNoContent {
+				if allow := rr.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+					t.Errorf("Allow = %q, want %q", allow, "GET, HEAD, OPTIONS")
+				}
+			}
+			if tt.headers != nil && rr.Header().Get("Access-Control-Allow-Methods") == "" {
+				t.Error("expected preflight response to allow methods")
+			}
+		})
+	}
+}
+
+// TestHandleImageProxyVary tests that the backend's Vary values are merged with the CORS Vary
+func TestHandleImageProxyVary(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/webp")
+		w.Header().Set("Vary", "Accept, origin")
+		w.Write([]byte("image-bytes"))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		cacheEnabled bool
+		wantCache    []string
+	}{
+		{"Uncached", false, []string{"", ""}},
+		{"Cached", true, []string{"MISS", "HIT"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Key:               "0123456789abcdef0123456789abcdef",
+				Salt:              "0123456789abcdef0123456789abcdef",
+				BaseURL:           backend.URL,
+				Encode:            true,
+				SignatureSize:     32,
+				CacheEnabled:      tt.cacheEnabled,
+				CacheMaxSize:      1024,
+				CacheMaxEntrySize: 1024,
+
+				CORSAllowedOrigins: []string{"https://app.example.com"},
+			}
+			handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+			path := signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg")
+
+			for i, wantCache := range tt.wantCache {
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Set("Origin", "https://app.example.com")
+				rr := httptest.NewRecorder()
+				handler.HandleImageProxy(rr, req)
+
+				if got := rr.Header().Get("X-Cache"); got != wantCache {
+					t.Errorf("request %d: X-Cache = %q, want %q", i, got, wantCache)
+				}
+				if got := strings.Join(rr.Header().Values("Vary"), ", "); got != "Origin, Accept" {
+					t.Errorf("request %d: Vary = %q, want %q", i, got, "Origin, Accept")
+				}
+				if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+					t.Errorf("request %d: Access-Control-Allow-Origin = %q, want %q", i, got, "https://app.example.com")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// imgixDialect translates imgix rendering API parameters, e.g.
+// /img.jpg?w=300&h=200&fit=crop&crop=faces&auto=format&q=75&dpr=2.
+// Unsupported parameters are ignored.
+type imgixDialect struct{}
+
+// imgixFits maps imgix fit modes to imgproxy options.
+var imgixFits = map[string][]string{
+	"clip":     {"rt:fit"},
+	"max":      {"rt:fit"},
+	"clamp":    {"rt:fit"},
+	"crop":     {"rt:fill"},
+	"min":      {"rt:fill"},
+	"facearea": {"rt:fill", "g:sm"},
+	"fill":     {"rt:fit", "ex:1"},
+	"fillmax":  {"rt:fit", "ex:1"},
+	"scale":    {"rt:force"},
+}
+
+// Name implements Dialect.
+func (imgixDialect) Name() string { return "imgix" }
+
+// Translate implements Dialect.
+func (imgixDialect) Translate(path string, query url.Values) (Translation, error) {
+	translation := Translation{Source: path}
+	if path == "" {
+		return translation, fmt.Errorf("missing image path")
+	}
+
+	for _, dim := range []string{"w", "h"} {
+		if value := query.Get(dim); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return translation, fmt.Errorf("invalid %s parameter %q", dim, value)
+			}
+			translation.Options = append(translation.Options, dim+":"+strconv.Itoa(min(size, maxDialectSize)))
+		}
+	}
+
+	if fit := query.Get("fit"); fit != "" {
+		if opts, ok := imgixFits[fit]; ok {
+			translation.Options = append(translation.Options, opts...)
+		}
+	}
+
+	if crop := query.Get("crop"); crop != "" {
+		switch {
+		case strings.Contains(crop, "faces"), strings.Contains(crop, "entropy"), strings.Contains(crop, "edges"):
+			translation.Options = append(translation.Options, "g:sm")
+		case crop == "focalpoint":
+			x, y := query.Get("fp-x"), query.Get("fp-y")
+			if _, errX := strconv.ParseFloat(x, 64); errX == nil {
+				if _, errY := strconv.ParseFloat(y, 64); errY == nil {
+					translation.Options = append(translation.Options, "g:fp:"+x+":"+y)
+				}
+			}
+		default:
+			if gravity, ok := gravities[crop]; ok {
+				translation.Options = append(translation.Options, "g:"+gravity)
+			}
+		}
+	}
+
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return translation, fmt.Errorf("invalid q parameter %q", q)
+		}
+		translation.Options = append(translation.Options, "q:"+strconv.Itoa(quality))
+	}
+
+	if dpr := query.Get("dpr"); dpr != "" {
+		if value, err := strconv.ParseFloat(dpr, 64); err == nil && value > 0 {
+			translation.Options = append(translation.Options, "dpr:"+strconv.FormatFloat(min(value, maxDialectDPR), 'f', -1, 64))
+		}
+	}
+
+	if format, ok := formatAliases[query.Get("fm")]; ok {
+		translation.Options = append(translation.Options, "f:"+format)
+	} else {
+		for _, auto := range strings.Split(query.Get("auto"), ",") {
+			if strings.TrimSpace(auto) == "format" {
+				translation.AutoFormat = true
+			}
+		}
+	}
+
+	return translation, nil
+}
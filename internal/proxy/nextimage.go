@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parseNextImageRequest parses requests following the Next.js image optimization API contract,
+// so the proxy can be used as the `path` of the default Next.js image loader:
+//
+//	GET /_next/image?url={source}&w={width}&q={quality}
+//
+// where:
+//   - url: A path resolved against the route's source base, or an absolute source URL
+//     when SOURCE_ALLOWED_HOSTS restricts the hosts it may point to
+//   - w: The requested width, which must be one of the configured device or image sizes
+//   - q: Optional quality between 1 and 100 (defaults to NEXT_IMAGE_DEFAULT_QUALITY)
+//
+// The request is unsigned; sources are restricted by the source policy.
+// It returns false if an error response has been written.
+func (h *ProxyHandler) parseNextImageRequest(w http.ResponseWriter, r *http.Request, req *imageRequest) (string, string, bool) {
+	source, options, err := parseNextImageQuery(req.state.config, r.URL.Query(), req.route.SourceBase, req.sources.restrictsHosts())
+	if err != nil {
+		req.logger.Warn("Invalid Next.js image request: %v", err)
+		h.fail(w, req, http.StatusBadRequest, err.Error())
+		return "", "", false
+	}
+
+	// Determine best image format based on Accept header
+	return source, addFormatFromAcceptHeader(options, r.Header.Get("Accept")), true
+}
+
+// parseNextImageQuery validates the url, w and q parameters of a Next.js image
+// request and returns the source URL and imgproxy options. Relative URLs are
+// resolved against baseURL; absolute URLs are rejected unless allowAbsolute is
+// set, so the unsigned endpoint cannot relay arbitrary hosts. Error messages
+// mirror the ones returned by Next.js itself.
+func parseNextImageQuery(config Config, query url.Values, baseURL string, allowAbsolute bool) (string, string, error) {
+	rawURL := query.Get("url")
+	if rawURL == "" {
+		return "", "", fmt.Errorf(`"url" parameter is required`)
+	}
+
+	source := rawURL
+	if strings.HasPrefix(rawURL, "/") {
+		if strings.HasPrefix(rawURL, "//") || baseURL == "" {
+			return "", "", fmt.Errorf(`"url" parameter is not allowed`)
+		}
+		source = strings.TrimSuffix(baseURL, "/") + rawURL
+	} else if u, err := url.Parse(rawURL); err != nil || u.Scheme == "" {
+		return "", "", fmt.Errorf(`"url" parameter is invalid`)
+	} else if !allowAbsolute {
+		return "", "", fmt.Errorf(`"url" parameter is not allowed`)
+	}
+
+	rawWidth := query.Get("w")
+	if rawWidth == "" {
+		return "", "", fmt.Errorf(`"w" parameter (width) is required`)
+	}
+	width, err := strconv.Atoi(rawWidth)
+	if err != nil || width <= 0 {
+		return "", "", fmt.Errorf(`"w" parameter (width) must be an integer greater than 0`)
+	}
+	if !slices.Contains(config.NextImageDeviceSizes, width) && !slices.Contains(config.NextImageSizes, width) {
+		return "", "", fmt.Errorf(`"w" parameter (width) of %d is not allowed`, width)
+	}
+
+	quality := config.NextImageDefaultQuality
+	if rawQuality := query.Get("q"); rawQuality != "" {
+		quality, err = strconv.Atoi(rawQuality)
+		if err != nil || quality < 1 || quality > 100 {
+			return "", "", fmt.Errorf(`"q" parameter (quality) must be an integer between 1 and 100`)
+		}
+	}
+
+	options := "w:" + strconv.Itoa(width)
+	if quality > 0 {
+		options += "/q:" + strconv.Itoa(quality)
+	}
+	return source, options, nil
+}
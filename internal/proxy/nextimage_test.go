@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/pkg/signing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newNextImageConfig(baseURL string) Config {
+	return Config{
+		Key:                     "0123456789abcdef0123456789abcdef",
+		Salt:                    "0123456789abcdef0123456789abcdef",
+		BaseURL:                 baseURL,
+		Encode:                  true,
+		SignatureSize:           32,
+		NextImageEnabled:        true,
+		NextImagePath:           "/_next/image",
+		NextImageBaseURL:        "https://cms.example.com/",
+		NextImageDeviceSizes:    []int{640, 1080},
+		NextImageSizes:          []int{64},
+		NextImageDefaultQuality: 75,
+	}
+}
+
+func TestParseNextImageQuery(t *testing.T) {
+	config := newNextImageConfig("http://localhost:8081")
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedSource  string
+		expectedOptions string
+		allowAbsolute   bool
+		expectErr       bool
+	}{
+		{"Absolute URL", "url=https://example.com/cat.jpg&w=640&q=80", "https://example.com/cat.jpg", "w:640/q:80", true, false},
+		{"Absolute URL without allowed hosts", "url=https://example.com/cat.jpg&w=640", "", "", false, true},
+		{"Relative URL", "url=/uploads/cat.jpg&w=64", "https://cms.example.com/uploads/cat.jpg", "w:64/q:75", false, false},
+		{"Missing url", "w=640", "", "", true, true},
+		{"Protocol-relative url", "url=//evil.com/x.jpg&w=640", "", "", true, true},
+		{"Not a URL", "url=cat.jpg&w=640", "", "", true, true},
+		{"Missing width", "url=https://example.com/cat.jpg", "", "", true, true},
+		{"Width not allowed", "url=https://example.com/cat.jpg&w=641", "", "", true, true},
+		{"Invalid width", "url=https://example.com/cat.jpg&w=abc", "", "", true, true},
+		{"Quality out of range", "url=https://example.com/cat.jpg&w=640&q=101", "", "", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			source, options, err := parseNextImageQuery(config, values, "https://cms.example.com/", tt.allowAbsolute)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseNextImageQuery() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if source != tt.expectedSource || options != tt.expectedOptions {
+				t.Errorf("parseNextImageQuery() = (%q, %q), want (%q, %q)", source, options, tt.expectedSource, tt.expectedOptions)
+			}
+		})
+	}
+}
+
+func TestHandleNextImage(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image"))
+	}))
+	defer backend.Close()
+
+	handler := NewProxyHandler(newNextImageConfig(backend.URL), logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	req := httptest.NewRequest("GET", "/_next/image?url=%2Fuploads%2Fcat.jpg&w=1080&q=60", nil)
+	req.Header.Set("Accept", "image/webp,*/*")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	encoded := signing.UrlSafeEncode([]byte("https://cms.example.com/uploads/cat.jpg"))
+	if !strings.HasSuffix(backendPath, "/w:1080/q:60/f:webp/"+encoded) {
+		t.Errorf("unexpected backend path %q", backendPath)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/_next/image?url=%2Fuploads%2Fcat.jpg&w=123", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for disallowed width, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/_next/image?url=http%3A%2F%2F169.254.169.254%2Flatest&w=1080", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for absolute url without SOURCE_ALLOWED_HOSTS, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
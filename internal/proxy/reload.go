@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+)
+
+// ConfigWatcher reloads the handler configuration on demand (e.g. on SIGHUP)
+// and when the config, routes, tenants or secret files change.
+type ConfigWatcher struct {
+	handler *ProxyHandler
+	logger  *logging.Logger
+	load    func() (Config, error)
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+	err    error // Error of the last reload
+}
+
+// fileStamp identifies a version of a watched file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewConfigWatcher creates a watcher reloading the handler with LoadConfig.
+func NewConfigWatcher(handler *ProxyHandler, logger *logging.Logger) *ConfigWatcher {
+	w := &ConfigWatcher{handler: handler, logger: logger, load: LoadConfig}
+	w.stamps = w.currentStamps(handler.Config())
+	return w
+}
+
+// Reload loads and validates the configuration and swaps it into the handler.
+// On error the current configuration stays in effect.
+func (w *ConfigWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	config, err := w.load()
+	if err == nil {
+		old := w.handler.Config()
+		if err = w.handler.Reload(config); err == nil {
+			for _, name := range restartRequired(old, config) {
+				w.logger.Warn("%s changed; restart the server to apply it", name)
+			}
+		}
+	}
+
+	// Remember the files as seen now, so a broken file is not reloaded again until it changes
+	w.stamps = w.currentStamps(w.handler.Config())
+	w.err = err
+	if err != nil {
+		w.logger.Error("Configuration reload failed, keeping the current configuration: %v", err)
+		return err
+	}
+	w.logger.Info("Configuration reloaded")
+	return nil
+}
+
+// Err returns the error of the last reload, or nil if it succeeded.
+func (w *ConfigWatcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Watch checks the watched files every interval and reloads the configuration
+// when one of them changes, until ctx is cancelled.
+func (w *ConfigWatcher) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.changed() {
+				w.Reload()
+			}
+		}
+	}
+}
+
+// changed reports whether a watched file differs from when it was last loaded.
+func (w *ConfigWatcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	current := w.currentStamps(w.handler.Config())
+	if len(current) != len(w.stamps) {
+		return true
+	}
+	for path, stamp := range current {
+		if w.stamps[path] != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// currentStamps returns the stamps of the files referenced by the configuration.
+func (w *ConfigWatcher) currentStamps(config Config) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, path := range watchedFiles(config) {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// watchedFiles returns the files the configuration and its secrets are loaded from.
+func watchedFiles(config Config) []string {
+	var files []string
+	paths := []string{config.ConfigFile, config.RoutesFile, config.TenantsFile, config.KeyFile, config.SaltFile, config.SecretFile, config.AdminTokenFile, config.AdminPasswordFile}
+	for _, path := range append(paths, config.SecretRefFiles...) {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// restartRequired returns the settings that changed between two configurations
+// but only take effect when the server starts.
+func restartRequired(old Config, updated Config) []string {
+	var names []string
+	check := func(name string, changed bool) {
+		if changed {
+			names = append(names, name)
+		}
+	}
+	check("SERVER_PORT", old.ServerPort != updated.ServerPort)
+	check("SERVER_READ_TIMEOUT", old.ServerReadTimeout != updated.ServerReadTimeout)
+	check("SERVER_READ_HEADER_TIMEOUT", old.ServerReadHeaderTimeout != updated.ServerReadHeaderTimeout)
+	check("SERVER_WRITE_TIMEOUT", old.ServerWriteTimeout != updated.ServerWriteTimeout)
+	check("SERVER_IDLE_TIMEOUT", old.ServerIdleTimeout != updated.ServerIdleTimeout)
+	check("SERVER_MAX_HEADER_BYTES", old.ServerMaxHeaderBytes != updated.ServerMaxHeaderBytes)
+	check("SHUTDOWN_TIMEOUT", old.ShutdownTimeout != updated.ShutdownTimeout)
+	check("SHUTDOWN_DELAY", old.ShutdownDelay != updated.ShutdownDelay)
+	check("HEALTH_CHECK_BACKEND_PATH", old.HealthCheckBackendPath != updated.HealthCheckBackendPath)
+	check("HEALTH_CHECK_TIMEOUT", old.HealthCheckTimeout != updated.HealthCheckTimeout)
+	check("HEALTH_CHECK_CACHE_TTL", old.HealthCheckCacheTTL != updated.HealthCheckCacheTTL)
+	check("OTEL_TRACES_EXPORTER", old.TracesExporter != updated.TracesExporter)
+	check("OTEL_EXPORTER_OTLP_ENDPOINT", old.OTLPTracesURL() != updated.OTLPTracesURL())
+	check("OTEL_EXPORTER_OTLP_HEADERS", old.OTLPHeaders != updated.OTLPHeaders)
+	check("OTEL_SERVICE_NAME", old.ServiceName != updated.ServiceName)
+	check("OTEL_TRACES_SAMPLER_ARG", old.TracesSampleRatio != updated.TracesSampleRatio)
+	check("ADMIN_ADDR", old.AdminAddr != updated.AdminAddr)
+	check("ADMIN_PPROF", old.AdminPprof != updated.AdminPprof)
+	check("METRICS_ENABLED", old.MetricsEnabled != updated.MetricsEnabled)
+	check("METRICS_ENDPOINT", old.MetricsEndpoint != updated.MetricsEndpoint)
+	check("METRICS_NAMESPACE", old.MetricsNamespace != updated.MetricsNamespace)
+	check("METRICS_LABELS", strings.Join(old.MetricsLabels, ",") != strings.Join(updated.MetricsLabels, ","))
+	check("METRICS_LABEL_MAX_VALUES", old.MetricsLabelMaxValues != updated.MetricsLabelMaxValues)
+	check("METRICS_GO_COLLECTOR", old.MetricsGoCollector != updated.MetricsGoCollector)
+	check("METRICS_PROCESS_COLLECTOR", old.MetricsProcessCollector != updated.MetricsProcessCollector)
+	check("LOG_FORMAT", old.LogFormat != updated.LogFormat)
+	check("ACCESS_LOG", old.AccessLog != updated.AccessLog)
+	check("ACCESS_LOG_FORMAT", old.AccessLogFormat != updated.AccessLogFormat)
+	check("ACCESS_LOG_TEMPLATE", old.AccessLogTemplate != updated.AccessLogTemplate)
+	check("ACCESS_LOG_SAMPLE_RATE", old.AccessLogSampleRate != updated.AccessLogSampleRate)
+	check("CACHE_ENABLED", old.CacheEnabled != updated.CacheEnabled)
+	check("CACHE_MAX_SIZE", old.CacheMaxSize != updated.CacheMaxSize)
+	check("CACHE_TTL", old.CacheTTL != updated.CacheTTL)
+	check("CONFIG_WATCH_INTERVAL", old.ConfigWatchInterval != updated.ConfigWatchInterval)
+	return names
+}
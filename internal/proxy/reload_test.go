@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestConfigWatcherReload tests that reloads swap the signing key and keep the old config on errors
+func TestConfigWatcherReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	defer backend.Close()
+
+	oldConfig := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       backend.URL,
+		Encode:        true,
+		SignatureSize: 32,
+	}
+	newConfig := oldConfig
+	newConfig.Key = "fedcba9876543210fedcba9876543210"
+
+	handler := NewProxyHandler(oldConfig, logging.NewLogger(logging.LevelFatal), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	watcher := NewConfigWatcher(handler, logging.NewLogger(logging.LevelFatal))
+
+	status := func(config Config) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg"), nil))
+		return rr.Code
+	}
+
+	watcher.load = func() (Config, error) { return Config{}, errors.New("broken file") }
+	if err := watcher.Reload(); err == nil {
+		t.Error("expected reload of an invalid config to fail")
+	}
+	if got := status(oldConfig); got != http.StatusOK {
+		t.Errorf("got status %d with the old key after a failed reload, want %d", got, http.StatusOK)
+	}
+
+	watcher.load = func() (Config, error) { return newConfig, nil }
+	if err := watcher.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := status(newConfig); got != http.StatusOK {
+		t.Errorf("got status %d with the new key, want %d", got, http.StatusOK)
+	}
+	if got := status(oldConfig); got != http.StatusForbidden {
+		t.Errorf("got status %d with the old key, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestConfigWatcherChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(`{"routes":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewProxyHandler(Config{RoutesFile: path}, logging.NewLogger(logging.LevelFatal), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+	watcher := NewConfigWatcher(handler, logging.NewLogger(logging.LevelFatal))
+	if watcher.changed() {
+		t.Error("expected no change before the file is written")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !watcher.changed() {
+		t.Error("expected a change after the file is modified")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := Config{ServerPort: ":8080", LogLevel: 1, BaseURL: "http://a", AdminToken: "old-token"}
+	updated := Config{ServerPort: ":9090", LogLevel: 1, BaseURL: "http://b", AdminToken: "new-token"}
+
+	if got := restartRequired(old, updated); !reflect.DeepEqual(got, []string{"SERVER_PORT"}) {
+		t.Errorf("restartRequired() = %v, want [SERVER_PORT]", got)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// originScheme is the pseudo-scheme for logical source URLs such as
+// "origin:products/abc.jpg", resolved through NamedOrigins.
+const originScheme = "origin:"
+
+// NamedOrigins maps origin names to base URLs. It decodes from a
+// comma-separated list of name=base-url pairs, e.g.
+// "products=s3://bucket/products/,cms=https://cms.example.com/uploads/".
+type NamedOrigins map[string]string
+
+// EnvDecode implements envconfig.Decoder.
+func (o *NamedOrigins) EnvDecode(value string) error {
+	origins := make(NamedOrigins)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, base, ok := strings.Cut(pair, "=")
+		name, base = strings.TrimSpace(name), strings.TrimSpace(base)
+		if !ok || name == "" || base == "" {
+			return fmt.Errorf("invalid origin %q, expected name=base-url", pair)
+		}
+		origins[name] = base
+	}
+	*o = origins
+	return nil
+}
+
+// String formats the origins in the form accepted by EnvDecode.
+func (o NamedOrigins) String() string {
+	pairs := make([]string, 0, len(o))
+	for name, base := range o {
+		pairs = append(pairs, name+"="+base)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// RewriteRule rewrites source URLs matching a prefix or a regular expression.
+type RewriteRule struct {
+	Prefix      string         // Prefix replaced by Replacement (unused for regex rules)
+	Pattern     *regexp.Regexp // Pattern whose matches are replaced by Replacement, with $1-style expansion
+	Replacement string
+}
+
+// Apply returns the rewritten URL and whether the rule matched.
+func (r RewriteRule) Apply(source string) (string, bool) {
+	if r.Pattern != nil {
+		if !r.Pattern.MatchString(source) {
+			return source, false
+		}
+		return r.Pattern.ReplaceAllString(source, r.Replacement), true
+	}
+	if rest, ok := strings.CutPrefix(source, r.Prefix); ok {
+		return r.Replacement + rest, true
+	}
+	return source, false
+}
+
+// RewriteRules is an ordered list of rewrite rules. It decodes from a
+// semicolon-separated list of "from => to" rules, where from is a URL prefix
+// or, when prefixed with "regex:", a regular expression, e.g.
+// "https://cms.example.com/uploads/ => s3://bucket/uploads/; regex:^https://(\w+)\.example\.com/ => s3://$1/".
+type RewriteRules []RewriteRule
+
+// EnvDecode implements envconfig.Decoder.
+func (rules *RewriteRules) EnvDecode(value string) error {
+	var decoded RewriteRules
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(spec, "=>")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" {
+			return fmt.Errorf("invalid rewrite rule %q, expected from => to", spec)
+		}
+
+		rule := RewriteRule{Prefix: from, Replacement: to}
+		if expr, isRegex := strings.CutPrefix(from, "regex:"); isRegex {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("invalid rewrite rule %q: %w", spec, err)
+			}
+			rule = RewriteRule{Pattern: pattern, Replacement: to}
+		}
+		decoded = append(decoded, rule)
+	}
+	*rules = decoded
+	return nil
+}
+
+// String formats the rules in the form accepted by EnvDecode.
+func (rules RewriteRules) String() string {
+	specs := make([]string, len(rules))
+	for i, rule := range rules {
+		from := rule.Prefix
+		if rule.Pattern != nil {
+			from = "regex:" + rule.Pattern.String()
+		}
+		specs[i] = from + " => " + rule.Replacement
+	}
+	return strings.Join(specs, "; ")
+}
+
+// SourceRewriter maps the source URLs clients sign to the URLs imgproxy fetches.
+type SourceRewriter struct {
+	origins NamedOrigins
+	rules   RewriteRules
+}
+
+// NewSourceRewriter builds a source rewriter from the configuration.
+func NewSourceRewriter(config Config) *SourceRewriter {
+	return &SourceRewriter{
+		origins: config.SourceOrigins,
+		rules:   config.SourceRewriteRules,
+	}
+}
+
+// Rewrite resolves "origin:name/path" sources against the named origins, then
+// applies the first matching rewrite rule. Sources matching nothing are returned unchanged.
+func (s *SourceRewriter) Rewrite(source string) (string, error) {
+	if logical, ok := strings.CutPrefix(source, originScheme); ok {
+		name, path, _ := strings.Cut(logical, "/")
+		base, ok := s.origins[name]
+		if !ok {
+			return "", fmt.Errorf("unknown source origin %q", name)
+		}
+		source = strings.TrimSuffix(base, "/") + "/" + path
+	}
+
+	for _, rule := range s.rules {
+		if rewritten, ok := rule.Apply(source); ok {
+			return rewritten, nil
+		}
+	}
+	return source, nil
+}
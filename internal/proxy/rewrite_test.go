@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/pkg/signing"
+
+	"github.com/sethvargo/go-envconfig"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSourceRewriterRewrite(t *testing.T) {
+	var origins NamedOrigins
+	if err := origins.EnvDecode("products=s3://bucket/products/, cms=https://cms.example.com/uploads"); err != nil {
+		t.Fatalf("NamedOrigins.EnvDecode() error = %v", err)
+	}
+	var rules RewriteRules
+	if err := rules.EnvDecode(`https://cms.example.com/uploads/ => s3://bucket/uploads/; regex:^https://(\w+)\.media\.example\.com/(.*)$ => gs://$1/$2`); err != nil {
+		t.Fatalf("RewriteRules.EnvDecode() error = %v", err)
+	}
+	rewriter := NewSourceRewriter(Config{SourceOrigins: origins, SourceRewriteRules: rules})
+
+	tests := []struct {
+		name      string
+		source    string
+		expected  string
+		expectErr bool
+	}{
+		{"Prefix rule", "https://cms.example.com/uploads/2024/cat.jpg", "s3://bucket/uploads/2024/cat.jpg", false},
+		{"Regex rule", "https://blog.media.example.com/a/b.png", "gs://blog/a/b.png", false},
+		{"Named origin", "origin:products/abc.jpg", "s3://bucket/products/abc.jpg", false},
+		{"Named origin then rule", "origin:cms/cat.jpg", "s3://bucket/uploads/cat.jpg", false},
+		{"No match", "https://other.example.com/cat.jpg", "https://other.example.com/cat.jpg", false},
+		{"Unknown origin", "origin:missing/cat.jpg", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriter.Rewrite(tt.source)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Rewrite(%q) error = %v, expectErr %v", tt.source, err, tt.expectErr)
+			}
+			if got != tt.expected {
+				t.Errorf("Rewrite(%q) = %q, want %q", tt.source, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRewriteDecodeErrors(t *testing.T) {
+	var rules RewriteRules
+	for _, value := range []string{"no-arrow", "regex:[ => x", " => x"} {
+		if err := rules.EnvDecode(value); err == nil {
+			t.Errorf("RewriteRules.EnvDecode(%q) expected error", value)
+		}
+	}
+
+	var origins NamedOrigins
+	for _, value := range []string{"products", "=s3://bucket", "name="} {
+		if err := origins.EnvDecode(value); err == nil {
+			t.Errorf("NamedOrigins.EnvDecode(%q) expected error", value)
+		}
+	}
+}
+
+func TestRewriteFromEnvironment(t *testing.T) {
+	os.Setenv("TEST_SOURCE_ORIGINS", "products=s3://bucket/products/")
+	os.Setenv("TEST_SOURCE_REWRITE_RULES", "https://cms.example.com/ => s3://bucket/")
+	defer os.Unsetenv("TEST_SOURCE_ORIGINS")
+	defer os.Unsetenv("TEST_SOURCE_REWRITE_RULES")
+
+	var config struct {
+		SourceOrigins      NamedOrigins `env:"TEST_SOURCE_ORIGINS"`
+		SourceRewriteRules RewriteRules `env:"TEST_SOURCE_REWRITE_RULES"`
+	}
+	if err := envconfig.Process(context.Background(), &config); err != nil {
+		t.Fatalf("envconfig.Process() error = %v", err)
+	}
+	if config.SourceOrigins["products"] != "s3://bucket/products/" || len(config.SourceRewriteRules) != 1 {
+		t.Errorf("unexpected decoded config %+v", config)
+	}
+}
+
+// TestHandleImageProxyRewrite tests that imgproxy receives the rewritten source URL
+func TestHandleImageProxyRewrite(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+		w.Write([]byte("image"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:                  "0123456789abcdef0123456789abcdef",
+		Salt:                 "0123456789abcdef0123456789abcdef",
+		BaseURL:              backend.URL,
+		Encode:               true,
+		SignatureSize:        32,
+		SourceAllowedSchemes: []string{"s3"},
+		SourceOrigins:        NamedOrigins{"products": "s3://bucket/products/"},
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	rr := httptest.NewRecorder()
+	handler.HandleImageProxy(rr, httptest.NewRequest("GET", signedRequestPath(t, config, "", "origin:products/abc.jpg"), nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	encoded := signing.UrlSafeEncode([]byte("s3://bucket/products/abc.jpg"))
+	if !strings.HasSuffix(backendPath, "/"+encoded) {
+		t.Errorf("backend path %q does not end with the rewritten source", backendPath)
+	}
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route types. Any registered dialect name is also a valid route type.
+const (
+	RouteTypeSigned = "signed" // Signed proxy URLs: /{signature}/{options}/{encoded-uri}
+	RouteTypeNextJS = "nextjs" // Next.js image optimization API: ?url=...&w=...&q=...
+)
+
+// Duration is a time.Duration that unmarshals from JSON strings such as "10m".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Backend holds imgproxy backend and signing settings that override the
+// global configuration when set.
+type Backend struct {
+	BaseURL       string `json:"base_url"`       // BaseURL of the imgproxy backend
+	Key           string `json:"key"`            // Key is the hex-encoded signing key
+	Salt          string `json:"salt"`           // Salt is the hex-encoded signing salt
+	Secret        string `json:"secret"`         // Secret is the Bearer token sent to the backend
+	SignatureSize int    `json:"signature_size"` // SignatureSize of client and backend signatures
+}
+
+// validate checks that the signing key and salt are hex-encoded.
+func (b Backend) validate() error {
+	if _, err := hex.DecodeString(b.Key); err != nil {
+		return fmt.Errorf("key is not valid hex: %w", err)
+	}
+	if _, err := hex.DecodeString(b.Salt); err != nil {
+		return fmt.Errorf("salt is not valid hex: %w", err)
+	}
+	return nil
+}
+
+// apply returns the configuration with the backend settings that are set.
+func (b Backend) apply(config Config) Config {
+	if b.BaseURL != "" {
+		config.BaseURL = b.BaseURL
+	}
+	if b.Key != "" {
+		config.Key = b.Key
+	}
+	if b.Salt != "" {
+		config.Salt = b.Salt
+	}
+	if b.Secret != "" {
+		config.Secret = b.Secret
+	}
+	if b.SignatureSize > 0 {
+		config.SignatureSize = b.SignatureSize
+	}
+	return config
+}
+
+// redacted returns a copy with the key, salt and secret masked.
+func (b Backend) redacted() Backend {
+	b.Key, b.Salt, b.Secret = redact(b.Key), redact(b.Salt), redact(b.Secret)
+	return b
+}
+
+// Route maps requests for a host and/or path prefix to their own settings.
+// Empty settings fall back to the global configuration.
+type Route struct {
+	Name       string `json:"name"`        // Name identifies the route in logs
+	Host       string `json:"host"`        // Host restricts the route to a Host header (any host when empty)
+	PathPrefix string `json:"path_prefix"` // PathPrefix is stripped from the path before it is parsed (defaults to "/")
+	Type       string `json:"type"`        // Type is "signed" (default), "nextjs" or a dialect name such as "imgix"
+	SourceBase string `json:"source_base"` // SourceBase resolves dialect paths and relative Next.js URLs
+
+	Backend
+
+	AllowedOptions []string `json:"allowed_options"` // AllowedOptions lists option names passed to imgproxy (all when empty)
+	Presets        []string `json:"presets"`         // Presets are imgproxy presets applied to every request
+	CacheTTL       Duration `json:"cache_ttl"`       // CacheTTL overrides CACHE_TTL for renditions of this route
+	AuthTokens     []string `json:"auth_tokens"`     // AuthTokens, if set, are required as a Bearer token from clients
+}
+
+// routesFile is the JSON document read from ROUTES_FILE.
+type routesFile struct {
+	Routes []Route `json:"routes"`
+}
+
+// LoadRoutesFile reads and validates a JSON route table.
+func LoadRoutesFile(path string) ([]Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading routes file: %w", err)
+	}
+
+	var file routesFile
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("error parsing routes file %s: %w", path, err)
+	}
+
+	for i := range file.Routes {
+		if err := file.Routes[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid route %d in %s: %w", i, path, err)
+		}
+	}
+	return file.Routes, nil
+}
+
+// validate normalises the route and checks its settings.
+func (rt *Route) validate() error {
+	if rt.PathPrefix == "" {
+		rt.PathPrefix = "/"
+	}
+	if !strings.HasPrefix(rt.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix %q must start with /", rt.PathPrefix)
+	}
+	if rt.Type == "" {
+		rt.Type = RouteTypeSigned
+	}
+	if _, isDialect := LookupDialect(rt.Type); !isDialect && rt.Type != RouteTypeSigned && rt.Type != RouteTypeNextJS {
+		return fmt.Errorf("unknown type %q", rt.Type)
+	}
+	if _, isDialect := LookupDialect(rt.Type); isDialect && rt.SourceBase == "" {
+		return fmt.Errorf("source_base is required for %s routes", rt.Type)
+	}
+	if err := rt.Backend.validate(); err != nil {
+		return err
+	}
+	if rt.Name == "" {
+		rt.Name = strings.TrimSuffix(rt.Host+rt.PathPrefix, "/")
+	}
+	rt.Host = strings.ToLower(rt.Host)
+	return nil
+}
+
+// authorize reports whether the request carries one of the route's tokens.
+// Routes without tokens are public.
+func (rt *Route) authorize(r *http.Request) bool {
+	if len(rt.AuthTokens) == 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, allowed := range rt.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// relativePath strips the route prefix from a request path, keeping a leading slash.
+func (rt *Route) relativePath(path string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, rt.PathPrefix), "/")
+}
+
+// applyOptions drops options the route does not allow and prepends its presets.
+func (rt *Route) applyOptions(options string) string {
+	var final []string
+	if len(rt.Presets) > 0 {
+		final = append(final, "pr:"+strings.Join(rt.Presets, ":"))
+	}
+	for _, option := range strings.Split(options, "/") {
+		if option == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(option, ":")
+		if len(rt.AllowedOptions) == 0 || containsString(rt.AllowedOptions, name) {
+			final = append(final, option)
+		}
+	}
+	return strings.Join(final, "/")
+}
+
+// RouteTable matches requests to routes by host and path prefix.
+type RouteTable struct {
+	routes   []*Route
+	fallback *Route
+}
+
+// NewRouteTable builds the route table from the routes file, dialect routes
+// and the Next.js endpoint. Requests matching no route use the signed proxy
+// URL format with the global configuration.
+func NewRouteTable(config Config) *RouteTable {
+	table := &RouteTable{
+		fallback: &Route{Name: "default", PathPrefix: "/", Type: RouteTypeSigned},
+	}
+	for i := range config.Routes {
+		route := config.Routes[i]
+		table.routes = append(table.routes, &route)
+	}
+	for _, dialectRoute := range config.DialectRoutes {
+		table.routes = append(table.routes, &Route{
+			Name:       dialectRoute.Dialect,
+			PathPrefix: dialectRoute.Prefix,
+			Type:       dialectRoute.Dialect,
+			SourceBase: dialectRoute.SourceBase,
+		})
+	}
+	if config.NextImageEnabled {
+		table.routes = append(table.routes, &Route{
+			Name:       RouteTypeNextJS,
+			PathPrefix: config.NextImagePath,
+			Type:       RouteTypeNextJS,
+			SourceBase: config.NextImageBaseURL,
+		})
+	}
+
+	// Host-specific routes first, then the longest prefixes, so the most specific route wins
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		a, b := table.routes[i], table.routes[j]
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+	return table
+}
+
+// Routes returns the configured routes in matching order, followed by the default route.
+func (t *RouteTable) Routes() []*Route {
+	return append(append([]*Route(nil), t.routes...), t.fallback)
+}
+
+// Match returns the route for a request host and path.
+func (t *RouteTable) Match(host string, path string) *Route {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, route := range t.routes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if hasPathPrefix(path, route.PathPrefix) {
+			return route
+		}
+	}
+	return t.fallback
+}
+
+// hasPathPrefix reports whether path starts with prefix at a segment boundary,
+// so the prefix "/img" matches "/img" and "/img/x" but not "/imgx".
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Default returns the route used when no other route matches.
+func (t *RouteTable) Default() *Route {
+	return t.fallback
+}
+
+// containsString reports whether values contains s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/pkg/signing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadRoutesFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		expectErr bool
+	}{
+		{"Valid routes", `{"routes":[{"host":"img.shop.com","key":"abcd","salt":"ef01","cache_ttl":"10m"},{"path_prefix":"/cms/","type":"imgix","source_base":"https://cms.example.com/"}]}`, false},
+		{"Unknown field", `{"routes":[{"prefix":"/cms/"}]}`, true},
+		{"Unknown type", `{"routes":[{"path_prefix":"/x/","type":"thumbor"}]}`, true},
+		{"Dialect without source base", `{"routes":[{"path_prefix":"/x/","type":"imgix"}]}`, true},
+		{"Relative prefix", `{"routes":[{"path_prefix":"x/"}]}`, true},
+		{"Invalid key", `{"routes":[{"key":"not-hex"}]}`, true},
+		{"Invalid duration", `{"routes":[{"cache_ttl":"soon"}]}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadRoutesFile(path)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("LoadRoutesFile() error = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(path, []byte(tests[0].content), 0o600)
+	routes, _ := LoadRoutesFile(path)
+	if routes[0].PathPrefix != "/" || routes[0].Type != RouteTypeSigned || routes[0].Name != "img.shop.com" {
+		t.Errorf("expected defaults to be applied, got %+v", routes[0])
+	}
+	if time.Duration(routes[0].CacheTTL) != 10*time.Minute {
+		t.Errorf("CacheTTL = %v, want 10m", time.Duration(routes[0].CacheTTL))
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	config := Config{
+		Routes: []Route{
+			{Name: "shop", Host: "img.shop.com", PathPrefix: "/", Type: RouteTypeSigned},
+			{Name: "cms", PathPrefix: "/cms/", Type: RouteTypeSigned},
+			{Name: "cms-thumbs", PathPrefix: "/cms/thumbs/", Type: RouteTypeSigned},
+			{Name: "img", PathPrefix: "/img", Type: RouteTypeSigned},
+		},
+		NextImageEnabled: true,
+		NextImagePath:    "/_next/image",
+	}
+	table := NewRouteTable(config)
+
+	tests := []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"img.shop.com:8080", "/cms/x", "shop"},
+		{"IMG.SHOP.COM", "/sig/x", "shop"},
+		{"other.com", "/cms/thumbs/x", "cms-thumbs"},
+		{"other.com", "/cms/x", "cms"},
+		{"other.com", "/_next/image", "nextjs"},
+		{"other.com", "/sig/x", "default"},
+		{"other.com", "/img", "img"},
+		{"other.com", "/img/sig/x", "img"},
+		{"other.com", "/imgx/sig/x", "default"},
+	}
+
+	for _, tt := range tests {
+		if got := table.Match(tt.host, tt.path).Name; got != tt.expected {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.host, tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestRouteApplyOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    Route
+		options  string
+		expected string
+	}{
+		{"No restrictions", Route{}, "w:100/h:50", "w:100/h:50"},
+		{"Allowed options", Route{AllowedOptions: []string{"w", "f"}}, "w:100/bl:10/f:webp", "w:100/f:webp"},
+		{"Presets", Route{Presets: []string{"thumb", "sharp"}}, "w:100", "pr:thumb:sharp/w:100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.route.applyOptions(tt.options); got != tt.expected {
+				t.Errorf("applyOptions() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+// TestServeHTTPRoutes tests that routes apply their own signing keys, backend and auth
+func TestServeHTTPRoutes(t *testing.T) {
+	var backendPath, backendAuth string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+		backendAuth = r.Header.Get("Authorization")
+		w.Write([]byte("image"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       "http://localhost:1",
+		Encode:        true,
+		SignatureSize: 32,
+		Routes: []Route{{
+			Name:       "partner",
+			PathPrefix: "/partner/",
+			Type:       RouteTypeSigned,
+			Backend: Backend{
+				BaseURL: backend.URL,
+				Key:     "fedcba9876543210",
+				Salt:    "0011223344556677",
+				Secret:  "backend-secret",
+			},
+			Presets:    []string{"partner"},
+			AuthTokens: []string{"client-token"},
+		}},
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	routeConfig := config.Routes[0].Backend.apply(config)
+	path := "/partner" + signedRequestPath(t, routeConfig, "w:100", "https://example.com/cat.jpg")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("got status %d without token, want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	encoded := signing.UrlSafeEncode([]byte("https://example.com/cat.jpg"))
+	if !strings.HasSuffix(backendPath, "/pr:partner/w:100/"+encoded) {
+		t.Errorf("unexpected backend path %q", backendPath)
+	}
+	if backendAuth != "Bearer backend-secret" {
+		t.Errorf("backend Authorization = %q, want the route secret", backendAuth)
+	}
+
+	// Signatures made with the global key are not valid on the route
+	req = httptest.NewRequest("GET", "/partner"+signedRequestPath(t, config, "w:100", "https://example.com/cat.jpg"), nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d for global signature, want %d", rr.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretRefPrefix marks setting values that reference a secret provider,
+// e.g. "secret:file:/run/secrets/imgproxy_key".
+const secretRefPrefix = "secret:"
+
+// secretTimeout bounds the time spent resolving the secrets of a configuration.
+const secretTimeout = 10 * time.Second
+
+// SecretProvider resolves references to secrets held outside the configuration,
+// such as mounted files or a secrets manager.
+type SecretProvider interface {
+	// Name is the provider name used in references, e.g. "file" in "secret:file:/path".
+	Name() string
+	// Resolve returns the secret identified by ref.
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = make(map[string]SecretProvider)
+)
+
+// RegisterSecretProvider makes a secret provider available to "secret:name:ref"
+// references, replacing any provider with the same name.
+func RegisterSecretProvider(p SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[p.Name()] = p
+}
+
+// LookupSecretProvider returns the secret provider registered under name.
+func LookupSecretProvider(name string) (SecretProvider, bool) {
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+	p, ok := secretProviders[name]
+	return p, ok
+}
+
+func init() {
+	RegisterSecretProvider(fileSecretProvider{})
+	RegisterSecretProvider(envSecretProvider{})
+}
+
+// fileSecretProvider reads secrets from files, such as Docker or Kubernetes secret mounts.
+type fileSecretProvider struct{}
+
+// Name implements SecretProvider.
+func (fileSecretProvider) Name() string { return "file" }
+
+// Resolve implements SecretProvider. Trailing newlines are removed.
+func (fileSecretProvider) Resolve(_ context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// envSecretProvider reads secrets from other environment variables.
+type envSecretProvider struct{}
+
+// Name implements SecretProvider.
+func (envSecretProvider) Name() string { return "env" }
+
+// Resolve implements SecretProvider.
+func (envSecretProvider) Resolve(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// secretSetting is a secret setting that may also be read from a file.
+type secretSetting struct {
+	name  string  // Environment variable name of the setting
+	value *string // Value, possibly a "secret:" reference
+	file  string  // Path set in the _FILE variant of the setting
+}
+
+// secretSettings returns the secret settings of the configuration.
+func (c *Config) secretSettings() []secretSetting {
+	return []secretSetting{
+		{"IMGPROXY_KEY", &c.Key, c.KeyFile},
+		{"IMGPROXY_SALT", &c.Salt, c.SaltFile},
+		{"IMGPROXY_SECRET", &c.Secret, c.SecretFile},
+		{"ADMIN_TOKEN", &c.AdminToken, c.AdminTokenFile},
+		{"ADMIN_PASSWORD", &c.AdminPassword, c.AdminPasswordFile},
+	}
+}
+
+// resolveSecrets replaces secret settings with the contents of their _FILE
+// variants and resolves "secret:provider:ref" references.
+func resolveSecrets(config *Config) ValidationError {
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+
+	var errs ValidationError
+	for _, setting := range config.secretSettings() {
+		provider, ref := "", ""
+		switch {
+		case setting.file != "" && *setting.value != "":
+			errs.add(setting.name, "must not be set together with %s_FILE", setting.name)
+			continue
+		case setting.file != "":
+			provider, ref = "file", setting.file
+		case strings.HasPrefix(*setting.value, secretRefPrefix):
+			var ok bool
+			provider, ref, ok = strings.Cut(strings.TrimPrefix(*setting.value, secretRefPrefix), ":")
+			if !ok {
+				errs.add(setting.name, "secret reference must have the form secret:provider:ref")
+				continue
+			}
+		default:
+			continue
+		}
+
+		p, ok := LookupSecretProvider(provider)
+		if !ok {
+			errs.add(setting.name, "unknown secret provider %q", provider)
+			continue
+		}
+		secret, err := p.Resolve(ctx, ref)
+		if err != nil {
+			errs.add(setting.name, "error reading secret from %s provider: %v", provider, err)
+			continue
+		}
+		*setting.value = secret
+		if provider == "file" && setting.file == "" {
+			config.SecretRefFiles = append(config.SecretRefFiles, ref)
+		}
+	}
+	return errs
+}
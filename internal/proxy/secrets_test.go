@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// staticSecretProvider resolves references from a map.
+type staticSecretProvider map[string]string
+
+func (p staticSecretProvider) Name() string { return "static" }
+
+func (p staticSecretProvider) Resolve(_ context.Context, ref string) (string, error) {
+	if secret, ok := p[ref]; ok {
+		return secret, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	RegisterSecretProvider(staticSecretProvider{"imgproxy/salt": "fedcba9876543210"})
+	t.Setenv("TEST_IMGPROXY_SECRET", "backend-token")
+
+	tests := []struct {
+		name     string
+		config   Config
+		expected Config
+		errors   int
+	}{
+		{
+			name:     "Plain values",
+			config:   Config{Key: "aa", Salt: "bb"},
+			expected: Config{Key: "aa", Salt: "bb"},
+		},
+		{
+			name:     "Files and providers",
+			config:   Config{KeyFile: keyFile, Salt: "secret:static:imgproxy/salt", Secret: "secret:env:TEST_IMGPROXY_SECRET"},
+			expected: Config{KeyFile: keyFile, Key: "0123456789abcdef", Salt: "fedcba9876543210", Secret: "backend-token"},
+		},
+		{
+			name:   "Value and file",
+			config: Config{Key: "aa", KeyFile: keyFile},
+			errors: 1,
+		},
+		{
+			name:   "Missing file and unknown provider",
+			config: Config{KeyFile: filepath.Join(dir, "missing"), Salt: "secret:vault:kv/salt", Secret: "secret:static"},
+			errors: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			errs := resolveSecrets(&config)
+			if len(errs) != tt.errors {
+				t.Fatalf("resolveSecrets() errors = %v, want %d", errs, tt.errors)
+			}
+			if tt.errors == 0 && (config.Key != tt.expected.Key || config.Salt != tt.expected.Salt || config.Secret != tt.expected.Secret) {
+				t.Errorf("resolveSecrets() = %+v, want %+v", config, tt.expected)
+			}
+		})
+	}
+}
+
+// TestLoadConfigSecretFiles tests that secret files are re-read on every load and watched
+func TestLoadConfigSecretFiles(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saltFile := filepath.Join(t.TempDir(), "salt")
+	if err := os.WriteFile(saltFile, []byte("fedcba9876543210"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("IMGPROXY_KEY_FILE", keyFile)
+	t.Setenv("IMGPROXY_SALT", "secret:file:"+saltFile)
+	t.Setenv("IMGPROXY_BASE_URL", "http://imgproxy:8080")
+
+	config, err := LoadConfig()
+	if err != nil || config.Key != "0123456789abcdef" {
+		t.Fatalf("LoadConfig() = %q, %v", config.Key, err)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("aabbccddeeff0011"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err = LoadConfig()
+	if err != nil || config.Key != "aabbccddeeff0011" {
+		t.Errorf("LoadConfig() after rotation = %q, %v", config.Key, err)
+	}
+	if files := watchedFiles(config); !reflect.DeepEqual(files, []string{keyFile, saltFile}) {
+		t.Errorf("watchedFiles() = %v, want the key and salt files", files)
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Source rejection reasons, used as metric labels.
+const (
+	SourceRejectInvalidURL   = "invalid_url"
+	SourceRejectScheme       = "scheme"
+	SourceRejectHost         = "host"
+	SourceRejectDeniedIP     = "denied_ip"
+	SourceRejectUnresolvable = "unresolvable"
+)
+
+// SourceError is returned when a source URL is not allowed by the SourcePolicy.
+type SourceError struct {
+	Reason string // Reason is one of the SourceReject* constants
+	Detail string // Detail describes the offending part of the URL
+}
+
+// Error implements the error interface.
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("source URL rejected (%s): %s", e.Reason, e.Detail)
+}
+
+// ipResolver resolves host names to IP addresses. It is satisfied by *net.Resolver.
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// SourcePolicy restricts which source URLs the proxy forwards to imgproxy,
+// protecting internal services from server-side request forgery.
+type SourcePolicy struct {
+	schemes  map[string]bool // Allowed schemes; empty allows any scheme
+	hosts    []string        // Allowed hosts or "*.domain" patterns; empty allows any host
+	denyNets []*net.IPNet    // Networks that http(s) hosts must not resolve to
+	resolver ipResolver
+}
+
+// NewSourcePolicy builds a source policy from the configuration.
+// Invalid CIDRs are reported in the returned error and skipped.
+func NewSourcePolicy(config Config) (*SourcePolicy, error) {
+	policy := &SourcePolicy{
+		schemes:  make(map[string]bool),
+		resolver: net.DefaultResolver,
+	}
+	for _, scheme := range config.SourceAllowedSchemes {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			policy.schemes[scheme] = true
+		}
+	}
+	for _, host := range config.SourceAllowedHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			policy.hosts = append(policy.hosts, host)
+		}
+	}
+
+	var invalid []string
+	for _, cidr := range config.SourceDenyCIDRs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			invalid = append(invalid, cidr)
+			continue
+		}
+		policy.denyNets = append(policy.denyNets, network)
+	}
+	if len(invalid) > 0 {
+		return policy, fmt.Errorf("invalid SOURCE_DENY_CIDRS entries: %s", strings.Join(invalid, ", "))
+	}
+	return policy, nil
+}
+
+// Check returns a *SourceError if the source URL may not be fetched by imgproxy.
+// Hosts of http(s) URLs are resolved and rejected if any address falls in a denied network.
+func (p *SourcePolicy) Check(ctx context.Context, sourceURL string) error {
+	u, err := url.Parse(sourceURL)
+	if err != nil || u.Scheme == "" {
+		return &SourceError{Reason: SourceRejectInvalidURL, Detail: "malformed source URL"}
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if len(p.schemes) > 0 && !p.schemes[scheme] {
+		return &SourceError{Reason: SourceRejectScheme, Detail: scheme}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if len(p.hosts) > 0 && scheme != "local" && !p.allowsHost(host) {
+		return &SourceError{Reason: SourceRejectHost, Detail: host}
+	}
+
+	if (scheme == "http" || scheme == "https") && len(p.denyNets) > 0 {
+		return p.checkAddresses(ctx, host)
+	}
+	return nil
+}
+
+// restrictsHosts reports whether the policy only allows listed hosts.
+func (p *SourcePolicy) restrictsHosts() bool {
+	return len(p.hosts) > 0
+}
+
+// allowsHost reports whether host matches an allowed host or wildcard pattern.
+func (p *SourcePolicy) allowsHost(host string) bool {
+	for _, allowed := range p.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddresses resolves host and rejects it if any of its addresses is denied.
+// imgproxy resolves the host again and follows redirects, so this is defense in
+// depth; imgproxy must still refuse loopback, link-local and private addresses.
+func (p *SourcePolicy) checkAddresses(ctx context.Context, host string) error {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := p.resolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return &SourceError{Reason: SourceRejectUnresolvable, Detail: host}
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		for _, network := range p.denyNets {
+			if network.Contains(ip) {
+				return &SourceError{Reason: SourceRejectDeniedIP, Detail: fmt.Sprintf("%s resolves to %s", host, ip)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeResolver resolves host names from a fixed table.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := f[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestSourcePolicyCheck(t *testing.T) {
+	policy, err := NewSourcePolicy(Config{
+		SourceAllowedSchemes: []string{"https", "s3", "local"},
+		SourceAllowedHosts:   []string{"images.example.com", "*.cdn.example.com", "my-bucket"},
+		SourceDenyCIDRs:      []string{"169.254.0.0/16", "10.0.0.0/8", "::1/128"},
+	})
+	if err != nil {
+		t.Fatalf("NewSourcePolicy() error = %v", err)
+	}
+	policy.resolver = fakeResolver{
+		"images.example.com":   {"93.184.216.34"},
+		"a.cdn.example.com":    {"93.184.216.35"},
+		"evil.cdn.example.com": {"93.184.216.36", "10.0.0.5"},
+	}
+
+	tests := []struct {
+		name       string
+		source     string
+		wantReason string
+	}{
+		{"Allowed host", "https://images.example.com/cat.jpg", ""},
+		{"Allowed wildcard host", "https://a.cdn.example.com/cat.jpg", ""},
+		{"Allowed bucket", "s3://my-bucket/cat.jpg", ""},
+		{"Local file", "local:///cat.jpg", ""},
+		{"Disallowed scheme", "http://images.example.com/cat.jpg", SourceRejectScheme},
+		{"Disallowed gs scheme", "gs://my-bucket/cat.jpg", SourceRejectScheme},
+		{"Disallowed host", "https://internal.example.com/cat.jpg", SourceRejectHost},
+		{"Wildcard does not match apex", "https://cdn.example.com/cat.jpg", SourceRejectHost},
+		{"Resolves to denied network", "https://evil.cdn.example.com/cat.jpg", SourceRejectDeniedIP},
+		{"Unresolvable host", "https://unknown.cdn.example.com/cat.jpg", SourceRejectUnresolvable},
+		{"Not a URL", "cat.jpg", SourceRejectInvalidURL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(context.Background(), tt.source)
+			var sourceErr *SourceError
+			switch {
+			case tt.wantReason == "" && err != nil:
+				t.Errorf("Check(%q) unexpected error: %v", tt.source, err)
+			case tt.wantReason != "" && !errors.As(err, &sourceErr):
+				t.Errorf("Check(%q) = %v, want reason %q", tt.source, err, tt.wantReason)
+			case tt.wantReason != "" && sourceErr.Reason != tt.wantReason:
+				t.Errorf("Check(%q) reason = %q, want %q", tt.source, sourceErr.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestSourcePolicyIPLiterals(t *testing.T) {
+	policy, _ := NewSourcePolicy(Config{SourceDenyCIDRs: []string{"169.254.0.0/16", "::1/128"}})
+	policy.resolver = fakeResolver{}
+
+	for _, source := range []string{"http://169.254.169.254/latest/meta-data/", "http://[::1]:8080/x.png"} {
+		if err := policy.Check(context.Background(), source); err == nil {
+			t.Errorf("expected %q to be rejected", source)
+		}
+	}
+	if err := policy.Check(context.Background(), "http://93.184.216.34/x.png"); err != nil {
+		t.Errorf("expected public IP literal to be allowed, got %v", err)
+	}
+}
+
+func TestNewSourcePolicyInvalidCIDR(t *testing.T) {
+	if _, err := NewSourcePolicy(Config{SourceDenyCIDRs: []string{"10.0.0.0/8", "not-a-cidr"}}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
+// TestHandleImageProxySourceRejected tests that disallowed sources are rejected with 403
+func TestHandleImageProxySourceRejected(t *testing.T) {
+	config := Config{
+		Key:             "0123456789abcdef0123456789abcdef",
+		Salt:            "0123456789abcdef0123456789abcdef",
+		BaseURL:         "http://localhost:8081",
+		Encode:          true,
+		SignatureSize:   32,
+		SourceDenyCIDRs: []string{"169.254.0.0/16"},
+	}
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), metrics.NewMetrics(prometheus.NewRegistry(), "test"))
+
+	rr := httptest.NewRecorder()
+	handler.HandleImageProxy(rr, httptest.NewRequest("GET", signedRequestPath(t, config, "", "http://169.254.169.254/latest/meta-data/"), nil))
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tenant resolution modes.
+const (
+	TenantModeHost = "host" // Tenants are selected by the Host header
+	TenantModePath = "path" // Tenants are selected by the first path segment, /{tenant}/...
+)
+
+// DefaultTenant is the metrics label of requests when multi-tenant mode is disabled.
+const DefaultTenant = "default"
+
+// unknownTenant is the metrics label of requests that match no tenant.
+const unknownTenant = "unknown"
+
+// Tenant holds the settings of a customer served by a shared proxy.
+// Backend settings that are empty fall back to the global configuration.
+type Tenant struct {
+	ID    string   `json:"id"`    // ID identifies the tenant and is its path segment in path mode
+	Hosts []string `json:"hosts"` // Hosts served for the tenant in host mode
+
+	Backend
+
+	AllowedSourceHosts []string `json:"allowed_source_hosts"` // AllowedSourceHosts overrides SOURCE_ALLOWED_HOSTS for the tenant
+	RateLimit          float64  `json:"rate_limit"`           // RateLimit is the sustained number of requests per second (unlimited when 0)
+	RateBurst          int      `json:"rate_burst"`           // RateBurst is the number of requests allowed at once (defaults to the rate limit)
+	MetricsLabel       string   `json:"metrics_label"`        // MetricsLabel is the tenant label on metrics (defaults to the ID)
+}
+
+// tenantsFile is the JSON document read from TENANTS_FILE.
+type tenantsFile struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+// LoadTenantsFile reads and validates a JSON tenant list.
+func LoadTenantsFile(path string) ([]Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants file: %w", err)
+	}
+
+	var file tenantsFile
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("error parsing tenants file %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	hosts := make(map[string]string) // Tenant ID by host
+	for i := range file.Tenants {
+		tenant := &file.Tenants[i]
+		if err := tenant.validate(); err != nil {
+			return nil, fmt.Errorf("invalid tenant %d in %s: %w", i, path, err)
+		}
+		if seen[tenant.ID] {
+			return nil, fmt.Errorf("duplicate tenant %q in %s", tenant.ID, path)
+		}
+		seen[tenant.ID] = true
+		for _, host := range tenant.Hosts {
+			if other, ok := hosts[host]; ok {
+				return nil, fmt.Errorf("duplicate host %q of tenants %q and %q in %s", host, other, tenant.ID, path)
+			}
+			hosts[host] = tenant.ID
+		}
+	}
+	return file.Tenants, nil
+}
+
+// validate normalises the tenant and checks its settings.
+func (t *Tenant) validate() error {
+	if t.ID == "" || strings.Contains(t.ID, "/") {
+		return fmt.Errorf("id %q must be a non-empty path segment", t.ID)
+	}
+	if t.RateLimit < 0 || t.RateBurst < 0 {
+		return fmt.Errorf("rate_limit and rate_burst must not be negative")
+	}
+	if err := t.Backend.validate(); err != nil {
+		return err
+	}
+	for i, host := range t.Hosts {
+		t.Hosts[i] = strings.ToLower(host)
+	}
+	if t.MetricsLabel == "" {
+		t.MetricsLabel = t.ID
+	}
+	return nil
+}
+
+// tenantState is a tenant with the policies built from its settings.
+type tenantState struct {
+	*Tenant
+	sources *SourcePolicy
+	limiter *rateLimiter
+}
+
+// Tenants resolves requests to tenants.
+type Tenants struct {
+	mode   string
+	byID   map[string]*tenantState
+	byHost map[string]*tenantState
+}
+
+// NewTenants builds the tenant registry from the configuration. It returns nil
+// when multi-tenant mode is disabled. Rate limiters of the previous registry,
+// which may be nil, are kept for tenants whose rate and burst are unchanged, so
+// a reload does not refill their buckets.
+func NewTenants(config Config, previous *Tenants) (*Tenants, error) {
+	if config.TenantMode == "" {
+		return nil, nil
+	}
+
+	tenants := &Tenants{
+		mode:   config.TenantMode,
+		byID:   make(map[string]*tenantState),
+		byHost: make(map[string]*tenantState),
+	}
+	for i := range config.Tenants {
+		tenant := config.Tenants[i]
+		state := &tenantState{Tenant: &tenant}
+
+		// Tenants share the global source policy unless they restrict their own hosts
+		tenantConfig := config
+		if len(tenant.AllowedSourceHosts) > 0 {
+			tenantConfig.SourceAllowedHosts = tenant.AllowedSourceHosts
+		}
+		sources, err := NewSourcePolicy(tenantConfig)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+		state.sources = sources
+
+		if tenant.RateLimit > 0 {
+			state.limiter = previous.limiter(tenant)
+			if state.limiter == nil {
+				state.limiter = newRateLimiter(tenant.RateLimit, tenant.RateBurst)
+			}
+		}
+
+		tenants.byID[tenant.ID] = state
+		for _, host := range tenant.Hosts {
+			tenants.byHost[host] = state
+		}
+	}
+	return tenants, nil
+}
+
+// limiter returns the rate limiter of the tenant with the ID of tenant if its
+// rate and burst are the same, or nil.
+func (t *Tenants) limiter(tenant Tenant) *rateLimiter {
+	if t == nil {
+		return nil
+	}
+	old, ok := t.byID[tenant.ID]
+	if !ok || old.RateLimit != tenant.RateLimit || old.RateBurst != tenant.RateBurst {
+		return nil
+	}
+	return old.limiter
+}
+
+// resolve returns the tenant of a request and the request path without the
+// tenant segment. It returns false if the request matches no tenant.
+func (t *Tenants) resolve(r *http.Request) (*tenantState, string, bool) {
+	if t.mode == TenantModePath {
+		id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		tenant, ok := t.byID[id]
+		return tenant, "/" + rest, ok
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tenant, ok := t.byHost[strings.ToLower(host)]
+	return tenant, r.URL.Path, ok
+}
+
+// rateLimiter is a token bucket allowing rate requests per second with bursts of up to burst requests.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newRateLimiter creates a full token bucket. The burst defaults to the rate, rounded up.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+// allow takes a token if one is available. Otherwise it returns false and the
+// time until the next token is available.
+func (l *rateLimiter) allow() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadTenantsFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		expectErr bool
+	}{
+		{"Valid tenants", `{"tenants":[{"id":"acme","hosts":["IMG.ACME.COM"],"key":"abcd","salt":"ef01","rate_limit":5}]}`, false},
+		{"Missing id", `{"tenants":[{"hosts":["img.acme.com"]}]}`, true},
+		{"Id with slash", `{"tenants":[{"id":"a/b"}]}`, true},
+		{"Duplicate id", `{"tenants":[{"id":"acme"},{"id":"acme"}]}`, true},
+		{"Duplicate host", `{"tenants":[{"id":"acme","hosts":["img.acme.com"]},{"id":"globex","hosts":["IMG.acme.com"]}]}`, true},
+		{"Negative rate limit", `{"tenants":[{"id":"acme","rate_limit":-1}]}`, true},
+		{"Invalid salt", `{"tenants":[{"id":"acme","salt":"xyz"}]}`, true},
+		{"Unknown field", `{"tenants":[{"id":"acme","label":"x"}]}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tenants.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			tenants, err := LoadTenantsFile(path)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("LoadTenantsFile() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && (tenants[0].MetricsLabel != "acme" || tenants[0].Hosts[0] != "img.acme.com") {
+				t.Errorf("expected defaults to be applied, got %+v", tenants[0])
+			}
+		})
+	}
+}
+
+func TestTenantsResolve(t *testing.T) {
+	tenantList := []Tenant{{ID: "acme", Hosts: []string{"img.acme.com"}}, {ID: "globex"}}
+
+	tests := []struct {
+		name         string
+		mode         string
+		host         string
+		path         string
+		expectedID   string
+		expectedPath string
+	}{
+		{"Host", TenantModeHost, "img.acme.com:443", "/sig/x", "acme", "/sig/x"},
+		{"Unknown host", TenantModeHost, "other.com", "/sig/x", "", ""},
+		{"Path", TenantModePath, "other.com", "/globex/sig/x", "globex", "/sig/x"},
+		{"Unknown path", TenantModePath, "img.acme.com", "/initech/sig/x", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenants, err := NewTenants(Config{TenantMode: tt.mode, Tenants: tenantList}, nil)
+			if err != nil {
+				t.Fatalf("NewTenants() error = %v", err)
+			}
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Host = tt.host
+
+			tenant, path, ok := tenants.resolve(req)
+			if ok != (tt.expectedID != "") {
+				t.Fatalf("resolve() ok = %v, want %v", ok, tt.expectedID != "")
+			}
+			if ok && (tenant.ID != tt.expectedID || path != tt.expectedPath) {
+				t.Errorf("resolve() = (%v, %v), want (%v, %v)", tenant.ID, path, tt.expectedID, tt.expectedPath)
+			}
+		})
+	}
+}
+
+func TestNewTenantsKeepsRateLimiters(t *testing.T) {
+	config := Config{TenantMode: TenantModePath, Tenants: []Tenant{{ID: "acme", RateLimit: 5}, {ID: "globex", RateLimit: 5}}}
+	previous, err := NewTenants(config, nil)
+	if err != nil {
+		t.Fatalf("NewTenants() error = %v", err)
+	}
+
+	config.Tenants = []Tenant{{ID: "acme", RateLimit: 5}, {ID: "globex", RateLimit: 10}}
+	tenants, err := NewTenants(config, previous)
+	if err != nil {
+		t.Fatalf("NewTenants() error = %v", err)
+	}
+	if tenants.byID["acme"].limiter != previous.byID["acme"].limiter {
+		t.Error("expected the rate limiter of an unchanged tenant to be kept")
+	}
+	if tenants.byID["globex"].limiter == previous.byID["globex"].limiter {
+		t.Error("expected a new rate limiter for a changed rate limit")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, retryAfter := limiter.allow()
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("allow() = (%v, %v), want (false, 500ms)", ok, retryAfter)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.allow(); !ok {
+		t.Error("expected a token after 500ms")
+	}
+}
+
+// TestServeHTTPTenants tests that tenants use their own keys, source hosts, rate limits and metrics label
+func TestServeHTTPTenants(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Key:           "0123456789abcdef0123456789abcdef",
+		Salt:          "0123456789abcdef0123456789abcdef",
+		BaseURL:       backend.URL,
+		Encode:        true,
+		SignatureSize: 32,
+		TenantMode:    TenantModePath,
+		Tenants: []Tenant{{
+			ID:                 "acme",
+			Backend:            Backend{Key: "fedcba9876543210", Salt: "0011223344556677"},
+			AllowedSourceHosts: []string{"cdn.acme.com"},
+			RateLimit:          1,
+			RateBurst:          2,
+			MetricsLabel:       "acme-corp",
+		}},
+	}
+	m := metrics.NewMetrics(prometheus.NewRegistry(), "test")
+	handler := NewProxyHandler(config, logging.NewLogger(logging.LevelError), m)
+	tenantConfig := config.Tenants[0].Backend.apply(config)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+	}{
+		{"Unknown tenant", "/initech" + signedRequestPath(t, config, "w:100", "https://cdn.acme.com/cat.jpg"), http.StatusNotFound},
+		{"Global key", "/acme" + signedRequestPath(t, config, "w:100", "https://cdn.acme.com/cat.jpg"), http.StatusForbidden},
+		{"Tenant key", "/acme" + signedRequestPath(t, tenantConfig, "w:100", "https://cdn.acme.com/cat.jpg"), http.StatusOK},
+		{"Rate limited", "/acme" + signedRequestPath(t, tenantConfig, "w:100", "https://cdn.acme.com/cat.jpg"), http.StatusTooManyRequests},
+	}
+
+	before := testutil.ToFloat64(m.RequestsTotal.WithLabelValues(http.StatusText(http.StatusOK), "default", "acme-corp", "other", "none"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != tt.expected {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.expected, rr.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues(http.StatusText(http.StatusOK), "default", "acme-corp", "other", "none")) - before; got != 1 {
+		t.Errorf("expected 1 request counted for the tenant label, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.RateLimited.WithLabelValues("acme-corp")); got < 1 {
+		t.Errorf("expected rate limited requests to be counted, got %v", got)
+	}
+
+	// Sources outside the tenant's allowed hosts are rejected
+	handler = NewProxyHandler(config, logging.NewLogger(logging.LevelError), m)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/acme"+signedRequestPath(t, tenantConfig, "", "https://example.com/cat.jpg"), nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d for disallowed source, want %d", rr.Code, http.StatusForbidden)
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"fmt"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -117,11 +118,13 @@ func MergeOptions(pathOpts string, queryOpts ImageOptimizationOptions) string {
 		optMap["q"] = strconv.Itoa(queryOpts.Quality)
 	}
 
-	// Build final options string
+	// Build final options string, sorted so equal requests map to the same
+	// backend URL and cache key
 	var finalOpts []string
 	for k, v := range optMap {
 		finalOpts = append(finalOpts, k+":"+v)
 	}
+	slices.Sort(finalOpts)
 	return strings.Join(finalOpts, "/")
 }
 
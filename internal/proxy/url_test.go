@@ -236,7 +236,7 @@ func TestMergeOptions(t *testing.T) {
 			name:      "Path only",
 			pathOpts:  "w:300/h:200",
 			queryOpts: ImageOptimizationOptions{},
-			expected:  "w:300/h:200",
+			expected:  "h:200/w:300",
 		},
 		{
 			name:     "Query only",
@@ -246,7 +246,7 @@ func TestMergeOptions(t *testing.T) {
 				Height:  200,
 				Quality: 90,
 			},
-			expected: "w:300/h:200/q:90",
+			expected: "h:200/q:90/w:300",
 		},
 		{
 			name:     "Override path with query",
@@ -255,47 +255,14 @@ func TestMergeOptions(t *testing.T) {
 				Width:   400,
 				Quality: 95,
 			},
-			expected: "w:400/h:200/q:95",
+			expected: "h:200/q:95/w:400",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := MergeOptions(tt.pathOpts, tt.queryOpts)
-
-			// Since map iteration order is non-deterministic, we need to check that all options are present
-			gotOptions := make(map[string]string)
-			if got != "" {
-				for _, opt := range strings.Split(got, "/") {
-					parts := strings.Split(opt, ":")
-					if len(parts) == 2 {
-						gotOptions[parts[0]] = parts[1]
-					}
-				}
-			}
-
-			expectedOptions := make(map[string]string)
-			if tt.expected != "" {
-				for _, opt := range strings.Split(tt.expected, "/") {
-					parts := strings.Split(opt, ":")
-					if len(parts) == 2 {
-						expectedOptions[parts[0]] = parts[1]
-					}
-				}
-			}
-
-			// Check that all expected options are present with correct values
-			for k, v := range expectedOptions {
-				if gotOptions[k] != v {
-					t.Errorf("MergeOptions() missing or incorrect option %s:%s, got %s:%s", k, v, k, gotOptions[k])
-				}
-			}
-
-			// Check that no unexpected options are present
-			for k := range gotOptions {
-				if _, ok := expectedOptions[k]; !ok {
-					t.Errorf("MergeOptions() has unexpected option %s:%s", k, gotOptions[k])
-				}
+			if got := MergeOptions(tt.pathOpts, tt.queryOpts); got != tt.expected {
+				t.Errorf("MergeOptions() = %v, want %v", got, tt.expected)
 			}
 		})
 	}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"imgproxy-proxy/internal/logging"
+	"imgproxy-proxy/internal/metrics"
+	"imgproxy-proxy/internal/tracing"
+)
+
+// FieldError describes an invalid configuration setting.
+type FieldError struct {
+	Field   string // Field is the environment variable name of the setting
+	Message string
+}
+
+// Error implements error.
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError []FieldError
+
+// Error implements error.
+func (e ValidationError) Error() string {
+	problems := make([]string, len(e))
+	for i, fieldErr := range e {
+		problems[i] = fieldErr.Error()
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+// add records a problem with a field.
+func (e *ValidationError) add(field string, format string, args ...any) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the validation error, or nil if no problems were found.
+func (e ValidationError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// without returns the errors about fields not listed in other, dropping
+// follow-up errors about values that already failed to decode.
+func (e ValidationError) without(other ValidationError) ValidationError {
+	var kept ValidationError
+	for _, fieldErr := range e {
+		if !slices.ContainsFunc(other, func(o FieldError) bool { return o.Field == fieldErr.Field }) {
+			kept = append(kept, fieldErr)
+		}
+	}
+	return kept
+}
+
+// Validate checks the configuration and returns a ValidationError listing all
+// invalid settings, or nil if the configuration is valid.
+func (c Config) Validate() error {
+	var errs ValidationError
+
+	// Signing and backend
+	validateHex(&errs, "IMGPROXY_KEY", c.Key, true)
+	validateHex(&errs, "IMGPROXY_SALT", c.Salt, true)
+	if c.BaseURL == "" {
+		errs.add("IMGPROXY_BASE_URL", "is required")
+	} else if !isHTTPURL(c.BaseURL) {
+		errs.add("IMGPROXY_BASE_URL", "must be an absolute http or https URL, got %q", c.BaseURL)
+	}
+	if c.SignatureSize < 1 || c.SignatureSize > 32 {
+		errs.add("IMGPROXY_SIGNATURE_SIZE", "must be between 1 and 32, got %d", c.SignatureSize)
+	}
+
+	// Server, metrics and logging
+	if c.LogLevel < logging.LevelDebug || c.LogLevel > logging.LevelFatal {
+		errs.add("LOG_LEVEL", "must be between %d and %d, got %d", logging.LevelDebug, logging.LevelFatal, c.LogLevel)
+	}
+	if c.LogFormat != "" && c.LogFormat != logging.FormatText && c.LogFormat != logging.FormatJSON {
+		errs.add("LOG_FORMAT", "must be %q or %q, got %q", logging.FormatText, logging.FormatJSON, c.LogFormat)
+	}
+	if _, err := parsePrefixes(c.LogTrustedProxies); err != nil {
+		errs.add("LOG_TRUSTED_PROXIES", "%v", err)
+	}
+	validateAddr(&errs, "SERVER_PORT", c.ServerPort, true)
+	for _, timeout := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", c.ServerReadTimeout},
+		{"SERVER_READ_HEADER_TIMEOUT", c.ServerReadHeaderTimeout},
+		{"SERVER_WRITE_TIMEOUT", c.ServerWriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", c.ServerIdleTimeout},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"SHUTDOWN_DELAY", c.ShutdownDelay},
+		{"HEALTH_CHECK_TIMEOUT", c.HealthCheckTimeout},
+		{"HEALTH_CHECK_CACHE_TTL", c.HealthCheckCacheTTL},
+	} {
+		if timeout.value < 0 {
+			errs.add(timeout.field, "must not be negative, got %v", timeout.value)
+		}
+	}
+	if c.ServerMaxHeaderBytes < 0 {
+		errs.add("SERVER_MAX_HEADER_BYTES", "must not be negative, got %d", c.ServerMaxHeaderBytes)
+	}
+	if c.HealthCheckBackendPath != "" && !strings.HasPrefix(c.HealthCheckBackendPath, "/") {
+		errs.add("HEALTH_CHECK_BACKEND_PATH", "must start with /, got %q", c.HealthCheckBackendPath)
+	}
+	if c.AccessLog != "" {
+		if _, err := logging.NewAccessLogger(io.Discard, c.AccessLogOptions()); err != nil {
+			field := "ACCESS_LOG_FORMAT"
+			if c.AccessLogFormat == logging.AccessFormatTemplate {
+				field = "ACCESS_LOG_TEMPLATE"
+			}
+			errs.add(field, "%v", err)
+		}
+		if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+			errs.add("ACCESS_LOG_SAMPLE_RATE", "must be between 0 and 1, got %v", c.AccessLogSampleRate)
+		}
+	}
+	switch c.TracesExporter {
+	case "", TracesExporterNone:
+	case TracesExporterOTLP:
+		if !isHTTPURL(c.OTLPTracesURL()) {
+			errs.add("OTEL_EXPORTER_OTLP_ENDPOINT", "must be an absolute http or https URL, got %q", c.OTLPTracesURL())
+		}
+		if _, err := tracing.ParseHeaders(c.OTLPHeaders); err != nil {
+			errs.add("OTEL_EXPORTER_OTLP_HEADERS", "%v", err)
+		}
+	default:
+		errs.add("OTEL_TRACES_EXPORTER", "must be %q or %q, got %q", TracesExporterOTLP, TracesExporterNone, c.TracesExporter)
+	}
+	if c.TracesSampleRatio < 0 || c.TracesSampleRatio > 1 {
+		errs.add("OTEL_TRACES_SAMPLER_ARG", "must be between 0 and 1, got %v", c.TracesSampleRatio)
+	}
+	if c.MetricsEnabled {
+		for _, label := range c.MetricsLabels {
+			switch label {
+			case metrics.LabelRoute, metrics.LabelTenant, metrics.LabelFormat, metrics.LabelPreset:
+			default:
+				errs.add("METRICS_LABELS", "unknown label %q, must be one of route, tenant, format and preset", label)
+			}
+		}
+		if c.MetricsLabelMaxValues < 0 {
+			errs.add("METRICS_LABEL_MAX_VALUES", "must not be negative, got %d", c.MetricsLabelMaxValues)
+		}
+		switch {
+		case !strings.HasPrefix(c.MetricsEndpoint, "/") || c.MetricsEndpoint == "/":
+			errs.add("METRICS_ENDPOINT", "must be a path below /, got %q", c.MetricsEndpoint)
+		case c.MetricsEndpoint == "/health" || c.MetricsEndpoint == "/livez" || c.MetricsEndpoint == "/readyz":
+			errs.add("METRICS_ENDPOINT", "collides with the health check endpoints")
+		case c.NextImageEnabled && c.MetricsEndpoint == c.NextImagePath:
+			errs.add("METRICS_ENDPOINT", "collides with NEXT_IMAGE_PATH")
+		}
+	}
+
+	// Cache
+	if c.CacheEnabled {
+		if c.CacheMaxSize <= 0 {
+			errs.add("CACHE_MAX_SIZE", "must be positive, got %d", c.CacheMaxSize)
+		}
+		if c.CacheMaxEntrySize <= 0 || c.CacheMaxEntrySize > c.CacheMaxSize {
+			errs.add("CACHE_MAX_ENTRY_SIZE", "must be positive and at most CACHE_MAX_SIZE, got %d", c.CacheMaxEntrySize)
+		}
+	}
+	if c.CacheTTL < 0 {
+		errs.add("CACHE_TTL", "must not be negative, got %v", c.CacheTTL)
+	}
+
+	// CORS and sources
+	if c.CORSMaxAge < 0 {
+		errs.add("CORS_MAX_AGE", "must not be negative, got %d", c.CORSMaxAge)
+	}
+	if _, err := NewSourcePolicy(c); err != nil {
+		errs.add("SOURCE_DENY_CIDRS", "%v", err)
+	}
+	for name, base := range c.SourceOrigins {
+		if u, err := url.Parse(base); err != nil || u.Scheme == "" {
+			errs.add("SOURCE_ORIGINS", "origin %q must have an absolute base URL, got %q", name, base)
+		}
+	}
+
+	// Next.js endpoint
+	if c.NextImageEnabled {
+		if !strings.HasPrefix(c.NextImagePath, "/") {
+			errs.add("NEXT_IMAGE_PATH", "must start with /, got %q", c.NextImagePath)
+		}
+		if c.NextImageBaseURL == "" && len(c.SourceAllowedHosts) == 0 {
+			errs.add("NEXT_IMAGE_ENABLED", "requires NEXT_IMAGE_BASE_URL or SOURCE_ALLOWED_HOSTS, absolute url parameters are only accepted from allowed hosts")
+		}
+		if c.NextImageBaseURL != "" && !isHTTPURL(c.NextImageBaseURL) && !strings.HasPrefix(c.NextImageBaseURL, originScheme) {
+			errs.add("NEXT_IMAGE_BASE_URL", "must be an absolute http or https URL or a named origin, got %q", c.NextImageBaseURL)
+		}
+		if len(c.NextImageDeviceSizes)+len(c.NextImageSizes) == 0 {
+			errs.add("NEXT_IMAGE_DEVICE_SIZES", "at least one width must be allowed")
+		}
+		for _, size := range append(append([]int(nil), c.NextImageDeviceSizes...), c.NextImageSizes...) {
+			if size <= 0 {
+				errs.add("NEXT_IMAGE_SIZES", "widths must be positive, got %d", size)
+			}
+		}
+		if c.NextImageDefaultQuality < 1 || c.NextImageDefaultQuality > 100 {
+			errs.add("NEXT_IMAGE_DEFAULT_QUALITY", "must be between 1 and 100, got %d", c.NextImageDefaultQuality)
+		}
+	}
+
+	// Tenants, hot reload and admin API
+	if c.TenantMode != "" {
+		if c.TenantMode != TenantModeHost && c.TenantMode != TenantModePath {
+			errs.add("TENANT_MODE", "must be %q or %q, got %q", TenantModeHost, TenantModePath, c.TenantMode)
+		}
+		if c.TenantsFile == "" {
+			errs.add("TENANTS_FILE", "is required when TENANT_MODE is set")
+		}
+	}
+	if c.ConfigWatchInterval < 0 {
+		errs.add("CONFIG_WATCH_INTERVAL", "must not be negative, got %v", c.ConfigWatchInterval)
+	}
+	if c.AdminAddr != "" {
+		validateAddr(&errs, "ADMIN_ADDR", c.AdminAddr, false)
+		if c.AdminAddr == c.ServerPort {
+			errs.add("ADMIN_ADDR", "must differ from SERVER_PORT")
+		}
+		if c.AdminToken == "" && c.AdminUsername == "" && c.AdminPassword == "" {
+			errs.add("ADMIN_TOKEN", "is required when ADMIN_ADDR is set, unless ADMIN_USERNAME and ADMIN_PASSWORD are set")
+		}
+	}
+	if (c.AdminUsername == "") != (c.AdminPassword == "") {
+		errs.add("ADMIN_PASSWORD", "ADMIN_USERNAME and ADMIN_PASSWORD must be set together")
+	}
+
+	return errs.err()
+}
+
+// validateHex checks that a setting is hex-encoded.
+func validateHex(errs *ValidationError, field string, value string, required bool) {
+	if value == "" {
+		if required {
+			errs.add(field, "is required")
+		}
+		return
+	}
+	if _, err := hex.DecodeString(value); err != nil {
+		errs.add(field, "must be hex-encoded")
+	}
+}
+
+// validateAddr checks that a setting is a host:port listen address.
+func validateAddr(errs *ValidationError, field string, value string, required bool) {
+	if value == "" {
+		if required {
+			errs.add(field, "is required")
+		}
+		return
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		errs.add(field, "must be a listen address such as :8080, got %q", value)
+	}
+}
+
+// isHTTPURL reports whether value is an absolute http or https URL.
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// decodeError converts errors from envconfig, which are prefixed with the
+// name of the Config field, e.g. `Port("abc"): ...`, into field errors.
+// It returns false if the error does not name a field.
+func decodeError(err error) (FieldError, bool) {
+	name, _, _ := strings.Cut(err.Error(), "(")
+	field, ok := reflect.TypeOf(Config{}).FieldByName(name)
+	cause := errors.Unwrap(err)
+	if !ok || cause == nil {
+		return FieldError{}, false
+	}
+	return FieldError{Field: envKey(field), Message: fmt.Sprintf("invalid %s value: %v", field.Type, cause)}, true
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a configuration passing validation, with the defaults of LoadConfig.
+func validConfig() Config {
+	return Config{
+		Key:                     "0123456789abcdef",
+		Salt:                    "fedcba9876543210",
+		BaseURL:                 "http://imgproxy:8080",
+		SignatureSize:           32,
+		LogLevel:                1,
+		ServerPort:              ":8080",
+		MetricsEnabled:          true,
+		MetricsEndpoint:         "/metrics",
+		NextImagePath:           "/_next/image",
+		NextImageDeviceSizes:    []int{640},
+		NextImageDefaultQuality: 75,
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(c *Config)
+		expected []string
+	}{
+		{"Valid", func(c *Config) {}, nil},
+		{"Missing required", func(c *Config) { c.Key, c.Salt, c.BaseURL = "", "", "" }, []string{"IMGPROXY_KEY", "IMGPROXY_SALT", "IMGPROXY_BASE_URL"}},
+		{"Malformed values", func(c *Config) {
+			c.Key = "not-hex"
+			c.BaseURL = "imgproxy:8080"
+			c.SignatureSize = 33
+			c.LogLevel = 7
+			c.LogFormat = "xml"
+		}, []string{"IMGPROXY_KEY", "IMGPROXY_BASE_URL", "IMGPROXY_SIGNATURE_SIZE", "LOG_LEVEL", "LOG_FORMAT"}},
+		{"Metrics on health path", func(c *Config) { c.MetricsEndpoint = "/health" }, []string{"METRICS_ENDPOINT"}},
+		{"Unknown metrics label", func(c *Config) { c.MetricsLabels = []string{"route", "path"} }, []string{"METRICS_LABELS"}},
+		{"Metrics disabled", func(c *Config) { c.MetricsEnabled, c.MetricsEndpoint = false, "/health" }, nil},
+		{"Cache entry larger than cache", func(c *Config) {
+			c.CacheEnabled, c.CacheMaxSize, c.CacheMaxEntrySize = true, 10, 20
+		}, []string{"CACHE_MAX_ENTRY_SIZE"}},
+		{"Invalid CIDR", func(c *Config) { c.SourceDenyCIDRs = []string{"10.0.0.0/33"} }, []string{"SOURCE_DENY_CIDRS"}},
+		{"Invalid trusted proxy", func(c *Config) { c.LogTrustedProxies = []string{"10.0.0.0/8", "proxy.local"} }, []string{"LOG_TRUSTED_PROXIES"}},
+		{"Next.js quality", func(c *Config) {
+			c.NextImageEnabled, c.NextImageBaseURL, c.NextImageDefaultQuality = true, "https://cms.example.com", 0
+		}, []string{"NEXT_IMAGE_DEFAULT_QUALITY"}},
+		{"Next.js open relay", func(c *Config) { c.NextImageEnabled = true }, []string{"NEXT_IMAGE_ENABLED"}},
+		{"Next.js allowed hosts", func(c *Config) { c.NextImageEnabled, c.SourceAllowedHosts = true, []string{"cdn.example.com"} }, nil},
+		{"Tenant mode", func(c *Config) { c.TenantMode = "header" }, []string{"TENANT_MODE", "TENANTS_FILE"}},
+		{"Admin", func(c *Config) { c.AdminAddr, c.AdminToken = ":8080", "token" }, []string{"ADMIN_ADDR"}},
+		{"Admin without auth", func(c *Config) { c.AdminAddr = "127.0.0.1:9091" }, []string{"ADMIN_TOKEN"}},
+		{"Admin with basic auth", func(c *Config) { c.AdminAddr, c.AdminUsername, c.AdminPassword = "127.0.0.1:9091", "ops", "pass" }, nil},
+		{"Admin user without password", func(c *Config) { c.AdminAddr, c.AdminUsername = "127.0.0.1:9091", "ops" }, []string{"ADMIN_PASSWORD"}},
+		{"Negative timeouts", func(c *Config) { c.ServerWriteTimeout, c.ShutdownTimeout = -time.Second, -time.Second }, []string{"SERVER_WRITE_TIMEOUT", "SHUTDOWN_TIMEOUT"}},
+		{"Bad server port", func(c *Config) { c.ServerPort = "8080" }, []string{"SERVER_PORT"}},
+		{"Access log", func(c *Config) {
+			c.AccessLog, c.AccessLogFormat, c.AccessLogTemplate, c.AccessLogSampleRate = "stdout", "template", "{{.Status", -1
+		}, []string{"ACCESS_LOG_TEMPLATE", "ACCESS_LOG_SAMPLE_RATE"}},
+		{"Tracing", func(c *Config) { c.TracesExporter, c.TracesSampleRatio = "jaeger", 2 }, []string{"OTEL_TRACES_EXPORTER", "OTEL_TRACES_SAMPLER_ARG"}},
+		{"OTLP exporter", func(c *Config) {
+			c.TracesExporter, c.OTLPEndpoint, c.OTLPHeaders = TracesExporterOTLP, "collector:4318", "api-key"
+		}, []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			tt.modify(&config)
+
+			var fields []string
+			var validationErr ValidationError
+			if err := config.Validate(); errors.As(err, &validationErr) {
+				for _, fieldErr := range validationErr {
+					fields = append(fields, fieldErr.Field)
+				}
+			}
+			if !reflect.DeepEqual(fields, tt.expected) {
+				t.Errorf("Validate() fields = %v, want %v", fields, tt.expected)
+			}
+		})
+	}
+}
+
+// TestLoadConfigErrors tests that values failing to decode are reported along with validation errors
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected []string
+	}{
+		{"Malformed and invalid values", map[string]string{
+			"IMGPROXY_SIGNATURE_SIZE": "abc",
+			"LOG_LEVEL":               "verbose",
+			"IMGPROXY_KEY":            "0123456789abcdef",
+			"IMGPROXY_SALT":           "fedcba9876543210",
+			"IMGPROXY_BASE_URL":       "ftp://x",
+		}, []string{"IMGPROXY_SIGNATURE_SIZE", "LOG_LEVEL", "IMGPROXY_BASE_URL"}},
+		{"Malformed and missing values", map[string]string{
+			"IMGPROXY_SIGNATURE_SIZE": "abc",
+			"IMGPROXY_KEY":            "zz",
+			"IMGPROXY_BASE_URL":       "ftp://x",
+		}, []string{"IMGPROXY_SIGNATURE_SIZE", "IMGPROXY_KEY", "IMGPROXY_SALT", "IMGPROXY_BASE_URL"}},
+		{"Malformed values only", map[string]string{
+			"LOG_LEVEL":           "verbose",
+			"SERVER_READ_TIMEOUT": "5",
+			"IMGPROXY_KEY":        "0123456789abcdef",
+			"IMGPROXY_SALT":       "fedcba9876543210",
+			"IMGPROXY_BASE_URL":   "http://imgproxy:8080",
+		}, []string{"LOG_LEVEL", "SERVER_READ_TIMEOUT"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			var fields []string
+			var validationErr ValidationError
+			_, err := LoadConfig()
+			if errors.As(err, &validationErr) {
+				for _, fieldErr := range validationErr {
+					fields = append(fields, fieldErr.Field)
+				}
+			}
+			if !reflect.DeepEqual(fields, tt.expected) {
+				t.Errorf("LoadConfig() fields = %v, want %v (%v)", fields, tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := validConfig()
+	config.Secret = "backend-secret"
+	config.AdminToken = "admin-token"
+	config.Routes = []Route{{Name: "r", Backend: Backend{Key: "aabb"}, AuthTokens: []string{"client-token"}}}
+	config.Tenants = []Tenant{{ID: "t", Backend: Backend{Secret: "tenant-secret"}}}
+
+	settings := strings.Join(config.Redacted().Settings(), "\n")
+	for _, secret := range []string{config.Key, config.Salt, config.Secret, config.AdminToken} {
+		if strings.Contains(settings, secret) {
+			t.Errorf("settings contain secret %q", secret)
+		}
+	}
+	if !strings.Contains(settings, "IMGPROXY_BASE_URL=http://imgproxy:8080") || !strings.Contains(settings, "NEXT_IMAGE_DEVICE_SIZES=640") {
+		t.Errorf("unexpected settings:\n%s", settings)
+	}
+
+	redacted := config.Redacted()
+	if redacted.Routes[0].Key != redactedValue || redacted.Routes[0].AuthTokens[0] != redactedValue || redacted.Tenants[0].Secret != redactedValue {
+		t.Errorf("route and tenant secrets are not redacted: %+v %+v", redacted.Routes[0], redacted.Tenants[0])
+	}
+	if config.Routes[0].AuthTokens[0] != "client-token" {
+		t.Error("Redacted() modified the original configuration")
+	}
+}
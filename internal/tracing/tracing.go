@@ -0,0 +1,129 @@
+// Package tracing configures OpenTelemetry tracing for the imgproxy proxy
+// service. Spans are exported in batches to an OTLP/HTTP collector and trace
+// context is propagated with the W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracerName is the instrumentation scope of the spans created by the proxy.
+const TracerName = "imgproxy-proxy"
+
+// TraceparentHeader is the W3C trace context header.
+const TraceparentHeader = "traceparent"
+
+// Propagator reads and writes the W3C traceparent and tracestate headers.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Config configures the export of spans to an OTLP collector.
+type Config struct {
+	Endpoint    string            // Endpoint is the URL spans are posted to, e.g. http://collector:4318/v1/traces
+	Headers     map[string]string // Headers are sent with every export request, e.g. for authentication
+	ServiceName string            // ServiceName is reported as the service.name resource attribute
+	SampleRatio float64           // SampleRatio is the ratio of new traces that are sampled, between 0 and 1
+}
+
+// NewProvider creates a tracer provider exporting spans in batches to an OTLP
+// collector over HTTP. New traces are sampled with the configured ratio; traces
+// continued from another service follow the sampling decision of the caller.
+// The provider must be shut down to flush the last spans.
+func NewProvider(config Config) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.Endpoint),
+		otlptracehttp.WithHeaders(config.Headers),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+	return newProvider(config, sdktrace.WithBatcher(exporter))
+}
+
+// newProvider creates a tracer provider with the resource and sampler of
+// config, passing finished spans to the span processor set by export.
+func newProvider(config Config, export sdktrace.TracerProviderOption) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", config.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		export,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	), nil
+}
+
+// Tracer returns the tracer of the proxy from provider, or a tracer creating
+// non-recording spans when provider is nil.
+func Tracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+	return provider.Tracer(TracerName)
+}
+
+// Extract returns a context continuing the trace of the traceparent header, if
+// it is valid. Invalid headers are ignored and a new trace is started instead.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return Propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the traceparent header to the span context in ctx, so the
+// receiver continues the trace. Without a span context it does nothing.
+func Inject(ctx context.Context, header http.Header) {
+	Propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// RecordError records err on the span and marks the span as failed. A nil
+// error is ignored.
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// SetHTTPStatus records the HTTP response status code on a span of the given
+// kind. Following the OpenTelemetry semantic conventions, 5xx responses are
+// errors of server spans and 4xx and 5xx responses are errors of client spans.
+func SetHTTPStatus(span trace.Span, kind trace.SpanKind, code int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", code))
+	if code >= 500 || (code >= 400 && kind == trace.SpanKindClient) {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+}
+
+// ParseHeaders parses headers in the format of OTEL_EXPORTER_OTLP_HEADERS:
+// comma-separated key=value pairs with URL-encoded values.
+func ParseHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, encoded, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid header %q, want key=value", pair)
+		}
+		decoded, err := url.PathUnescape(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of header %q: %w", key, err)
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
@@ -0,0 +1,222 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestProvider creates a provider recording spans synchronously in exporter.
+func newTestProvider(t *testing.T, exporter *tracetest.InMemoryExporter, ratio float64) *sdktrace.TracerProvider {
+	t.Helper()
+	provider, err := newProvider(Config{ServiceName: "imgproxy-proxy", SampleRatio: ratio}, sdktrace.WithSyncer(exporter))
+	if err != nil {
+		t.Fatalf("newProvider() error = %v", err)
+	}
+	return provider
+}
+
+func TestPropagation(t *testing.T) {
+	tracer := Tracer(newTestProvider(t, tracetest.NewInMemoryExporter(), 1))
+	incoming := http.Header{}
+	incoming.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, span := tracer.Start(Extract(context.Background(), incoming), "server", trace.WithSpanKind(trace.SpanKindServer))
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+
+	sc := span.SpanContext()
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("span did not continue the incoming trace: %v", sc.TraceID())
+	}
+	if got, want := outgoing.Get(TraceparentHeader), "00-"+sc.TraceID().String()+"-"+sc.SpanID().String()+"-01"; got != want {
+		t.Errorf("Inject() = %q, want %q", got, want)
+	}
+
+	// Invalid headers start a new trace
+	incoming.Set(TraceparentHeader, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	if sc := trace.SpanContextFromContext(Extract(context.Background(), incoming)); sc.IsValid() {
+		t.Errorf("Extract() accepted an all-zero trace ID: %v", sc.TraceID())
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tests := []struct {
+		name        string
+		ratio       float64
+		traceparent string
+		recorded    bool
+	}{
+		{"Always", 1, "", true},
+		{"Never", 0, "", false},
+		{"Sampled by caller", 0, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"Not sampled by caller", 1, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tracer := Tracer(newTestProvider(t, exporter, tt.ratio))
+			header := http.Header{}
+			if tt.traceparent != "" {
+				header.Set(TraceparentHeader, tt.traceparent)
+			}
+
+			ctx, span := tracer.Start(Extract(context.Background(), header), "server", trace.WithSpanKind(trace.SpanKindServer))
+			_, child := tracer.Start(ctx, "child")
+			child.End()
+			span.End()
+
+			if got := len(exporter.GetSpans()) == 2; got != tt.recorded {
+				t.Errorf("got %d exported spans, recorded = %v", len(exporter.GetSpans()), tt.recorded)
+			}
+			if !span.SpanContext().IsValid() {
+				t.Error("unsampled span has no span context to propagate")
+			}
+		})
+	}
+}
+
+func TestSpanStatus(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := Tracer(newTestProvider(t, exporter, 1))
+
+	ctx, server := tracer.Start(context.Background(), "GET", trace.WithSpanKind(trace.SpanKindServer))
+	_, client := tracer.Start(ctx, "fetch", trace.WithSpanKind(trace.SpanKindClient))
+	SetHTTPStatus(client, trace.SpanKindClient, http.StatusNotFound)
+	client.End()
+	_, internal := tracer.Start(ctx, "generate_url")
+	RecordError(internal, nil)
+	internal.End()
+	SetHTTPStatus(server, trace.SpanKindServer, http.StatusNotFound)
+	server.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	if spans[0].Parent.SpanID() != server.SpanContext().SpanID() || spans[0].Status.Code != codes.Error {
+		t.Errorf("client span = %+v, want a failed child of the server span", spans[0])
+	}
+	if spans[1].Status.Code != codes.Unset || len(spans[1].Events) != 0 {
+		t.Errorf("RecordError(nil) changed the span: %+v", spans[1])
+	}
+	if spans[2].Parent.IsValid() || spans[2].Status.Code != codes.Unset {
+		t.Errorf("server span = %+v, want an unset root span", spans[2])
+	}
+	if !hasAttribute(spans[2].Attributes, attribute.Int("http.response.status_code", http.StatusNotFound)) {
+		t.Errorf("server span attributes = %v, want the status code", spans[2].Attributes)
+	}
+
+	exporter.Reset()
+	_, span := tracer.Start(context.Background(), "verify_signature")
+	RecordError(span, errors.New("invalid key"))
+	span.End()
+	if got := exporter.GetSpans()[0].Status; got.Code != codes.Error || got.Description != "invalid key" {
+		t.Errorf("RecordError() status = %+v, want an error", got)
+	}
+
+	// A nil provider creates non-recording spans
+	if _, span := Tracer(nil).Start(context.Background(), "noop"); span.IsRecording() {
+		t.Error("Tracer(nil) created a recording span")
+	}
+}
+
+// hasAttribute reports whether attrs contains want.
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{"", map[string]string{}, false},
+		{"api-key=secret,x-scope=a%20b", map[string]string{"api-key": "secret", "x-scope": "a b"}, false},
+		{"novalue", nil, true},
+	}
+	for _, tt := range tests {
+		headers, err := ParseHeaders(tt.value)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(headers, tt.expected)) {
+			t.Errorf("ParseHeaders(%q) = %v, %v, want %v", tt.value, headers, err, tt.expected)
+		}
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	requests := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Api-Key") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		request := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	provider, err := NewProvider(Config{
+		Endpoint:    collector.URL + "/v1/traces",
+		Headers:     map[string]string{"Api-Key": "secret"},
+		ServiceName: "imgproxy-proxy",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider() error = %v", err)
+	}
+	ctx, parent := Tracer(provider).Start(context.Background(), "parent", trace.WithSpanKind(trace.SpanKindServer))
+	_, child := Tracer(provider).Start(ctx, "child")
+	child.End()
+	parent.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	var request *coltracepb.ExportTraceServiceRequest
+	select {
+	case request = <-requests:
+	default:
+		t.Fatal("no spans were exported")
+	}
+	resource := request.ResourceSpans[0]
+	serviceName := ""
+	for _, attr := range resource.Resource.GetAttributes() {
+		if attr.Key == "service.name" {
+			serviceName = attr.Value.GetStringValue()
+		}
+	}
+	if serviceName != "imgproxy-proxy" {
+		t.Errorf("service.name = %q, want imgproxy-proxy", serviceName)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if string(spans[0].ParentSpanId) != string(spans[1].SpanId) || len(spans[1].ParentSpanId) != 0 {
+		t.Errorf("exported spans %v, want a child and its root", spans)
+	}
+}